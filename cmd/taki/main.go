@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/bindernews/taki/pkg/fsdiff"
 	"github.com/bindernews/taki/pkg/imager"
 	"github.com/spf13/cobra"
 )
@@ -15,6 +16,21 @@ var (
 	targetPods      []string
 	targetContainer string
 	imagePath       string
+	baselineDir     string
+	platform        string
+	workers         int
+	maxIO           int
+	digests         string
+	fastMode        bool
+	excludeRules    []string
+	excludeFrom     string
+	exports         string
+	baseDepth       int
+	knownGood       []string
+	knownBad        []string
+	skipKnownGood   bool
+	overlayMode     bool
+	textDiffSize    int64
 )
 
 func init() {
@@ -27,8 +43,99 @@ func init() {
 		`the container to image in the given pod(s)`)
 	rootCmd.MarkFlagRequired("container")
 	rootCmd.Flags().StringVar(&imagePath, "image", "",
-		`local path to base image to compare against`)
-	rootCmd.MarkFlagRequired("image")
+		`local path to base image to compare against (docker save archive, OCI image-layout, or root filesystem tar), without it files are checked against the container's dpkg, apk or rpm database`)
+	rootCmd.Flags().IntVar(&workers, "workers", 0,
+		`number of files to hash at once in the target container (default: number of CPUs on the node)`)
+	rootCmd.Flags().IntVar(&maxIO, "max-io", 0,
+		`maximum number of files to read at once in the target container (default: same as --workers)`)
+	rootCmd.Flags().StringVar(&digests, "digests", "",
+		`comma-separated digests to compute for added and modified files in addition to sha256, e.g. md5,sha1`)
+	rootCmd.Flags().BoolVar(&fastMode, "fast", false,
+		`only hash files whose size, mode or modification time differ from the base image, skipped files are listed in the archive`)
+	rootCmd.Flags().StringArrayVar(&excludeRules, "exclude", []string{},
+		`exclude rule such as '/proc/**', '**/__pycache__' or '*.log size>1G', may be given multiple times`)
+	rootCmd.Flags().StringVar(&excludeFrom, "exclude-from", "",
+		`file of exclude rules, one per line, applied before any --exclude rules`)
+	rootCmd.Flags().StringVar(&exports, "export", "jsonl,csv,bodyfile",
+		`comma-separated formats to write the diff in next to the archive (jsonl, csv, bodyfile, privesc, persistence, config, patch, elf, known-bad), empty for none`)
+	rootCmd.Flags().Int64Var(&textDiffSize, "text-diff-size", 64*1024,
+		`largest modified text file to write a unified diff of, only used by the patch export, 0 to disable`)
+	rootCmd.Flags().IntVar(&baseDepth, "base-depth", 0,
+		`send the base image this many directory levels at a time, only sending deeper levels that changed (default: send it all at once)`)
+	rootCmd.Flags().StringArrayVar(&knownGood, "known-good", []string{},
+		`file of known-good hashes (one md5, sha1 or sha256 per line, or NSRL-style CSV), may be given multiple times`)
+	rootCmd.Flags().StringArrayVar(&knownBad, "known-bad", []string{},
+		`file of known-bad hashes in the same formats as --known-good, may be given multiple times`)
+	rootCmd.Flags().BoolVar(&skipKnownGood, "skip-known-good", false,
+		`don't collect added files whose hashes are known-good, they are still listed in the diff`)
+	rootCmd.Flags().BoolVar(&overlayMode, "overlay", false,
+		`diff the upper directory of the container's overlay filesystem instead of using --image, the debug container needs access to the node's filesystem`)
+	rootCmd.PersistentFlags().StringVar(&baselineDir, "baseline-dir", "",
+		`directory of stored base image baselines, set to "none" to disable (default: user cache dir)`)
+	rootCmd.PersistentFlags().StringVar(&platform, "platform", "",
+		`platform of the base image to use if --image holds several, e.g. linux/amd64 or linux/arm/v7`)
+
+	baselineCmd.Flags().StringVar(&imagePath, "image", "",
+		`local path to the base image to build a baseline for`)
+	baselineCmd.MarkFlagRequired("image")
+	rootCmd.AddCommand(baselineCmd)
+}
+
+// Creates the image cache for --platform, using the on-disk baseline store unless
+// it's disabled.
+func newImageCache() (*imager.ImageCache, error) {
+	cache := imager.NewImageCache()
+	var err error
+	if cache.Platform, err = imager.ParsePlatform(platform); err != nil {
+		return nil, err
+	}
+	dir := baselineDir
+	if dir == "none" {
+		return cache, nil
+	}
+	if dir == "" {
+		if dir, err = imager.DefaultMetaStoreDir(); err != nil {
+			return nil, err
+		}
+	}
+	cache.Store = imager.NewMetaStore(dir)
+	return cache, nil
+}
+
+// Loads the rules from --exclude-from followed by the --exclude rules.
+func loadRules() (*fsdiff.RuleSet, error) {
+	rules := &fsdiff.RuleSet{}
+	if excludeFrom != "" {
+		var err error
+		if rules, err = fsdiff.LoadRules(excludeFrom); err != nil {
+			return nil, err
+		}
+	}
+	for _, line := range excludeRules {
+		if err := rules.Add(line); err != nil {
+			return nil, fmt.Errorf("'%s': %w", line, err)
+		}
+	}
+	return rules, nil
+}
+
+// Loads the --known-good and --known-bad hash sets, returns nil if there are none.
+func loadHashSet() (*fsdiff.HashSet, error) {
+	if len(knownGood) == 0 && len(knownBad) == 0 {
+		return nil, nil
+	}
+	hs := fsdiff.NewHashSet()
+	for _, fpath := range knownGood {
+		if err := hs.LoadFile(fpath, fsdiff.KnownGood); err != nil {
+			return nil, err
+		}
+	}
+	for _, fpath := range knownBad {
+		if err := hs.LoadFile(fpath, fsdiff.KnownBad); err != nil {
+			return nil, err
+		}
+	}
+	return hs, nil
 }
 
 var rootCmd = &cobra.Command{
@@ -39,11 +146,48 @@ var rootCmd = &cobra.Command{
 		ctx, cancelFn := context.WithCancel(context.Background())
 		defer cancelFn()
 
+		cache, err := newImageCache()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error setting up the image cache: '%s'", err)
+			return
+		}
+		digestAlgos, err := fsdiff.ParseHashAlgos(digests)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --digests: '%s'", err)
+			return
+		}
+		exportFormats, err := fsdiff.ParseExportFormats(exports)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --export: '%s'", err)
+			return
+		}
+		rules, err := loadRules()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid exclude rules: '%s'", err)
+			return
+		}
+		hashSet, err := loadHashSet()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error loading hash sets: '%s'", err)
+			return
+		}
 		config := imager.ImagerConfig{
-			KubectlCmd: strings.Split(kubectlCmd, " "),
-			Pod:        "",
-			Container:  targetContainer,
-			BaseImage:  imagePath,
+			KubectlCmd:    strings.Split(kubectlCmd, " "),
+			Pod:           "",
+			Container:     targetContainer,
+			BaseImage:     imagePath,
+			MetaCache:     cache,
+			Workers:       workers,
+			MaxIO:         maxIO,
+			Digests:       digestAlgos,
+			Fast:          fastMode,
+			Rules:         rules,
+			Exports:       exportFormats,
+			BaseDepth:     baseDepth,
+			HashSet:       hashSet,
+			SkipKnownGood: skipKnownGood,
+			Overlay:       overlayMode,
+			TextDiffSize:  textDiffSize,
 		}
 		for i, err := range imager.SimpleImagePods(ctx, config, targetPods) {
 			if err != nil {
@@ -53,6 +197,32 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+var baselineCmd = &cobra.Command{
+	Use:   "baseline",
+	Short: "Build and store the baseline for a base image ahead of time",
+	Long:  `Reads a base image and stores its metadata in the baseline directory, so later runs against that image don't have to re-read it. The stored files may be shared with other machines.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cache, err := newImageCache()
+		if err != nil {
+			return err
+		}
+		if cache.Store == nil {
+			return fmt.Errorf("baseline store is disabled")
+		}
+		req := cache.Request(imagePath)
+		<-req.Done()
+		if err := req.Err(); err != nil {
+			return err
+		}
+		fpath, err := cache.Store.Path(req.Digest)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %s\n", req.Digest, fpath)
+		return nil
+	},
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "There was an error while executing taki '%s'", err)
@@ -4,11 +4,11 @@ go 1.19
 
 require (
 	github.com/samber/lo v1.35.0
+	github.com/spf13/cobra v1.7.0
 	golang.org/x/exp v0.0.0-20221114191408-850992195362
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/spf13/cobra v1.7.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 )
@@ -0,0 +1,571 @@
+package fsdiff
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"math"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Size of the binary digests stored in a CompactTree
+const compactDigestSize = 32
+
+// Bits of CompactTree.Flags
+const (
+	// Digests holds the entry's hash, or TreeHash for directories
+	compactHasDigest uint8 = 1 << iota
+	// The directory is Implicit
+	compactImplicit
+	// The directory is Partial
+	compactPartial
+)
+
+// Stored instead of the Unix time for times that aren't set
+const compactNoTime = math.MinInt64
+
+// A DirMeta packed into a flat table, which takes a fraction of the memory and
+// encodes much faster. Entries are stored in depth-first order with the entries of
+// each directory sorted by name, each field in its own column. Names are interned
+// and hashes are stored as binary. Fields most entries don't have are kept in Extras.
+//
+// Comparing CompactTrees gives the same results as comparing the DirMetas they
+// were built from.
+type CompactTree struct {
+	// Interned entry names
+	Names []string
+	// Index into Names, for each entry. The first entry is the root directory.
+	Name []uint32
+	// Number of entries in the subtree of each entry, including itself
+	Count []uint32
+	Mode  []uint32
+	Uid   []uint32
+	Gid   []uint32
+	Size  []int64
+	// Unix times in seconds, or compactNoTime. Nanoseconds are stored apart so any
+	// time fits, like in a DirMeta.
+	ModTime    []int64
+	ChangeTime []int64
+	AccessTime []int64
+	ModNsec    []uint32
+	ChangeNsec []uint32
+	AccessNsec []uint32
+	// compactDigestSize bytes for each entry, see compactHasDigest
+	Digests []byte
+	Flags   []uint8
+	// Index into Extras plus one, 0 for entries without extra fields
+	Extra  []uint32
+	Extras []CompactExtra
+}
+
+// Fields of a CompactTree entry which most entries don't have
+type CompactExtra struct {
+	// Hash, if it can't be stored in binary
+	Hash     string
+	Hashes   map[HashAlgo]string
+	Link     string
+	HardLink string
+	DevMajor uint32
+	DevMinor uint32
+	Xattrs   map[string]string
+	// StatHash of directories
+	StatHash string
+}
+
+// Packs 'd' into a new CompactTree.
+func NewCompactTree(d *DirMeta) *CompactTree {
+	n := d.CountTree() + 1
+	t := &CompactTree{
+		Name:       make([]uint32, 0, n),
+		Count:      make([]uint32, 0, n),
+		Mode:       make([]uint32, 0, n),
+		Uid:        make([]uint32, 0, n),
+		Gid:        make([]uint32, 0, n),
+		Size:       make([]int64, 0, n),
+		ModTime:    make([]int64, 0, n),
+		ChangeTime: make([]int64, 0, n),
+		AccessTime: make([]int64, 0, n),
+		ModNsec:    make([]uint32, 0, n),
+		ChangeNsec: make([]uint32, 0, n),
+		AccessNsec: make([]uint32, 0, n),
+		Digests:    make([]byte, 0, n*compactDigestSize),
+		Flags:      make([]uint8, 0, n),
+		Extra:      make([]uint32, 0, n),
+	}
+	p := compactPacker{t: t, names: make(map[string]uint32)}
+	p.addDir(d)
+	return t
+}
+
+type compactPacker struct {
+	t     *CompactTree
+	names map[string]uint32
+}
+
+func (p *compactPacker) addDir(d *DirMeta) {
+	var flags uint8
+	if d.Implicit {
+		flags |= compactImplicit
+	}
+	if d.Partial {
+		flags |= compactPartial
+	}
+	i := p.add(&d.FileMeta, d.TreeHash, d.StatHash, flags)
+	names := make([]string, 0, len(d.Files)+len(d.Dirs))
+	names = append(names, maps.Keys(d.Files)...)
+	names = append(names, maps.Keys(d.Dirs)...)
+	slices.Sort(names)
+	for _, name := range names {
+		if fm := d.Files[name]; fm != nil {
+			p.add(fm, fm.Hash, "", 0)
+		} else {
+			p.addDir(d.Dirs[name])
+		}
+	}
+	p.t.Count[i] = uint32(len(p.t.Name) - i)
+}
+
+// Appends one entry, with 'digest' as its hex digest. Returns its index.
+func (p *compactPacker) add(fm *FileMeta, digest string, statHash string, flags uint8) int {
+	t := p.t
+	id, ok := p.names[fm.Name]
+	if !ok {
+		id = uint32(len(t.Names))
+		t.Names = append(t.Names, fm.Name)
+		p.names[fm.Name] = id
+	}
+	extra := CompactExtra{
+		Hashes:   fm.Hashes,
+		Link:     fm.Link,
+		HardLink: fm.HardLink,
+		DevMajor: fm.DevMajor,
+		DevMinor: fm.DevMinor,
+		Xattrs:   fm.Xattrs,
+		StatHash: statHash,
+	}
+	var raw [compactDigestSize]byte
+	if digest != "" {
+		if len(digest) == 2*compactDigestSize {
+			if _, err := hex.Decode(raw[:], []byte(digest)); err == nil {
+				flags |= compactHasDigest
+			}
+		}
+		if flags&compactHasDigest == 0 {
+			extra.Hash = digest
+		}
+	}
+	extraIdx := uint32(0)
+	if extra.Hash != "" || len(extra.Hashes) > 0 || extra.Link != "" || extra.HardLink != "" ||
+		extra.DevMajor != 0 || extra.DevMinor != 0 || len(extra.Xattrs) > 0 || extra.StatHash != "" {
+		t.Extras = append(t.Extras, extra)
+		extraIdx = uint32(len(t.Extras))
+	}
+	t.Name = append(t.Name, id)
+	t.Count = append(t.Count, 1)
+	t.Mode = append(t.Mode, uint32(fm.Mode))
+	t.Uid = append(t.Uid, uint32(fm.Uid))
+	t.Gid = append(t.Gid, uint32(fm.Gid))
+	t.Size = append(t.Size, fm.Size)
+	t.addTimes(fm)
+	t.Digests = append(t.Digests, raw[:]...)
+	t.Flags = append(t.Flags, flags)
+	t.Extra = append(t.Extra, extraIdx)
+	return len(t.Name) - 1
+}
+
+func (t *CompactTree) addTimes(fm *FileMeta) {
+	sec, nsec := packTime(fm.ModTime)
+	t.ModTime, t.ModNsec = append(t.ModTime, sec), append(t.ModNsec, nsec)
+	sec, nsec = packTime(fm.ChangeTime)
+	t.ChangeTime, t.ChangeNsec = append(t.ChangeTime, sec), append(t.ChangeNsec, nsec)
+	sec, nsec = packTime(fm.AccessTime)
+	t.AccessTime, t.AccessNsec = append(t.AccessTime, sec), append(t.AccessNsec, nsec)
+}
+
+func packTime(tm time.Time) (int64, uint32) {
+	if tm.IsZero() {
+		return compactNoTime, 0
+	}
+	return tm.Unix(), uint32(tm.Nanosecond())
+}
+
+func unpackTime(sec int64, nsec uint32) time.Time {
+	if sec == compactNoTime {
+		return time.Time{}
+	}
+	return time.Unix(sec, int64(nsec))
+}
+
+// Returns the number of entries, including the root directory.
+func (t *CompactTree) Len() int {
+	return len(t.Name)
+}
+
+// Returns the TreeHash of the root directory, or an empty string if it wasn't
+// computed before packing.
+func (t *CompactTree) TreeHash() string {
+	return (&compactDir{t: t}).subtreeHash()
+}
+
+// Returns the metadata of entry 'i', and its hex digest (TreeHash for directories).
+func (t *CompactTree) meta(i int) (*FileMeta, string) {
+	fm := &FileMeta{
+		Name:       t.Names[t.Name[i]],
+		Mode:       fs.FileMode(t.Mode[i]),
+		Size:       t.Size[i],
+		Uid:        int(t.Uid[i]),
+		Gid:        int(t.Gid[i]),
+		ModTime:    unpackTime(t.ModTime[i], t.ModNsec[i]),
+		ChangeTime: unpackTime(t.ChangeTime[i], t.ChangeNsec[i]),
+		AccessTime: unpackTime(t.AccessTime[i], t.AccessNsec[i]),
+	}
+	var digest string
+	if t.Flags[i]&compactHasDigest != 0 {
+		digest = hex.EncodeToString(t.Digests[i*compactDigestSize : (i+1)*compactDigestSize])
+	}
+	if x := t.Extra[i]; x != 0 {
+		extra := &t.Extras[x-1]
+		if extra.Hash != "" {
+			digest = extra.Hash
+		}
+		fm.Hashes = extra.Hashes
+		fm.Link = extra.Link
+		fm.HardLink = extra.HardLink
+		fm.DevMajor = extra.DevMajor
+		fm.DevMinor = extra.DevMinor
+		fm.Xattrs = extra.Xattrs
+	}
+	return fm, digest
+}
+
+// Unpacks the tree into a new DirMeta.
+func (t *CompactTree) DirMeta() *DirMeta {
+	if t.Len() == 0 {
+		return NewDirMeta("")
+	}
+	return t.unpackDir(0)
+}
+
+func (t *CompactTree) unpackDir(i int) *DirMeta {
+	fm, digest := t.meta(i)
+	dm := &DirMeta{
+		FileMeta: *fm,
+		TreeHash: digest,
+		StatHash: t.statHash(i),
+		Implicit: t.Flags[i]&compactImplicit != 0,
+		Partial:  t.Flags[i]&compactPartial != 0,
+	}
+	dm.InitMaps()
+	end := i + int(t.Count[i])
+	for j := i + 1; j < end; j += int(t.Count[j]) {
+		if fs.FileMode(t.Mode[j]).IsDir() {
+			dm.AddDir(t.unpackDir(j))
+		} else {
+			fm, digest := t.meta(j)
+			fm.Hash = digest
+			dm.AddFile(fm)
+		}
+	}
+	return dm
+}
+
+// Compare two compact trees, building a full diff of them. The result is the same as
+// comparing the DirMetas they were built from.
+func (d *FsDiff) CompareCompact(lt *CompactTree, rt *CompactTree) error {
+	c := comparer{fn: d.Add}
+	return c.compareDirs("", &compactDir{t: lt}, &compactDir{t: rt})
+}
+
+// A directory of a CompactTree
+type compactDir struct {
+	t *CompactTree
+	// Index of the directory entry
+	i int
+}
+
+// Implement treeDir.list
+func (d *compactDir) list() ([]treeEntry, error) {
+	t := d.t
+	if t.Len() == 0 {
+		return nil, nil
+	}
+	entries := make([]treeEntry, 0)
+	end := d.i + int(t.Count[d.i])
+	for j := d.i + 1; j < end; j += int(t.Count[j]) {
+		fm, digest := t.meta(j)
+		te := treeEntry{meta: fm}
+		if fm.Mode.IsDir() {
+			te.dir = &compactDir{t: t, i: j}
+			te.implicit = t.Flags[j]&compactImplicit != 0
+		} else {
+			fm.Hash = digest
+		}
+		entries = append(entries, te)
+	}
+	return entries, nil
+}
+
+// Implement subtreeDir.subtreeHash
+func (d *compactDir) subtreeHash() string {
+	if d.t.Len() == 0 || d.t.Flags[d.i]&compactHasDigest == 0 {
+		return ""
+	}
+	_, digest := d.t.meta(d.i)
+	return digest
+}
+
+// Implement subtreeDir.partialMeta
+func (d *compactDir) partialMeta() *DirMeta {
+	if d.t.Len() == 0 || d.t.Flags[d.i]&compactPartial == 0 {
+		return nil
+	}
+	return d.t.unpackDir(d.i)
+}
+
+// Returns the index of the directory at 'fpath', or -1 if there is none.
+func (t *CompactTree) findDir(fpath string) int {
+	if t.Len() == 0 {
+		return -1
+	}
+	i := 0
+	fpath = cleanPath(fpath)
+	if fpath == "." {
+		return i
+	}
+	for _, name := range strings.Split(fpath, "/") {
+		next := -1
+		end := i + int(t.Count[i])
+		for j := i + 1; j < end; j += int(t.Count[j]) {
+			if t.Names[t.Name[j]] == name {
+				next = j
+				break
+			}
+		}
+		if next < 0 || !fs.FileMode(t.Mode[next]).IsDir() {
+			return -1
+		}
+		i = next
+	}
+	return i
+}
+
+// Returns the subtree of the directory at 'fpath', or nil if there is none. The
+// subtree shares all of its data with 't'.
+func (t *CompactTree) Subtree(fpath string) *CompactTree {
+	i := t.findDir(fpath)
+	if i < 0 {
+		return nil
+	}
+	if i == 0 {
+		return t
+	}
+	end := i + int(t.Count[i])
+	return &CompactTree{
+		Names:      t.Names,
+		Name:       t.Name[i:end],
+		Count:      t.Count[i:end],
+		Mode:       t.Mode[i:end],
+		Uid:        t.Uid[i:end],
+		Gid:        t.Gid[i:end],
+		Size:       t.Size[i:end],
+		ModTime:    t.ModTime[i:end],
+		ChangeTime: t.ChangeTime[i:end],
+		AccessTime: t.AccessTime[i:end],
+		ModNsec:    t.ModNsec[i:end],
+		ChangeNsec: t.ChangeNsec[i:end],
+		AccessNsec: t.AccessNsec[i:end],
+		Digests:    t.Digests[i*compactDigestSize : end*compactDigestSize],
+		Flags:      t.Flags[i:end],
+		Extra:      t.Extra[i:end],
+		Extras:     t.Extras,
+	}
+}
+
+// Returns a copy of the tree that only goes 'depth' levels deep, like
+// DirMeta.Truncate. Only the names and extra fields of the copied entries are kept,
+// so truncating a Subtree doesn't carry the whole tree along. A depth below 1
+// returns 't' itself.
+func (t *CompactTree) Truncate(depth int) *CompactTree {
+	if depth < 1 || t.Len() == 0 {
+		return t
+	}
+	c := newCompactCopier(t)
+	c.truncateDir(0, depth)
+	return c.dst
+}
+
+func (c *compactCopier) truncateDir(i int, depth int) {
+	t := c.src
+	di := c.copy(i)
+	end := i + int(t.Count[i])
+	for j := i + 1; j < end; j += int(t.Count[j]) {
+		switch {
+		case !fs.FileMode(t.Mode[j]).IsDir():
+			c.copy(j)
+		case depth == 1:
+			c.dst.Flags[c.copy(j)] |= compactPartial
+		default:
+			c.truncateDir(j, depth-1)
+		}
+	}
+	c.dst.Count[di] = uint32(c.dst.Len() - di)
+}
+
+// Returns a copy of the tree without the entries the rules exclude by path alone,
+// like RuleSet.Filter. The TreeHash of each directory that lost entries is updated.
+// A nil or empty RuleSet returns 't' itself.
+func (t *CompactTree) Filter(rs *RuleSet) *CompactTree {
+	if rs == nil || len(rs.Rules) == 0 || t.Len() == 0 {
+		return t
+	}
+	c := newCompactCopier(t)
+	c.filterDir(rs, 0, "")
+	return c.dst
+}
+
+// Copies directory 'i' and the entries below it that 'rs' doesn't exclude. Returns
+// true if any were left out.
+func (c *compactCopier) filterDir(rs *RuleSet, i int, root string) bool {
+	t := c.src
+	di := c.copy(i)
+	changed := false
+	end := i + int(t.Count[i])
+	for j := i + 1; j < end; j += int(t.Count[j]) {
+		fpath := root + t.Names[t.Name[j]]
+		if rs.PathExcluded(fpath) {
+			changed = true
+		} else if fs.FileMode(t.Mode[j]).IsDir() {
+			changed = c.filterDir(rs, j, fpath+"/") || changed
+		} else {
+			c.copy(j)
+		}
+	}
+	c.dst.Count[di] = uint32(c.dst.Len() - di)
+	if changed && c.dst.Flags[di]&compactHasDigest != 0 && c.dst.Flags[di]&compactPartial == 0 {
+		c.dst.updateDirHash(di)
+	}
+	return changed
+}
+
+// Returns the StatHash of directory 'i', or an empty string if it wasn't computed.
+func (t *CompactTree) statHash(i int) string {
+	if x := t.Extra[i]; x != 0 {
+		return t.Extras[x-1].StatHash
+	}
+	return ""
+}
+
+// Recomputes the TreeHash and StatHash of directory 'i' from the entries directly
+// below it, like DirMeta.UpdateTreeHash.
+func (t *CompactTree) updateDirHash(i int) {
+	h := sha256.New()
+	sh := sha256.New()
+	end := i + int(t.Count[i])
+	for j := i + 1; j < end; j += int(t.Count[j]) {
+		fm, digest := t.meta(j)
+		if fm.Mode.IsDir() {
+			implicit := t.Flags[j]&compactImplicit != 0
+			writeDirHash(h, fm, implicit, digest)
+			writeDirHash(sh, fm, implicit, t.statHash(j))
+		} else {
+			writeFileHash(h, fm, digest)
+			writeFileHash(sh, fm, "")
+		}
+	}
+	copy(t.Digests[i*compactDigestSize:], h.Sum(nil))
+	if x := t.Extra[i]; x != 0 && t.Extras[x-1].StatHash != "" {
+		t.Extras[x-1].StatHash = hex.EncodeToString(sh.Sum(nil))
+	}
+}
+
+// Copies entries of one CompactTree into a new one, with their names and extra
+// fields interned again.
+type compactCopier struct {
+	src *CompactTree
+	dst *CompactTree
+	// Index in dst.Names for each index in src.Names that was copied
+	names map[uint32]uint32
+}
+
+func newCompactCopier(src *CompactTree) *compactCopier {
+	return &compactCopier{src: src, dst: &CompactTree{}, names: make(map[uint32]uint32)}
+}
+
+// Appends entry 'i' of the source, with a Count of 1. Returns its index.
+func (c *compactCopier) copy(i int) int {
+	src, dst := c.src, c.dst
+	id, ok := c.names[src.Name[i]]
+	if !ok {
+		id = uint32(len(dst.Names))
+		dst.Names = append(dst.Names, src.Names[src.Name[i]])
+		c.names[src.Name[i]] = id
+	}
+	extraIdx := uint32(0)
+	if x := src.Extra[i]; x != 0 {
+		dst.Extras = append(dst.Extras, src.Extras[x-1])
+		extraIdx = uint32(len(dst.Extras))
+	}
+	dst.Name = append(dst.Name, id)
+	dst.Count = append(dst.Count, 1)
+	dst.Mode = append(dst.Mode, src.Mode[i])
+	dst.Uid = append(dst.Uid, src.Uid[i])
+	dst.Gid = append(dst.Gid, src.Gid[i])
+	dst.Size = append(dst.Size, src.Size[i])
+	dst.ModTime = append(dst.ModTime, src.ModTime[i])
+	dst.ChangeTime = append(dst.ChangeTime, src.ChangeTime[i])
+	dst.AccessTime = append(dst.AccessTime, src.AccessTime[i])
+	dst.ModNsec = append(dst.ModNsec, src.ModNsec[i])
+	dst.ChangeNsec = append(dst.ChangeNsec, src.ChangeNsec[i])
+	dst.AccessNsec = append(dst.AccessNsec, src.AccessNsec[i])
+	dst.Digests = append(dst.Digests, src.Digests[i*compactDigestSize:(i+1)*compactDigestSize]...)
+	dst.Flags = append(dst.Flags, src.Flags[i])
+	dst.Extra = append(dst.Extra, extraIdx)
+	return dst.Len() - 1
+}
+
+// Implement FileFinder.FindFiles
+func (t *CompactTree) FindFiles(hashes map[string]bool, fn func(fpath string, fm *FileMeta)) {
+	if t.Len() == 0 || len(hashes) == 0 {
+		return
+	}
+	// Compare the binary digests so only matching entries are unpacked
+	raw := make(map[[compactDigestSize]byte]bool, len(hashes))
+	for digest := range hashes {
+		var key [compactDigestSize]byte
+		if n, err := hex.Decode(key[:], []byte(digest)); err == nil && n == compactDigestSize {
+			raw[key] = true
+		}
+	}
+	t.findFiles(0, "", hashes, raw, fn)
+}
+
+func (t *CompactTree) findFiles(i int, root string, hashes map[string]bool, raw map[[compactDigestSize]byte]bool, fn func(fpath string, fm *FileMeta)) {
+	end := i + int(t.Count[i])
+	for j := i + 1; j < end; j += int(t.Count[j]) {
+		mode := fs.FileMode(t.Mode[j])
+		if mode.IsDir() {
+			t.findFiles(j, root+t.Names[t.Name[j]]+"/", hashes, raw, fn)
+			continue
+		}
+		if !mode.IsRegular() || t.Size[j] == 0 {
+			continue
+		}
+		var match bool
+		if x := t.Extra[j]; x != 0 && t.Extras[x-1].Hash != "" {
+			match = hashes[t.Extras[x-1].Hash]
+		} else if t.Flags[j]&compactHasDigest != 0 {
+			var key [compactDigestSize]byte
+			copy(key[:], t.Digests[j*compactDigestSize:])
+			match = raw[key]
+		}
+		if match {
+			fm, digest := t.meta(j)
+			fm.Hash = digest
+			fn(root+fm.Name, fm)
+		}
+	}
+}
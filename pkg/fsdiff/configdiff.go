@@ -0,0 +1,328 @@
+package fsdiff
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"io"
+	"path"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// Largest config file that is parsed, bigger files aren't what we expect
+const MAX_CONFIG_SIZE = 1 << 20
+
+// One record of a parsed config file, e.g. a user or a hosts entry
+type configRecord struct {
+	// Identifies the record within the file, e.g. the user name
+	Key   string
+	Value string
+	// Security-relevant properties of the record, e.g. "uid 0"
+	Notes []string
+}
+
+type configParser func(data []byte) []configRecord
+
+// Parsers by path, in the syntax of path.Match
+var configParsers = []struct {
+	pattern string
+	parse   configParser
+}{
+	{"etc/passwd", parsePasswd},
+	{"etc/group", parseGroup},
+	{"etc/shadow", parseShadow},
+	{"etc/gshadow", parseShadow},
+	{"etc/hosts", parseHosts},
+	{"etc/resolv.conf", parseResolvConf},
+	{"etc/ssh/sshd_config", parseSshdConfig},
+	{"etc/ssh/sshd_config.d/*.conf", parseSshdConfig},
+}
+
+func findConfigParser(fpath string) configParser {
+	fpath = cleanPath(fpath)
+	for _, p := range configParsers {
+		if ok, _ := path.Match(p.pattern, fpath); ok {
+			return p.parse
+		}
+	}
+	return nil
+}
+
+// Returns true if DiffConfig can parse the file at 'fpath'.
+func IsConfigFile(fpath string) bool {
+	return findConfigParser(fpath) != nil
+}
+
+// A record-level change to a config file
+type ConfigChange struct {
+	// Path of the file
+	Path string
+	// Identifies the record within the file, e.g. the user name or the sshd_config keyword
+	Key string
+	// Added, Removed or Modified
+	Kind ChangeKind
+	// The record before and after the change, empty if it was added or removed.
+	// Password hashes are replaced by a fingerprint.
+	Old string
+	New string
+	// Security-relevant properties of the new record (or the removed one), e.g. "uid 0"
+	Notes []string
+}
+
+// Parses the base and new contents of the config file at 'fpath' and returns the
+// records that were added, removed or modified, sorted by key. Returns nil if the
+// file isn't one IsConfigFile knows about.
+func DiffConfig(fpath string, old, new []byte) []ConfigChange {
+	parse := findConfigParser(fpath)
+	if parse == nil {
+		return nil
+	}
+	oldRecs := configIndex(parse(old))
+	newRecs := configIndex(parse(new))
+	changes := make([]ConfigChange, 0)
+	for key, nr := range newRecs {
+		or := oldRecs[key]
+		switch {
+		case or == nil:
+			changes = append(changes, ConfigChange{Path: fpath, Key: key, Kind: Added, New: nr.Value, Notes: nr.Notes})
+		case or.Value != nr.Value:
+			changes = append(changes, ConfigChange{Path: fpath, Key: key, Kind: Modified, Old: or.Value, New: nr.Value, Notes: nr.Notes})
+		}
+	}
+	for key, or := range oldRecs {
+		if newRecs[key] == nil {
+			changes = append(changes, ConfigChange{Path: fpath, Key: key, Kind: Removed, Old: or.Value, Notes: or.Notes})
+		}
+	}
+	slices.SortFunc(changes, func(a, b ConfigChange) bool {
+		return a.Key < b.Key
+	})
+	return changes
+}
+
+// Indexes records by key. Records with the same key are merged, with their values
+// joined in file order.
+func configIndex(recs []configRecord) map[string]*configRecord {
+	index := make(map[string]*configRecord, len(recs))
+	for i := range recs {
+		rec := &recs[i]
+		if prev := index[rec.Key]; prev != nil {
+			prev.Value += "; " + rec.Value
+			for _, note := range rec.Notes {
+				if !slices.Contains(prev.Notes, note) {
+					prev.Notes = append(prev.Notes, note)
+				}
+			}
+		} else {
+			index[rec.Key] = rec
+		}
+	}
+	return index
+}
+
+// Calls 'fn' with the fields of each non-empty line, with '#' comments removed if
+// 'comments' is set.
+func configLines(data []byte, comments bool, fn func(line string)) {
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, MAX_CONFIG_SIZE)
+	for sc.Scan() {
+		line := sc.Text()
+		if comments {
+			line, _, _ = strings.Cut(line, "#")
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			fn(line)
+		}
+	}
+}
+
+// name:password:uid:gid:gecos:home:shell
+func parsePasswd(data []byte) []configRecord {
+	recs := make([]configRecord, 0)
+	configLines(data, false, func(line string) {
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 {
+			return
+		}
+		rec := configRecord{Key: fields[0]}
+		if fields[2] == "0" {
+			rec.Notes = append(rec.Notes, "uid 0")
+		}
+		if fields[3] == "0" {
+			rec.Notes = append(rec.Notes, "gid 0")
+		}
+		// "x" means the password is in shadow, anything else is redacted like there
+		if fields[1] != "x" {
+			rec.Notes = redactPassword(fields, rec.Notes)
+		}
+		rec.Value = strings.Join(fields[1:], ":")
+		recs = append(recs, rec)
+	})
+	return recs
+}
+
+// name:password:gid:members
+func parseGroup(data []byte) []configRecord {
+	recs := make([]configRecord, 0)
+	configLines(data, false, func(line string) {
+		fields := strings.Split(line, ":")
+		if len(fields) < 4 {
+			return
+		}
+		rec := configRecord{Key: fields[0], Value: strings.Join(fields[1:], ":")}
+		if fields[2] == "0" {
+			rec.Notes = append(rec.Notes, "gid 0")
+		}
+		switch fields[0] {
+		case "root", "wheel", "sudo", "admin", "docker", "disk", "shadow":
+			if fields[3] != "" {
+				rec.Notes = append(rec.Notes, "privileged group members")
+			}
+		}
+		recs = append(recs, rec)
+	})
+	return recs
+}
+
+// name:password:... for shadow and gshadow. The hash is replaced by its state and a
+// fingerprint, so the export shows that it changed without containing it.
+func parseShadow(data []byte) []configRecord {
+	recs := make([]configRecord, 0)
+	configLines(data, false, func(line string) {
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 {
+			return
+		}
+		rec := configRecord{Key: fields[0]}
+		rec.Notes = redactPassword(fields, rec.Notes)
+		rec.Value = strings.Join(fields[1:], ":")
+		recs = append(recs, rec)
+	})
+	return recs
+}
+
+// Replaces the password in fields[1] by its state and a fingerprint, and returns
+// 'notes' with the note for that state added.
+func redactPassword(fields []string, notes []string) []string {
+	pw := fields[1]
+	switch {
+	case pw == "":
+		fields[1] = "<empty>"
+		notes = append(notes, "no password")
+	case pw[0] == '!' || pw[0] == '*':
+		fields[1] = "<locked>"
+		if len(pw) > 1 && pw != "!!" && pw != "*" {
+			fields[1] = "<locked " + passwordFingerprint(pw[1:]) + ">"
+		}
+	default:
+		fields[1] = "<hash " + passwordFingerprint(pw) + ">"
+		notes = append(notes, "password set")
+	}
+	return notes
+}
+
+func passwordFingerprint(pw string) string {
+	sum := sha256.Sum256([]byte(pw))
+	return hex.EncodeToString(sum[:4])
+}
+
+// address name [aliases...], keyed by name so remapped names show up as modified
+func parseHosts(data []byte) []configRecord {
+	recs := make([]configRecord, 0)
+	configLines(data, true, func(line string) {
+		fields := strings.Fields(line)
+		for _, name := range fields[1:] {
+			rec := configRecord{Key: name, Value: fields[0]}
+			if name == "localhost" && fields[0] != "127.0.0.1" && fields[0] != "::1" {
+				rec.Notes = append(rec.Notes, "localhost remapped")
+			}
+			recs = append(recs, rec)
+		}
+	})
+	return recs
+}
+
+// Each nameserver is its own record, other options are keyed by their keyword.
+func parseResolvConf(data []byte) []configRecord {
+	recs := make([]configRecord, 0)
+	configLines(data, true, func(line string) {
+		fields := strings.Fields(line)
+		if fields[0] == "nameserver" && len(fields) > 1 {
+			recs = append(recs, configRecord{Key: "nameserver " + fields[1], Value: fields[1]})
+		} else {
+			recs = append(recs, configRecord{Key: fields[0], Value: strings.Join(fields[1:], " ")})
+		}
+	})
+	return recs
+}
+
+// Keywords are case-insensitive and keyed in lower case. Options inside a Match
+// block are keyed with the block's criteria, e.g. "match User git/forcecommand".
+func parseSshdConfig(data []byte) []configRecord {
+	recs := make([]configRecord, 0)
+	prefix := ""
+	configLines(data, true, func(line string) {
+		keyword, value := line, ""
+		if i := strings.IndexAny(line, " \t="); i >= 0 {
+			keyword, value = line[:i], line[i+1:]
+		}
+		keyword = strings.ToLower(keyword)
+		value = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(value), "="))
+		if keyword == "match" {
+			prefix = ""
+			if strings.ToLower(value) != "all" {
+				prefix = "match " + value + "/"
+			}
+			recs = append(recs, configRecord{Key: "match " + value, Value: value})
+			return
+		}
+		rec := configRecord{Key: prefix + keyword, Value: value}
+		lower := strings.ToLower(value)
+		switch keyword {
+		case "permitrootlogin":
+			if lower == "yes" {
+				rec.Notes = append(rec.Notes, "root login allowed")
+			}
+		case "permitemptypasswords", "passwordauthentication", "permituserenvironment", "gatewayports",
+			"allowtcpforwarding", "allowagentforwarding", "permittunnel":
+			if lower == "yes" || lower == "all" {
+				rec.Notes = append(rec.Notes, keyword+" enabled")
+			}
+		case "authorizedkeysfile", "authorizedkeyscommand", "authorizedprincipalscommand",
+			"trustedusercakeys", "forcecommand", "subsystem":
+			rec.Notes = append(rec.Notes, keyword+" set")
+		}
+		recs = append(recs, rec)
+	})
+	return recs
+}
+
+// Returns the config changes of every entry in 'd'.
+func (d *FsDiff) ConfigChanges() []ConfigChange {
+	changes := make([]ConfigChange, 0)
+	for _, e := range d.Entries {
+		changes = append(changes, e.Config...)
+	}
+	return changes
+}
+
+// Writes the config changes in 'd' as a CSV, one row per record.
+func WriteConfigChanges(w io.Writer, d *FsDiff) error {
+	cw := csv.NewWriter(w)
+	header := []string{"path", "key", "change", "old", "new", "notes"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, c := range d.ConfigChanges() {
+		row := []string{c.Path, c.Key, c.Kind.String(), c.Old, c.New, strings.Join(c.Notes, "; ")}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -2,48 +2,200 @@ package fsdiff
 
 import (
 	"archive/tar"
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"io/fs"
 	"path"
 	"strings"
+	"time"
 
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 )
 
 const SEP = "/"
 
+// Prefix of PAX records that hold extended attributes
+const PAX_XATTR_PREFIX = "SCHILY.xattr."
+
 type FileMeta struct {
 	Name string
+	// Type and permission bits, including setuid/setgid/sticky
 	Mode fs.FileMode
-	// Sha256 hash of the file contents
+	// Hex digest of the file contents using PRIMARY_HASH
 	Hash string
+	// Any other digests of the file contents which were requested, nil if none
+	Hashes map[HashAlgo]string
 	// Size of the file
 	Size int64
+	// Target of the symbolic link, empty if this is not a symlink
+	Link string
+	// Major and minor numbers of character and block devices
+	DevMajor uint32
+	DevMinor uint32
+	// Owner user and group IDs
+	Uid int
+	Gid int
+	// Modification, status change and access times. Any of these may be zero
+	// if the source doesn't record them.
+	ModTime    time.Time
+	ChangeTime time.Time
+	AccessTime time.Time
+	// Extended attributes (e.g. security.capability), nil if there are none
+	Xattrs map[string]string
+	// Path of the first entry in this file's hard link group. Empty if the file
+	// isn't a hard link, or is the first of its group.
+	HardLink string
+	// Device and inode number and number of links, only set for local files
+	inode Inode
+	nlink uint64
 }
 
+// Returns true if both the contents and the metadata of the entries match.
 func (fm *FileMeta) IsSame(rhs *FileMeta) bool {
-	return *fm == *rhs
+	return fm.SameContent(rhs) && fm.SameMeta(rhs)
+}
+
+// Returns true if the entries have the same type and contents (or link target, or
+// device numbers).
+func (fm *FileMeta) SameContent(rhs *FileMeta) bool {
+	return fm.Mode.Type() == rhs.Mode.Type() &&
+		fm.Hash == rhs.Hash &&
+		fm.Size == rhs.Size &&
+		fm.DevMajor == rhs.DevMajor &&
+		fm.DevMinor == rhs.DevMinor &&
+		fm.Link == rhs.Link
+}
+
+// Returns true if the entries have the same permissions, ownership, modification time
+// and extended attributes. Change and access times are ignored since they are updated
+// by simply extracting or reading a file. Modification times are compared in whole
+// seconds because that's all most tar headers store. Directory modification times are
+// ignored too, they change whenever an entry is added or removed.
+func (fm *FileMeta) SameMeta(rhs *FileMeta) bool {
+	return fm.Mode == rhs.Mode &&
+		fm.Uid == rhs.Uid &&
+		fm.Gid == rhs.Gid &&
+		(fm.Mode.IsDir() || fm.ModTime.Unix() == rhs.ModTime.Unix()) &&
+		maps.Equal(fm.Xattrs, rhs.Xattrs)
+}
+
+// Returns true if both entries are regular files with the same size, mode and
+// modification time. This is how fast mode decides a file doesn't need hashing.
+func (fm *FileMeta) SameStat(rhs *FileMeta) bool {
+	return fm.Mode.IsRegular() &&
+		fm.Mode == rhs.Mode &&
+		fm.Size == rhs.Size &&
+		fm.ModTime.Unix() == rhs.ModTime.Unix()
+}
+
+// Returns true if this entry is a symbolic link.
+func (fm *FileMeta) IsSymlink() bool {
+	return fm.Mode&fs.ModeSymlink != 0
+}
+
+// Returns true if this entry is a device node, named pipe or socket. Their contents
+// are never read.
+func (fm *FileMeta) IsSpecial() bool {
+	return fm.Mode&(fs.ModeDevice|fs.ModeNamedPipe|fs.ModeSocket) != 0
+}
+
+// Type of a filesystem entry
+type FileType int
+
+const (
+	TypeFile FileType = iota
+	TypeDir
+	TypeSymlink
+	TypeFifo
+	TypeSocket
+	TypeCharDevice
+	TypeBlockDevice
+)
+
+func (t FileType) String() string {
+	switch t {
+	case TypeFile:
+		return "file"
+	case TypeDir:
+		return "dir"
+	case TypeSymlink:
+		return "symlink"
+	case TypeFifo:
+		return "fifo"
+	case TypeSocket:
+		return "socket"
+	case TypeCharDevice:
+		return "char-device"
+	case TypeBlockDevice:
+		return "block-device"
+	default:
+		return "unknown"
+	}
+}
+
+// Returns the type of this entry.
+func (fm *FileMeta) Type() FileType {
+	switch mode := fm.Mode; {
+	case mode.IsDir():
+		return TypeDir
+	case mode&fs.ModeSymlink != 0:
+		return TypeSymlink
+	case mode&fs.ModeNamedPipe != 0:
+		return TypeFifo
+	case mode&fs.ModeSocket != 0:
+		return TypeSocket
+	case mode&fs.ModeCharDevice != 0:
+		return TypeCharDevice
+	case mode&fs.ModeDevice != 0:
+		return TypeBlockDevice
+	default:
+		return TypeFile
+	}
 }
 
 type DirMeta struct {
-	Name  string
-	Mode  fs.FileMode
+	// Metadata of the directory itself
+	FileMeta
 	Files map[string]*FileMeta
 	Dirs  map[string]*DirMeta
+	// True if the directory was created by MakeDir and hasn't been given metadata, so
+	// its own metadata must not be compared
+	Implicit bool
+	// Hash of the subtree, see UpdateTreeHash. Empty if it hasn't been computed.
+	TreeHash string
+	// Same as TreeHash, but without the contents of files. Used to match subtrees
+	// in fast mode.
+	StatHash string
+	// True if Files and Dirs were left out to save space, see Truncate
+	Partial bool
 }
 
 func NewDirMeta(name string) *DirMeta {
 	return &DirMeta{
-		Name:  name,
-		Mode:  fs.ModeDir,
+		FileMeta: FileMeta{
+			Name: name,
+			Mode: fs.ModeDir,
+		},
 		Files: make(map[string]*FileMeta),
 		Dirs:  make(map[string]*DirMeta),
 	}
 }
 
+// Gob leaves empty maps nil, this recreates them throughout the tree so a decoded
+// DirMeta can be modified again.
+func (d *DirMeta) InitMaps() {
+	if d.Files == nil {
+		d.Files = make(map[string]*FileMeta)
+	}
+	if d.Dirs == nil {
+		d.Dirs = make(map[string]*DirMeta)
+	}
+	for _, dm := range d.Dirs {
+		dm.InitMaps()
+	}
+}
+
 // Returns the total number of files and directories in this tree.
 // This may be useful in determining progress indicators.
 func (d *DirMeta) CountTree() int {
@@ -67,7 +219,7 @@ func (d *DirMeta) AddDir(dm *DirMeta) {
 // Similar to the 'mkdir -p' command this will return a new directory at the
 // given path, creating missing directories if necessary.
 func (d *DirMeta) MakeDir(fpath string) *DirMeta {
-	fpath = path.Clean(fpath)
+	fpath = cleanPath(fpath)
 	if fpath == "." {
 		return d
 	}
@@ -77,6 +229,7 @@ func (d *DirMeta) MakeDir(fpath string) *DirMeta {
 		next := dm.Dirs[name]
 		if next == nil {
 			next = NewDirMeta(name)
+			next.Implicit = true
 			dm.Dirs[name] = next
 		}
 		dm = next
@@ -85,7 +238,7 @@ func (d *DirMeta) MakeDir(fpath string) *DirMeta {
 }
 
 func (d *DirMeta) GetDir(fpath string) *DirMeta {
-	fpath = path.Clean(fpath)
+	fpath = cleanPath(fpath)
 	if fpath == "." {
 		return d
 	}
@@ -101,15 +254,73 @@ func (d *DirMeta) GetDir(fpath string) *DirMeta {
 	return dm
 }
 
+// Removes the file or directory at the given path. Returns false if there was
+// nothing to remove.
+func (d *DirMeta) Remove(fpath string) bool {
+	parent, name := path.Split(cleanPath(fpath))
+	pd := d.GetDir(parent)
+	if pd == nil {
+		return false
+	}
+	if _, ok := pd.Files[name]; ok {
+		delete(pd.Files, name)
+		return true
+	}
+	if _, ok := pd.Dirs[name]; ok {
+		delete(pd.Dirs, name)
+		return true
+	}
+	return false
+}
+
+// Removes all files and directories inside this directory.
+func (d *DirMeta) Clear() {
+	d.Files = make(map[string]*FileMeta)
+	d.Dirs = make(map[string]*DirMeta)
+}
+
+// Overlays 'other' on top of this directory. Entries in 'other' replace entries with
+// the same name, except for directories which are merged recursively. The metadata
+// of this directory is replaced unless 'other' was only created implicitly.
+func (d *DirMeta) Merge(other *DirMeta) {
+	if !other.Implicit {
+		name := d.Name
+		d.FileMeta = other.FileMeta
+		d.Name = name
+		d.Implicit = false
+	}
+	for name, fm := range other.Files {
+		delete(d.Dirs, name)
+		d.Files[name] = fm
+	}
+	for name, odm := range other.Dirs {
+		delete(d.Files, name)
+		if dm := d.Dirs[name]; dm != nil {
+			dm.Merge(odm)
+		} else {
+			d.Dirs[name] = odm
+		}
+	}
+}
+
 func (d *DirMeta) GetFile(fpath string) *FileMeta {
-	parent, name := path.Split(path.Clean(fpath))
-	if d1 := d.GetDir(parent); d1 != nil {
+	parent, name := path.Split(cleanPath(fpath))
+	if d1 := d.GetDir(parent); d1 == nil {
 		return nil
 	} else {
 		return d1.Files[name]
 	}
 }
 
+// Cleans 'fpath' and strips any leading separator, returning "." for the root.
+func cleanPath(fpath string) string {
+	fpath = strings.TrimPrefix(path.Clean(fpath), SEP)
+	if fpath == "" {
+		return "."
+	}
+	return fpath
+}
+
 // Take a pre-split path and get the directory from it
 func (d *DirMeta) getSplitDir(path []string) *DirMeta {
 	di := d
@@ -136,8 +347,42 @@ type DirMetaBuilder struct {
 	PathErrors map[string]error
 	// An array of absolute paths that will be ignored
 	Excludes []string
-	// Byte buffer for reading/copying
-	buf []byte
+	// Pattern-based exclude rules, may be nil
+	Rules *RuleSet
+	// Digests to compute in addition to PRIMARY_HASH, stored in FileMeta.Hashes.
+	// CompareFs only computes them for files whose contents differ from the base.
+	Digests []HashAlgo
+	// Fast mode, only used by CompareFs. Files whose size, mode and modification
+	// time match the base tree are assumed to be unchanged and aren't hashed.
+	Fast bool
+	// Paths which weren't hashed because of fast mode are written here, one per
+	// line, so the list doesn't have to be kept in memory. May be nil. Write errors
+	// are left to the writer, a bufio.Writer reports them when it's flushed.
+	UnhashedList io.Writer
+	// Number of files which weren't hashed because of fast mode
+	UnhashedCount int
+	// Number of files AddFs and CompareFs hash at once, values below 1 mean 1.
+	// Tar archives are always read sequentially.
+	Workers int
+	// Maximum number of files being read (hashed, or having their link target and
+	// attributes read) at once. Values below 1 mean the same as Workers. Use this to
+	// limit the IO load placed on the host.
+	MaxIO int
+	// Base directories that were left out of a partial base tree and don't match
+	// the filesystem, see CompareFs
+	Pending []string
+	// Path of Root within the source, used when matching excludes and recording
+	// errors. Empty for the root of the source.
+	prefix string
+	// Only exclude what the rules exclude by path alone, see RuleSet.PathExcluded.
+	// Used for trees whose hashes are compared with a filtered base.
+	pathRulesOnly bool
+	// Set while probing a partial base directory, see sameSubtree. AddFs only
+	// hashes files with PRIMARY_HASH, or not at all in fast mode, and hard links
+	// aren't recorded.
+	probe bool
+	// Locks, buffers, etc.
+	shared *builderShared
 }
 
 func NewDirMetaBuilder(root *DirMeta) *DirMetaBuilder {
@@ -145,67 +390,203 @@ func NewDirMetaBuilder(root *DirMeta) *DirMetaBuilder {
 		Root:       root,
 		PathErrors: make(map[string]error),
 		Excludes:   make([]string, 0),
-		buf:        make([]byte, 4096),
+		shared:     newBuilderShared(),
 	}
 }
 
 // Similar to fs.WalkDirFunc but also receives a reader to read the contents of the file or nil
-// if the entry is a directory.
+// if the entry is a directory. Symbolic links are never read or followed, use AddSymlink
+// to record their target.
 func (b *DirMetaBuilder) Add(fpath string, d fs.DirEntry, rd io.Reader, inErr error) error {
 	if inErr != nil {
-		b.PathErrors[fpath] = inErr
+		b.addError(fpath, inErr)
 		return nil
 	}
+	fm, err := EntryMeta(d)
+	if err != nil {
+		b.addError(fpath, err)
+		return nil
+	}
+	return b.AddMeta(fpath, fm, rd)
+}
+
+// Adds a symbolic link entry pointing to 'target'.
+func (b *DirMetaBuilder) AddSymlink(fpath string, d fs.DirEntry, target string) error {
+	fm, err := EntryMeta(d)
+	if err != nil {
+		b.addError(fpath, err)
+		return nil
+	}
+	fm.Link = target
+	return b.AddMeta(fpath, fm, nil)
+}
+
+// Adds an entry whose metadata has already been collected. The contents of regular
+// files are read from 'rd' to fill in the size and hash, if 'rd' is nil the size and
+// hash in 'fm' are kept. Directories that already exist only have their metadata
+// replaced, their contents are kept.
+func (b *DirMetaBuilder) AddMeta(fpath string, fm *FileMeta, rd io.Reader) error {
 	// Skip excludes
-	if slices.Contains(b.Excludes, fpath) {
-		if d.IsDir() {
+	if b.IsExcluded(fpath, fm) {
+		if fm.Mode.IsDir() {
 			return fs.SkipDir
 		} else {
 			return nil
 		}
 	}
+	if fm.Mode.IsRegular() && rd != nil {
+		if err := b.hashFile(rd, fm); err != nil {
+			b.addError(fpath, err)
+			return nil
+		}
+	}
+
+	b.shared.lck.Lock()
+	defer b.shared.lck.Unlock()
+	if fm.Mode.IsDir() {
+		dm := b.Root.MakeDir(fpath)
+		name := dm.Name
+		dm.FileMeta = *fm
+		dm.Name = name
+		dm.Implicit = false
+		return nil
+	}
 	// Get parent directory
 	parentPath := path.Dir(fpath)
 	parentDir := b.Root.MakeDir(parentPath)
 	if parentDir == nil {
 		return fmt.Errorf("could not create directory '%s'", parentPath)
 	}
-	if d.IsDir() {
-		dm := NewDirMeta(d.Name())
-		dm.Mode = d.Type()
-		parentDir.AddDir(dm)
-	} else {
-		size, hash, err := b.HashReader(rd)
-		if err != nil {
-			b.PathErrors[fpath] = err
-			return nil
-		}
-		parentDir.AddFile(&FileMeta{
-			Name: d.Name(),
-			Mode: d.Type(),
-			Size: size,
-			Hash: hash,
-		})
-	}
+	// Links are compared by their target, not by what they point to
+	parentDir.AddFile(fm)
 	return nil
 }
 
-// Calls fs.WalkDir on fsys and then adds the files and directories using b.Add.
+// Returns true if the entry at 'fpath' should be ignored.
+func (b *DirMetaBuilder) IsExcluded(fpath string, fm *FileMeta) bool {
+	fpath = b.fullPath(fpath)
+	if slices.Contains(b.Excludes, fpath) {
+		return true
+	}
+	if b.pathRulesOnly {
+		return b.Rules.PathExcluded(fpath)
+	}
+	return b.Rules.Excluded(fpath, fm)
+}
+
+// Returns 'fpath' relative to the root of the source rather than to Root.
+func (b *DirMetaBuilder) fullPath(fpath string) string {
+	if b.prefix == "" {
+		return fpath
+	}
+	return path.Join(b.prefix, fpath)
+}
+
+// Calls fs.WalkDir on fsys and then adds the files and directories using b.AddMeta.
+// See ReadFsMeta for the metadata that is collected. Up to b.Workers files are
+// hashed at once while the walk continues.
 func (b *DirMetaBuilder) AddFs(fsys fs.FS) error {
+	level := hashDigests
+	if b.probe && b.Fast {
+		level = hashNone
+	} else if b.probe {
+		level = hashPrimary
+	}
+	jobs := newJobGroup(b.workers())
+	defer jobs.Wait()
 	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil || d.IsDir() {
+		if err != nil {
+			return b.Add(path, d, nil, err)
+		}
+		fm, err := EntryMeta(d)
+		if err != nil {
+			return b.Add(path, d, nil, err)
+		}
+		if b.IsExcluded(path, fm) {
+			return b.AddMeta(path, fm, nil)
+		}
+		if fm.Mode.IsRegular() {
+			b.addHardLink(path, fm)
+			jobs.Go(func() {
+				if err := b.readFsMeta(fsys, path, fm, level); err != nil {
+					b.addError(path, err)
+				} else {
+					b.AddMeta(path, fm, nil)
+				}
+			})
+			return nil
+		}
+		if err := b.ReadFsMeta(fsys, path, fm); err != nil {
 			return b.Add(path, d, nil, err)
-		} else {
-			rd, err := fsys.Open(path)
-			if err != nil {
-				defer rd.Close()
-			}
-			return b.Add(path, d, rd, err)
 		}
+		return b.AddMeta(path, fm, nil)
 	})
 }
 
-// Iterates through the tar file and calls b.Add for each entry.
+// Fills in the parts of 'fm' that must be read from fsys: the size and hash of regular
+// files, the target of symbolic links if fsys implements ReadLinkFS, and extended
+// attributes if fsys implements XattrFS. Failing to read extended attributes is
+// recorded in PathErrors but otherwise ignored. This is safe to call from multiple
+// goroutines.
+func (b *DirMetaBuilder) ReadFsMeta(fsys fs.FS, fpath string, fm *FileMeta) (err error) {
+	return b.readFsMeta(fsys, fpath, fm, hashDigests)
+}
+
+// How much of a regular file's contents readFsMeta hashes
+type hashLevel int
+
+const (
+	// Not at all, the size is taken from the metadata
+	hashNone hashLevel = iota
+	// Only PRIMARY_HASH
+	hashPrimary
+	// PRIMARY_HASH and each of the builder's Digests
+	hashDigests
+)
+
+// Same as ReadFsMeta, but regular files are only hashed as far as 'level' says.
+func (b *DirMetaBuilder) readFsMeta(fsys fs.FS, fpath string, fm *FileMeta, level hashLevel) (err error) {
+	defer b.acquireIO()()
+	if xfs, ok := fsys.(XattrFS); ok && !fm.IsSymlink() {
+		if fm.Xattrs, err = xfs.Xattrs(fpath); err != nil {
+			b.addError(fpath, err)
+		}
+	}
+	if fm.IsSymlink() {
+		fm.Link, err = readLink(fsys, fpath)
+		return
+	}
+	if !fm.Mode.IsRegular() || level == hashNone {
+		return nil
+	}
+	return b.hashFsFile(fsys, fpath, fm, level == hashDigests)
+}
+
+// Hashes the regular file at 'fpath' again, with the builder's Digests as well if
+// 'digests' is true.
+func (b *DirMetaBuilder) rehash(fsys fs.FS, fpath string, fm *FileMeta, digests bool) error {
+	defer b.acquireIO()()
+	return b.hashFsFile(fsys, fpath, fm, digests)
+}
+
+// Hashes the regular file at 'fpath', with the builder's Digests as well if 'digests'
+// is true. The caller must hold an IO slot, see acquireIO.
+func (b *DirMetaBuilder) hashFsFile(fsys fs.FS, fpath string, fm *FileMeta, digests bool) error {
+	rd, err := fsys.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	if !digests {
+		fm.Size, fm.Hash, err = b.HashReader(rd)
+		fm.Hashes = nil
+		return err
+	}
+	return b.hashFile(rd, fm)
+}
+
+// Iterates through the tar file and adds each entry, including the ownership,
+// timestamps and extended attributes from the headers.
 func (b *DirMetaBuilder) AddTar(tr *tar.Reader) error {
 	for {
 		header, err := tr.Next()
@@ -217,28 +598,116 @@ func (b *DirMetaBuilder) AddTar(tr *tar.Reader) error {
 			return err
 		}
 		// Normal case
-		info := fs.FileInfoToDirEntry(header.FileInfo())
-		var rd io.Reader = tr
-		if info.IsDir() {
-			rd = nil
+		fm := InfoMeta(header.FileInfo())
+		if header.Typeflag == tar.TypeLink {
+			err = b.addTarLink(header.Name, fm, header.Linkname, nil)
+		} else {
+			err = b.AddMeta(header.Name, fm, tr)
 		}
-		if err := b.Add(header.Name, info, rd, nil); err != nil {
+		if err != nil {
 			return err
 		}
 	}
 }
 
+// Builds the metadata for a directory entry without reading its contents.
+func EntryMeta(d fs.DirEntry) (*FileMeta, error) {
+	info, err := d.Info()
+	if err != nil {
+		return nil, err
+	}
+	return InfoMeta(info), nil
+}
+
+// Builds the metadata for a file without reading its contents. Ownership and
+// extra timestamps are filled in when info comes from a tar header or from the
+// local filesystem.
+func InfoMeta(info fs.FileInfo) *FileMeta {
+	fm := &FileMeta{
+		Name:    info.Name(),
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+	}
+	if fm.Mode.IsRegular() {
+		fm.Size = info.Size()
+	}
+	if header, ok := info.Sys().(*tar.Header); ok {
+		fm.Uid = header.Uid
+		fm.Gid = header.Gid
+		fm.ChangeTime = header.ChangeTime
+		fm.AccessTime = header.AccessTime
+		if header.Typeflag == tar.TypeSymlink {
+			fm.Link = header.Linkname
+		}
+		if header.Typeflag == tar.TypeChar || header.Typeflag == tar.TypeBlock {
+			fm.DevMajor = uint32(header.Devmajor)
+			fm.DevMinor = uint32(header.Devminor)
+		}
+		for key, value := range header.PAXRecords {
+			if strings.HasPrefix(key, PAX_XATTR_PREFIX) {
+				if fm.Xattrs == nil {
+					fm.Xattrs = make(map[string]string)
+				}
+				fm.Xattrs[strings.TrimPrefix(key, PAX_XATTR_PREFIX)] = value
+			}
+		}
+	} else {
+		fillSysMeta(fm, info.Sys())
+	}
+	return fm
+}
+
+// Reads the target of a symbolic link from fsys, if supported.
+func readLink(fsys fs.FS, fpath string) (string, error) {
+	if lfs, ok := fsys.(ReadLinkFS); ok {
+		return lfs.ReadLink(fpath)
+	}
+	return "", &fs.PathError{Op: "readlink", Path: fpath, Err: ErrReadLinkUnsupported}
+}
+
+// Returns a builder with the same settings which fills in a different tree.
+// Path errors are shared with the original builder.
+func (b *DirMetaBuilder) withRoot(root *DirMeta) *DirMetaBuilder {
+	nb := *b
+	nb.Root = root
+	return &nb
+}
+
+// Records a recoverable error for 'fpath'.
+func (b *DirMetaBuilder) addError(fpath string, err error) {
+	b.shared.lck.Lock()
+	defer b.shared.lck.Unlock()
+	b.PathErrors[b.fullPath(fpath)] = err
+}
+
+// Records that 'fpath' was assumed to be unchanged without hashing it.
+func (b *DirMetaBuilder) addUnhashed(fpath string) {
+	b.shared.lck.Lock()
+	defer b.shared.lck.Unlock()
+	b.UnhashedCount++
+	if b.UnhashedList != nil {
+		fmt.Fprintln(b.UnhashedList, b.fullPath(fpath))
+	}
+}
+
 func (b *DirMetaBuilder) HasErrors() bool {
 	return len(b.PathErrors) > 0
 }
 
-// Hashes the contents of a reader, returning the total size, hash, and any error.
+// Hashes the contents of a reader, returning the total size, primary hash, and any
+// error. This is safe to call from multiple goroutines.
 func (b *DirMetaBuilder) HashReader(rd io.Reader) (int64, string, error) {
-	h := sha256.New()
-	size, err := io.CopyBuffer(h, rd, b.buf)
-	if err != nil {
-		return 0, "", err
-	}
-	hs := hex.EncodeToString(h.Sum([]byte{}))
-	return size, hs, nil
+	buf := b.shared.bufs.Get().(*[]byte)
+	defer b.shared.bufs.Put(buf)
+	size, hash, _, err := hashAll(rd, *buf, nil)
+	return size, hash, err
+}
+
+// Hashes the contents of a reader with every configured digest, storing the results
+// and the size in 'fm'.
+func (b *DirMetaBuilder) hashFile(rd io.Reader, fm *FileMeta) (err error) {
+	buf := b.shared.bufs.Get().(*[]byte)
+	defer b.shared.bufs.Put(buf)
+	fm.Size, fm.Hash, fm.Hashes, err = hashAll(rd, *buf, b.Digests)
+	return
 }
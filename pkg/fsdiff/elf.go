@@ -0,0 +1,263 @@
+package fsdiff
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Executable segments with more bits of entropy per byte than this look compressed
+// or encrypted, compiled code is usually between 5 and 6.5
+const ELF_PACKED_ENTROPY = 7.2
+
+// Most bytes of each executable segment read to compute its entropy
+const elfEntropyRead = 4 << 20
+
+// Largest ELF file read into memory when the filesystem can't read at an offset
+const elfMaxRead = 64 << 20
+
+var elfMagic = []byte(elf.ELFMAG)
+
+// Section names used by packers, with the packer's name
+var elfPackerSections = map[string]string{
+	"UPX0":    "upx",
+	"UPX1":    "upx",
+	"UPX2":    "upx",
+	".upx":    "upx",
+	"MPRESS1": "mpress",
+	"MPRESS2": "mpress",
+}
+
+// Executable sections a normal toolchain produces
+var elfCodeSections = map[string]bool{
+	".text": true, ".init": true, ".fini": true, ".plt": true, ".plt.got": true,
+	".plt.sec": true, ".iplt": true, "__libc_freeres_fn": true,
+}
+
+// Triage of an ELF file, see AnalyzeElf
+type ElfReport struct {
+	// 32 or 64
+	Bits int
+	// Target architecture, e.g. "x86_64" or "aarch64"
+	Machine string
+	// "exec", "dyn" (shared objects and PIE executables), "rel" or "core"
+	Type string
+	// Program interpreter, e.g. "/lib64/ld-linux-x86-64.so.2"
+	Interpreter string
+	// Has no interpreter and needs no shared libraries
+	Static bool
+	// Has no symbol table
+	Stripped bool
+	// Shared libraries it needs (DT_NEEDED)
+	Libraries []string
+	// Sections a normal build doesn't have, with the reason, e.g. "UPX0 (upx)"
+	SuspiciousSections []string
+	// Packer the file looks packed with, "unknown" if it looks packed by something
+	// else, empty if it doesn't look packed
+	Packer string
+	// Highest entropy of the executable segments, in bits per byte
+	Entropy float64
+	// Other oddities, e.g. "no section headers"
+	Notes []string
+}
+
+// Returns true if 'data' starts with the ELF magic number.
+func IsElf(data []byte) bool {
+	return bytes.HasPrefix(data, elfMagic)
+}
+
+// Parses the ELF file in 'r', which is 'size' bytes long, and reports how it's built
+// and whether it looks packed.
+func AnalyzeElf(r io.ReaderAt, size int64) (*ElfReport, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	rep := &ElfReport{
+		Machine: strings.ToLower(strings.TrimPrefix(f.Machine.String(), "EM_")),
+		Type:    strings.ToLower(strings.TrimPrefix(f.Type.String(), "ET_")),
+	}
+	if f.Class == elf.ELFCLASS64 {
+		rep.Bits = 64
+	} else {
+		rep.Bits = 32
+	}
+	for _, p := range f.Progs {
+		switch {
+		case p.Type == elf.PT_INTERP:
+			data, _ := io.ReadAll(io.LimitReader(p.Open(), 4096))
+			rep.Interpreter = strings.TrimRight(string(data), "\x00")
+		case p.Type == elf.PT_LOAD && p.Flags&elf.PF_X != 0:
+			if p.Flags&elf.PF_W != 0 {
+				rep.addNote("writable and executable segment")
+			}
+			if e := entropy(io.LimitReader(p.Open(), elfEntropyRead)); e > rep.Entropy {
+				rep.Entropy = math.Round(e*100) / 100
+			}
+		}
+	}
+	rep.Libraries, _ = f.ImportedLibraries()
+	rep.Static = rep.Interpreter == "" && len(rep.Libraries) == 0
+	rep.Stripped = f.Section(".symtab") == nil
+
+	if len(f.Sections) <= 1 {
+		rep.addNote("no section headers")
+	}
+	for _, s := range f.Sections {
+		exec := s.Flags&elf.SHF_EXECINSTR != 0
+		switch {
+		case elfPackerSections[s.Name] != "":
+			rep.Packer = elfPackerSections[s.Name]
+			rep.SuspiciousSections = append(rep.SuspiciousSections, s.Name+" ("+rep.Packer+")")
+		case exec && s.Flags&elf.SHF_WRITE != 0:
+			rep.SuspiciousSections = append(rep.SuspiciousSections, s.Name+" (writable and executable)")
+		case exec && !elfCodeSections[s.Name]:
+			rep.SuspiciousSections = append(rep.SuspiciousSections, s.Name+" (unusual executable section)")
+		}
+	}
+	// UPX leaves its magic in the headers and the trailer even when the sections are renamed
+	if rep.Packer == "" && (hasMagicAt(r, 0, "UPX!") || hasMagicAt(r, size-4096, "UPX!")) {
+		rep.Packer = "upx"
+	}
+	if rep.Packer == "" && rep.Entropy > ELF_PACKED_ENTROPY {
+		rep.Packer = "unknown"
+	}
+	return rep, nil
+}
+
+func (rep *ElfReport) addNote(note string) {
+	for _, n := range rep.Notes {
+		if n == note {
+			return
+		}
+	}
+	rep.Notes = append(rep.Notes, note)
+}
+
+// Returns true if the 4 KiB at 'offset' contain 'magic'.
+func hasMagicAt(r io.ReaderAt, offset int64, magic string) bool {
+	if offset < 0 {
+		offset = 0
+	}
+	buf := make([]byte, 4096)
+	n, _ := r.ReadAt(buf, offset)
+	return bytes.Contains(buf[:n], []byte(magic))
+}
+
+// Returns the Shannon entropy of the bytes read from 'r', in bits per byte.
+func entropy(r io.Reader) float64 {
+	var counts [256]int64
+	var total int64
+	buf := make([]byte, HASH_BUFFER_SIZE)
+	for {
+		n, err := r.Read(buf)
+		for _, c := range buf[:n] {
+			counts[c]++
+		}
+		total += int64(n)
+		if err != nil {
+			break
+		}
+	}
+	e := 0.0
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(total)
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+// Analyzes the file at 'fpath' in 'fsys'. Returns nil if it isn't an ELF file. A
+// malformed file that makes the parser panic is returned as an error.
+func AnalyzeElfFile(fsys fs.FS, fpath string) (rep *ElfReport, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			rep, err = nil, fmt.Errorf("parsing ELF file '%s': %v", fpath, r)
+		}
+	}()
+	file, err := fsys.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	ra, ok := file.(io.ReaderAt)
+	if !ok {
+		data, err := io.ReadAll(io.LimitReader(file, elfMaxRead))
+		if err != nil {
+			return nil, err
+		}
+		ra = bytes.NewReader(data)
+	}
+	magic := make([]byte, len(elfMagic))
+	if _, err := ra.ReadAt(magic, 0); err != nil || !IsElf(magic) {
+		return nil, nil
+	}
+	return AnalyzeElf(ra, info.Size())
+}
+
+// Returns true if the entry is an added or modified regular file which is large
+// enough to be an ELF file, see TagElfs.
+func (e *DiffEntry) MayBeElf() bool {
+	return (e.Kind == Added || e.Kind == Modified) && e.New.Mode.IsRegular() && e.New.Size >= int64(len(elfMagic))
+}
+
+// Attaches an ElfReport to each added or modified ELF file in 'd', reading them from
+// 'fsys' with up to 'workers' at once. Files that can't be read or parsed are left
+// without a report.
+func (d *FsDiff) TagElfs(fsys fs.FS, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := newJobGroup(workers)
+	for _, e := range d.Entries {
+		if !e.MayBeElf() {
+			continue
+		}
+		entry := e
+		jobs.Go(func() {
+			entry.Elf, _ = AnalyzeElfFile(fsys, entry.Path)
+		})
+	}
+	jobs.Wait()
+}
+
+// Writes the ELF reports in 'd' as a CSV, one row per ELF file.
+func WriteElfReports(w io.Writer, d *FsDiff) error {
+	cw := csv.NewWriter(w)
+	header := []string{"path", "change", "bits", "machine", "type", "linking", "interpreter", "stripped",
+		"libraries", "suspicious_sections", "packer", "entropy", "notes", string(PRIMARY_HASH)}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, e := range d.Entries {
+		rep := e.Elf
+		if rep == nil {
+			continue
+		}
+		linking := "dynamic"
+		if rep.Static {
+			linking = "static"
+		}
+		row := []string{e.Path, e.Kind.String(), strconv.Itoa(rep.Bits), rep.Machine, rep.Type, linking,
+			rep.Interpreter, strconv.FormatBool(rep.Stripped), strings.Join(rep.Libraries, ";"),
+			strings.Join(rep.SuspiciousSections, ";"), rep.Packer,
+			strconv.FormatFloat(rep.Entropy, 'f', 2, 64), strings.Join(rep.Notes, ";"), e.New.Hash}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
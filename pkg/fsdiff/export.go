@@ -0,0 +1,326 @@
+package fsdiff
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File format a diff can be exported to
+type ExportFormat string
+
+const (
+	// One JSON object per change
+	FormatJSONL ExportFormat = "jsonl"
+	// One row per change with the new (or removed) metadata and the old metadata
+	FormatCSV ExportFormat = "csv"
+	// Sleuth Kit bodyfile, for building timelines with mactime
+	FormatBodyfile ExportFormat = "bodyfile"
+	// CSV of setuid, setgid and world-writable files and capabilities, see FindPrivEsc
+	FormatPrivEsc ExportFormat = "privesc"
+	// CSV of changes in cron, systemd, ssh and other persistence locations, see
+	// FindPersistence
+	FormatPersistence ExportFormat = "persistence"
+	// CSV of the records changed in passwd, hosts, sshd_config and other config
+	// files, see DiffConfig
+	FormatConfig ExportFormat = "config"
+	// Unified diffs of modified text files, see UnifiedDiff
+	FormatPatch ExportFormat = "patch"
+	// CSV of the added and modified ELF files, see TagElfs
+	FormatElf ExportFormat = "elf"
+	// CSV of the changed files whose contents are known-bad, see TagHashes
+	FormatKnownBad ExportFormat = "known-bad"
+)
+
+// All supported export formats
+var ExportFormats = []ExportFormat{FormatJSONL, FormatCSV, FormatBodyfile, FormatPrivEsc, FormatPersistence, FormatConfig,
+	FormatPatch, FormatElf, FormatKnownBad}
+
+// Parses a comma-separated list of export formats, e.g. "jsonl,bodyfile".
+func ParseExportFormats(s string) ([]ExportFormat, error) {
+	formats := make([]ExportFormat, 0)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, f := range ExportFormats {
+			if string(f) == name {
+				formats = append(formats, f)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unsupported export format '%s'", name)
+		}
+	}
+	return formats, nil
+}
+
+// Returns the file extension for the format, including the dot.
+func (f ExportFormat) Ext() string {
+	switch f {
+	case FormatBodyfile:
+		return ".body"
+	case FormatPrivEsc:
+		return ".privesc.csv"
+	case FormatPersistence:
+		return ".persistence.csv"
+	case FormatConfig:
+		return ".config.csv"
+	case FormatElf:
+		return ".elf.csv"
+	case FormatKnownBad:
+		return ".known-bad.csv"
+	default:
+		return "." + string(f)
+	}
+}
+
+// Writes every entry of 'd' to 'w' in this format.
+func (f ExportFormat) Write(w io.Writer, d *FsDiff) error {
+	switch f {
+	case FormatJSONL:
+		return WriteJSONL(w, d)
+	case FormatCSV:
+		return WriteCSV(w, d)
+	case FormatBodyfile:
+		return WriteBodyfile(w, d)
+	case FormatPrivEsc:
+		return WritePrivEsc(w, d)
+	case FormatPersistence:
+		return WritePersistence(w, d)
+	case FormatConfig:
+		return WriteConfigChanges(w, d)
+	case FormatPatch:
+		return WritePatch(w, d)
+	case FormatElf:
+		return WriteElfReports(w, d)
+	case FormatKnownBad:
+		return WriteKnownBad(w, d)
+	default:
+		return fmt.Errorf("unsupported export format '%s'", f)
+	}
+}
+
+// Metadata of one side of a change in the JSON Lines export
+type jsonMeta struct {
+	Type       string              `json:"type"`
+	Mode       string              `json:"mode"`
+	Size       int64               `json:"size"`
+	Uid        int                 `json:"uid"`
+	Gid        int                 `json:"gid"`
+	ModTime    *time.Time          `json:"mtime,omitempty"`
+	ChangeTime *time.Time          `json:"ctime,omitempty"`
+	AccessTime *time.Time          `json:"atime,omitempty"`
+	Hashes     map[HashAlgo]string `json:"hashes,omitempty"`
+	Link       string              `json:"link,omitempty"`
+	HardLink   string              `json:"hardlink,omitempty"`
+	DevMajor   uint32              `json:"dev_major,omitempty"`
+	DevMinor   uint32              `json:"dev_minor,omitempty"`
+	Xattrs     map[string]string   `json:"xattrs,omitempty"`
+}
+
+// Writes one JSON object per entry of 'd', with the change kind and the metadata
+// of both sides of the change.
+func WriteJSONL(w io.Writer, d *FsDiff) error {
+	enc := json.NewEncoder(w)
+	for _, e := range d.Entries {
+		rec := struct {
+			Path    string         `json:"path"`
+			Change  string         `json:"change"`
+			Type    string         `json:"type"`
+			Source  string         `json:"source,omitempty"`
+			Verdict string         `json:"verdict"`
+			Old     *jsonMeta      `json:"old,omitempty"`
+			New     *jsonMeta      `json:"new,omitempty"`
+			Config  []ConfigChange `json:"config,omitempty"`
+			Elf     *ElfReport     `json:"elf,omitempty"`
+		}{
+			Path:    e.Path,
+			Change:  e.Kind.String(),
+			Type:    e.Type().String(),
+			Source:  e.Source,
+			Verdict: e.Verdict.String(),
+			Old:     newJsonMeta(e.Old),
+			New:     newJsonMeta(e.New),
+			Config:  e.Config,
+			Elf:     e.Elf,
+		}
+		if err := enc.Encode(&rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newJsonMeta(fm *FileMeta) *jsonMeta {
+	if fm == nil {
+		return nil
+	}
+	jm := &jsonMeta{
+		Type:       fm.Type().String(),
+		Mode:       fmt.Sprintf("%04o", unixMode(fm.Mode)),
+		Size:       fm.Size,
+		Uid:        fm.Uid,
+		Gid:        fm.Gid,
+		ModTime:    optTime(fm.ModTime),
+		ChangeTime: optTime(fm.ChangeTime),
+		AccessTime: optTime(fm.AccessTime),
+		Link:       fm.Link,
+		HardLink:   fm.HardLink,
+		DevMajor:   fm.DevMajor,
+		DevMinor:   fm.DevMinor,
+		Xattrs:     fm.Xattrs,
+	}
+	if fm.Hash != "" {
+		jm.Hashes = map[HashAlgo]string{PRIMARY_HASH: fm.Hash}
+		for algo, digest := range fm.Hashes {
+			jm.Hashes[algo] = digest
+		}
+	}
+	return jm
+}
+
+func optTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Writes a CSV with a header and one row per entry of 'd'. The main columns hold the
+// new metadata, or the old metadata for removed entries, and the old_ columns hold
+// the old metadata of changed entries (or of the source of moved and copied ones).
+func WriteCSV(w io.Writer, d *FsDiff) error {
+	cw := csv.NewWriter(w)
+	header := []string{"path", "change", "type", "size", "mode", "uid", "gid", "mtime", "ctime", "atime"}
+	for _, algo := range HashAlgos {
+		header = append(header, string(algo))
+	}
+	header = append(header, "link", "hardlink", "source", "verdict", "old_size", "old_mode", "old_uid", "old_gid", "old_mtime", "old_"+string(PRIMARY_HASH))
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, e := range d.Entries {
+		cur, old := e.New, e.Old
+		if cur == nil {
+			cur, old = e.Old, nil
+		}
+		row := []string{e.Path, e.Kind.String(), e.Type().String(),
+			strconv.FormatInt(cur.Size, 10), fmt.Sprintf("%04o", unixMode(cur.Mode)),
+			strconv.Itoa(cur.Uid), strconv.Itoa(cur.Gid),
+			csvTime(cur.ModTime), csvTime(cur.ChangeTime), csvTime(cur.AccessTime)}
+		for _, algo := range HashAlgos {
+			row = append(row, cur.Digest(algo))
+		}
+		row = append(row, cur.Link, cur.HardLink, e.Source, e.Verdict.String())
+		if old != nil {
+			row = append(row, strconv.FormatInt(old.Size, 10), fmt.Sprintf("%04o", unixMode(old.Mode)),
+				strconv.Itoa(old.Uid), strconv.Itoa(old.Gid), csvTime(old.ModTime), old.Hash)
+		} else {
+			row = append(row, make([]string, 6)...)
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Writes 'd' as a Sleuth Kit 3.x bodyfile (MD5|name|inode|mode|UID|GID|size|atime|
+// mtime|ctime|crtime), which mactime turns into a timeline. Removed entries use their
+// old metadata and are marked "(deleted)" like TSK does, symlinks list their target
+// and moved or copied files their source.
+func WriteBodyfile(w io.Writer, d *FsDiff) error {
+	for _, e := range d.Entries {
+		fm, name := e.New, "/"+e.Path
+		if fm == nil {
+			fm, name = e.Old, name+" (deleted)"
+		}
+		if fm.Link != "" {
+			name += " -> " + fm.Link
+		}
+		if e.Source != "" {
+			name += fmt.Sprintf(" (%s from /%s)", e.Kind, e.Source)
+		}
+		md5 := fm.Digest(MD5)
+		if md5 == "" {
+			md5 = "0"
+		}
+		// '|' separates fields and there's no escaping, so replace it
+		name = strings.ReplaceAll(name, "|", "\\x7c")
+		_, err := fmt.Fprintf(w, "%s|%s|0|%s|%d|%d|%d|%d|%d|%d|0\n",
+			md5, name, lsMode(fm.Mode), fm.Uid, fm.Gid, fm.Size,
+			unixTime(fm.AccessTime), unixTime(fm.ModTime), unixTime(fm.ChangeTime))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// Returns the mode as a unix mode_t, with the setuid, setgid and sticky bits where
+// stat puts them.
+func unixMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 01000
+	}
+	return m
+}
+
+// Returns the mode formatted like 'ls -l', e.g. "-rwsr-xr-x".
+func lsMode(mode fs.FileMode) string {
+	const types = "-dlpscb"
+	buf := []byte{types[(&FileMeta{Mode: mode}).Type()]}
+	const rwx = "rwxrwxrwx"
+	for i := 0; i < 9; i++ {
+		if mode&(1<<uint(8-i)) != 0 {
+			buf = append(buf, rwx[i])
+		} else {
+			buf = append(buf, '-')
+		}
+	}
+	special := func(bit fs.FileMode, pos int, set, unset byte) {
+		if mode&bit != 0 {
+			if buf[pos] == '-' {
+				buf[pos] = unset
+			} else {
+				buf[pos] = set
+			}
+		}
+	}
+	special(fs.ModeSetuid, 3, 's', 'S')
+	special(fs.ModeSetgid, 6, 's', 'S')
+	special(fs.ModeSticky, 9, 't', 'T')
+	return string(buf)
+}
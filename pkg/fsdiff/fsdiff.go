@@ -1,11 +1,115 @@
 package fsdiff
 
 import (
+	"errors"
+	"fmt"
 	"path"
 
-	"github.com/samber/lo"
+	"golang.org/x/exp/slices"
 )
 
+// The kind of change found for a path
+type ChangeKind int
+
+const (
+	// Path only exists in the new tree
+	Added ChangeKind = iota
+	// Path only exists in the base tree
+	Removed
+	// Contents of the file changed
+	Modified
+	// Contents are the same but permissions, ownership, etc. changed
+	MetaModified
+	// Symbolic link points somewhere new
+	Retargeted
+	// Path changed type, for example a file was replaced by a directory or symlink
+	TypeChanged
+	// File was added with the contents of a base file that was removed or replaced
+	Moved
+	// File was added with the contents of a base file that still exists
+	Copied
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Modified:
+		return "modified"
+	case MetaModified:
+		return "meta-modified"
+	case Retargeted:
+		return "retargeted"
+	case TypeChanged:
+		return "type-changed"
+	case Moved:
+		return "moved"
+	case Copied:
+		return "copied"
+	default:
+		return "unknown"
+	}
+}
+
+// A single change found when comparing two trees.
+type DiffEntry struct {
+	// Full path of the entry
+	Path string
+	// What changed
+	Kind ChangeKind
+	// Metadata in the base tree, nil if the entry was added. For moved and copied
+	// entries this is the metadata of Source.
+	Old *FileMeta
+	// Metadata in the new tree, nil if the entry was removed
+	New *FileMeta
+	// Base path the contents came from, only set for moved and copied entries
+	Source string
+	// Whether the contents are in a hash set, see TagHashes
+	Verdict HashVerdict
+	// Record-level changes of a modified config file, see DiffConfig
+	Config []ConfigChange
+	// Unified diff of a modified text file, see UnifiedDiff
+	TextDiff string
+	// Triage of an added or modified ELF file, see TagElfs
+	Elf *ElfReport
+}
+
+// Returns the type of the entry. For type changes this is the new type.
+func (e *DiffEntry) Type() FileType {
+	if e.New != nil {
+		return e.New.Type()
+	}
+	return e.Old.Type()
+}
+
+// Returns true if the entry is a directory. For type changes this is the new type.
+func (e *DiffEntry) IsDir() bool {
+	return e.Type() == TypeDir
+}
+
+// Returns true if the entry is a device node, named pipe or socket. For type
+// changes this is the new type.
+func (e *DiffEntry) IsSpecial() bool {
+	if e.New != nil {
+		return e.New.IsSpecial()
+	}
+	return e.Old.IsSpecial()
+}
+
+// Returns true if the contents of the entry are collected, see GetAddedModified.
+func (e *DiffEntry) IsAddedModified() bool {
+	switch e.Kind {
+	case Added, Modified, Retargeted, TypeChanged:
+		return !e.IsDir() && !e.IsSpecial()
+	}
+	return false
+}
+
+// Called for each change found in a comparison, returning an error stops the comparison.
+type DiffFunc func(e *DiffEntry) error
+
 // A filesystem-diff, determines a full list of files that have been
 // added, modified, and removed.
 type FsDiff struct {
@@ -13,100 +117,357 @@ type FsDiff struct {
 	Added []string
 	// Full paths of files that were removed
 	Removed []string
-	// Full paths of files that were modified
+	// Full paths of files whose contents were modified
 	Modified []string
+	// Full paths of files with the same contents but different permissions,
+	// ownership, modification time or extended attributes
+	MetaModified []string
+	// Full paths of symbolic links that point somewhere new
+	Retargeted []string
+	// Full paths of directories that were added
+	AddedDirs []string
+	// Full paths of directories that were removed
+	RemovedDirs []string
+	// Full paths of directories with different permissions, ownership or extended
+	// attributes
+	MetaModifiedDirs []string
+	// Full paths that changed type, e.g. from a file to a directory or symlink
+	TypeChanged []string
+	// Full paths of device nodes, named pipes and sockets that were added
+	AddedSpecial []string
+	// Full paths of device nodes, named pipes and sockets that were removed
+	RemovedSpecial []string
+	// Full paths of device nodes whose major or minor number changed
+	ModifiedSpecial []string
+	// Full paths of files moved from another path, see DetectMoves
+	Moved []string
+	// Full paths of files copied from another path, see DetectMoves
+	Copied []string
+	// Full paths of changed files whose contents are known-good, see TagHashes
+	KnownGood []string
+	// Full paths of changed files whose contents are known-bad, see TagHashes
+	KnownBad []string
+	// Every change with its metadata, in the order they were found
+	Entries []*DiffEntry
+	// Number of files which weren't hashed in fast mode because their size, mode
+	// and modification time matched the base. Changes to their contents aren't
+	// detected. Their paths are only listed in the archive.
+	UnhashedCount int
+	// True if the ELF files were still being triaged when the diff was fetched, or
+	// the triage stopped early, so some reports may be missing, see TagElfs
+	ElfPending bool
 }
 
 func NewFsDiff() *FsDiff {
 	return &FsDiff{}
 }
 
-// Returns the combied list of added and modified files
+// Returns the combied list of added and modified files, including retargeted links
+// and paths that changed type into something other than a directory. Device nodes,
+// named pipes and sockets are never included, they have no contents to collect.
 func (d *FsDiff) GetAddedModified() []string {
-	lst := make([]string, 0, len(d.Added)+len(d.Modified))
+	lst := make([]string, 0, len(d.Added)+len(d.Modified)+len(d.Retargeted)+len(d.TypeChanged))
 	lst = append(lst, d.Added...)
 	lst = append(lst, d.Modified...)
+	lst = append(lst, d.Retargeted...)
+	for _, e := range d.Entries {
+		if e.Kind == TypeChanged && e.IsAddedModified() {
+			lst = append(lst, e.Path)
+		}
+	}
 	return lst
 }
 
+// Records a single change. This is a DiffFunc so it can be used to collect
+// the results of a streaming comparison.
+func (d *FsDiff) Add(e *DiffEntry) error {
+	switch {
+	case e.Kind == TypeChanged:
+		d.TypeChanged = append(d.TypeChanged, e.Path)
+	case e.Kind == Added && e.IsDir():
+		d.AddedDirs = append(d.AddedDirs, e.Path)
+	case e.Kind == Removed && e.IsDir():
+		d.RemovedDirs = append(d.RemovedDirs, e.Path)
+	case e.Kind == MetaModified && e.IsDir():
+		d.MetaModifiedDirs = append(d.MetaModifiedDirs, e.Path)
+	case e.Kind == Added && e.IsSpecial():
+		d.AddedSpecial = append(d.AddedSpecial, e.Path)
+	case e.Kind == Removed && e.IsSpecial():
+		d.RemovedSpecial = append(d.RemovedSpecial, e.Path)
+	case e.Kind == Modified && e.IsSpecial():
+		d.ModifiedSpecial = append(d.ModifiedSpecial, e.Path)
+	case e.Kind == Added:
+		d.Added = append(d.Added, e.Path)
+	case e.Kind == Removed:
+		d.Removed = append(d.Removed, e.Path)
+	case e.Kind == Modified:
+		d.Modified = append(d.Modified, e.Path)
+	case e.Kind == MetaModified:
+		d.MetaModified = append(d.MetaModified, e.Path)
+	case e.Kind == Retargeted:
+		d.Retargeted = append(d.Retargeted, e.Path)
+	case e.Kind == Moved:
+		d.Moved = append(d.Moved, e.Path)
+	case e.Kind == Copied:
+		d.Copied = append(d.Copied, e.Path)
+	}
+	d.Entries = append(d.Entries, e)
+	return nil
+}
+
+// Clears the per-kind path lists that Add fills, so the entries can be added again.
+func (d *FsDiff) resetKinds() {
+	d.Added, d.Removed, d.Modified, d.MetaModified, d.Retargeted = nil, nil, nil, nil, nil
+	d.AddedDirs, d.RemovedDirs, d.MetaModifiedDirs, d.TypeChanged = nil, nil, nil, nil
+	d.AddedSpecial, d.RemovedSpecial, d.ModifiedSpecial = nil, nil, nil
+	d.Moved, d.Copied = nil, nil
+}
+
 // Compare two directory metadata objects, building a full diff of them.
 func (d *FsDiff) Compare(lt *DirMeta, rt *DirMeta) error {
-	return d.compareDirs("", lt, rt)
-}
-
-func (d *FsDiff) compareDirs(root string, lt *DirMeta, rt *DirMeta) error {
-	// First diff files
-	ltFiles := lo.Keys(lt.Files)
-	rtFiles := lo.Keys(rt.Files)
-	filesDeleted, filesAdded := lo.Difference(ltFiles, rtFiles)
-	filesSame := lo.Intersect(ltFiles, rtFiles)
-
-	// Add directly added/removed files
-	prependDir(filesAdded, root)
-	prependDir(filesDeleted, root)
-	d.Added = append(d.Added, filesAdded...)
-	d.Removed = append(d.Removed, filesDeleted...)
-	// Check same files
-	for _, name := range filesSame {
-		ltF := lt.Files[name]
-		rtF := rt.Files[name]
-		if !ltF.IsSame(rtF) {
-			d.Modified = append(d.Modified, path.Join(root, name))
+	c := comparer{fn: d.Add}
+	return c.compareDirs("", lt, rt)
+}
+
+// Error returned by treeDir.list when a directory can't be read. The error has
+// already been recorded and the directory should just be skipped.
+var errUnreadable = errors.New("directory is unreadable")
+
+// One directory of a tree that is being compared.
+type treeDir interface {
+	// Lists the entries of the directory, sorted by name.
+	list() ([]treeEntry, error)
+}
+
+// Entry in a treeDir
+type treeEntry struct {
+	// Metadata of the entry
+	meta *FileMeta
+	// Contents of the entry if it's a directory, otherwise nil
+	dir treeDir
+	// True if the metadata is incomplete because the entry couldn't be read
+	unreadable bool
+	// True if the entry matched an exclude rule and must be ignored
+	excluded bool
+	// True if the entry is a directory without metadata of its own
+	implicit bool
+}
+
+// Implement treeDir.list
+func (d *DirMeta) list() ([]treeEntry, error) {
+	entries := make([]treeEntry, 0, len(d.Files)+len(d.Dirs))
+	for _, fm := range d.Files {
+		entries = append(entries, treeEntry{meta: fm})
+	}
+	for _, dm := range d.Dirs {
+		entries = append(entries, treeEntry{meta: &dm.FileMeta, dir: dm, implicit: dm.Implicit})
+	}
+	slices.SortFunc(entries, func(a, b treeEntry) bool {
+		return a.meta.Name < b.meta.Name
+	})
+	return entries, nil
+}
+
+// Implemented by the directories of stored trees, which may have subtree hashes
+// and be partial
+type subtreeDir interface {
+	// Returns the TreeHash of the directory, or an empty string if it's unknown
+	subtreeHash() string
+	// Returns the directory as a DirMeta if it's Partial, otherwise nil
+	partialMeta() *DirMeta
+}
+
+// Implement subtreeDir.subtreeHash
+func (d *DirMeta) subtreeHash() string {
+	return d.TreeHash
+}
+
+// Implement subtreeDir.partialMeta
+func (d *DirMeta) partialMeta() *DirMeta {
+	if d.Partial {
+		return d
+	}
+	return nil
+}
+
+// Walks two trees side by side, reporting each change to fn.
+type comparer struct {
+	fn DiffFunc
+	// Returns true if a path in the base tree should be ignored, may be nil
+	skip func(fpath string, fm *FileMeta) bool
+	// Called for Partial base directories instead of comparing their contents, with
+	// the matching directory of the other tree or nil if there is none. May be nil,
+	// in which case partial base trees can't be compared.
+	partial func(fpath string, base *DirMeta, other treeDir) error
+}
+
+func (c *comparer) compareDirs(root string, lt treeDir, rt treeDir) error {
+	ltList, err := lt.list()
+	if err != nil {
+		return skipUnreadable(err)
+	}
+	rtList, err := rt.list()
+	if err != nil {
+		return skipUnreadable(err)
+	}
+	// Both lists are sorted, so step through them together
+	i, j := 0, 0
+	for i < len(ltList) || j < len(rtList) {
+		switch {
+		case j >= len(rtList) || (i < len(ltList) && ltList[i].meta.Name < rtList[j].meta.Name):
+			err = c.removed(root, ltList[i])
+			i++
+		case i >= len(ltList) || rtList[j].meta.Name < ltList[i].meta.Name:
+			err = c.added(root, rtList[j])
+			j++
+		default:
+			err = c.compareEntries(root, ltList[i], rtList[j])
+			i++
+			j++
+		}
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	// Diff directories
-	ltDirs := lo.Keys(lt.Dirs)
-	rtDirs := lo.Keys(rt.Dirs)
-	dirsDeleted, dirsAdded := lo.Difference(ltDirs, rtDirs)
-	dirsSame := lo.Intersect(ltDirs, rtDirs)
+// Compares two entries with the same name.
+func (c *comparer) compareEntries(root string, lt treeEntry, rt treeEntry) error {
+	fpath := path.Join(root, lt.meta.Name)
+	if lt.excluded || rt.excluded || (c.skip != nil && c.skip(fpath, lt.meta)) {
+		return nil
+	}
+	ltF, rtF := lt.meta, rt.meta
+	if ltF.Mode.Type() != rtF.Mode.Type() {
+		return c.typeChanged(fpath, lt, rt)
+	}
+	if lt.dir != nil && rt.dir != nil {
+		if !lt.implicit && !rt.implicit && !ltF.SameMeta(rtF) {
+			e := &DiffEntry{Path: fpath, Kind: MetaModified, Old: ltF, New: rtF}
+			if err := c.fn(e); err != nil {
+				return err
+			}
+		}
+		if ltDir, ok := lt.dir.(subtreeDir); ok {
+			// Identical subtrees don't need to be walked
+			hash := ltDir.subtreeHash()
+			if rtDir, ok := rt.dir.(subtreeDir); ok && hash != "" && hash == rtDir.subtreeHash() {
+				return nil
+			}
+			if dm := ltDir.partialMeta(); dm != nil {
+				return c.partialDir(fpath, dm, rt.dir)
+			}
+		}
+		return c.compareDirs(fpath, lt.dir, rt.dir)
+	}
+	if lt.unreadable || rt.unreadable {
+		return nil
+	}
+	e := &DiffEntry{Path: fpath, Old: ltF, New: rtF}
+	if ltF.SameContent(rtF) {
+		if ltF.SameMeta(rtF) {
+			return nil
+		}
+		e.Kind = MetaModified
+	} else if ltF.IsSymlink() {
+		e.Kind = Retargeted
+	} else {
+		e.Kind = Modified
+	}
+	return c.fn(e)
+}
 
-	// Recursively track added/removed directories
-	for _, name := range dirsAdded {
-		d.recAdded(path.Join(root, name), rt.Dirs[name])
+// Reports a path whose type changed. The contents of a replaced directory are
+// reported as removed, and the contents of a new directory as added.
+func (c *comparer) typeChanged(fpath string, lt treeEntry, rt treeEntry) error {
+	if err := c.fn(&DiffEntry{Path: fpath, Kind: TypeChanged, Old: lt.meta, New: rt.meta}); err != nil {
+		return err
 	}
-	for _, name := range dirsDeleted {
-		d.recRemoved(path.Join(root, name), lt.Dirs[name])
+	if lt.dir != nil {
+		if err := c.removedChildren(fpath, lt.dir); err != nil {
+			return err
+		}
 	}
-	// Recursively handle directories that are the same
-	for _, name := range dirsSame {
-		ltD := lt.Dirs[name]
-		rtD := rt.Dirs[name]
-		if err := d.compareDirs(path.Join(root, name), ltD, rtD); err != nil {
+	if rt.dir != nil {
+		return c.addedChildren(fpath, rt.dir)
+	}
+	return nil
+}
+
+// Reports the entry as added, followed by all of its contents if it's a directory.
+func (c *comparer) added(root string, te treeEntry) error {
+	fpath := path.Join(root, te.meta.Name)
+	if te.excluded {
+		return nil
+	}
+	if err := c.fn(&DiffEntry{Path: fpath, Kind: Added, New: te.meta}); err != nil {
+		return err
+	}
+	if te.dir == nil {
+		return nil
+	}
+	return c.addedChildren(fpath, te.dir)
+}
+
+func (c *comparer) addedChildren(fpath string, dir treeDir) error {
+	entries, err := dir.list()
+	if err != nil {
+		return skipUnreadable(err)
+	}
+	for _, child := range entries {
+		if err := c.added(fpath, child); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// Adds all files and directories in the given root recursively to self.
-func (d *FsDiff) recAdded(root string, dm *DirMeta) {
-	// Track files
-	addedFiles := lo.Keys(dm.Files)
-	prependDir(addedFiles, root)
-	d.Added = append(d.Added, addedFiles...)
-	// Recurse into directories
-	for _, dir := range dm.Dirs {
-		d.recAdded(path.Join(root, dir.Name), dir)
+// Reports the entry as removed, followed by all of its contents if it's a directory.
+func (c *comparer) removed(root string, te treeEntry) error {
+	fpath := path.Join(root, te.meta.Name)
+	if c.skip != nil && c.skip(fpath, te.meta) {
+		return nil
+	}
+	if err := c.fn(&DiffEntry{Path: fpath, Kind: Removed, Old: te.meta}); err != nil {
+		return err
 	}
+	if te.dir == nil {
+		return nil
+	}
+	return c.removedChildren(fpath, te.dir)
+}
+
+func (c *comparer) removedChildren(fpath string, dir treeDir) error {
+	if sd, ok := dir.(subtreeDir); ok {
+		if dm := sd.partialMeta(); dm != nil {
+			return c.partialDir(fpath, dm, nil)
+		}
+	}
+	entries, err := dir.list()
+	if err != nil {
+		return skipUnreadable(err)
+	}
+	for _, child := range entries {
+		if err := c.removed(fpath, child); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Lists all files and directories recursively in 'dm' as being removed in self.
-func (d *FsDiff) recRemoved(root string, dm *DirMeta) {
-	// Track files
-	removedFiles := lo.Keys(dm.Files)
-	prependDir(removedFiles, root)
-	d.Removed = append(d.Removed, removedFiles...)
-	// Recurse into directories
-	for _, dir := range dm.Dirs {
-		d.recRemoved(path.Join(root, dir.Name), dir)
+// Hands a Partial base directory to c.partial.
+func (c *comparer) partialDir(fpath string, base *DirMeta, other treeDir) error {
+	if c.partial == nil {
+		return fmt.Errorf("base directory '%s' is partial", fpath)
 	}
+	return c.partial(fpath, base, other)
 }
 
-// Helper function to prepend 'dir' to each value in 'files'.
-// This modifies 'files'.
-func prependDir(files []string, dir string) {
-	for i, n := range files {
-		files[i] = path.Join(dir, n)
+// Unreadable directories have been recorded already and are skipped.
+func skipUnreadable(err error) error {
+	if err == errUnreadable {
+		return nil
 	}
+	return err
 }
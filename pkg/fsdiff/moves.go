@@ -0,0 +1,101 @@
+package fsdiff
+
+import (
+	"path"
+)
+
+// Finds the regular files of a base tree by their contents, see DetectMoves
+type FileFinder interface {
+	// Calls fn with the path and metadata of each non-empty regular file whose Hash
+	// is in 'hashes', in no particular order.
+	FindFiles(hashes map[string]bool, fn func(fpath string, fm *FileMeta))
+}
+
+// Matches the contents of added files against the base tree. An added file with the
+// contents of a removed file, or of a file whose contents were replaced, is reported
+// as Moved, replacing its Added entry and the Removed entry of the source. An added
+// file with the contents of any other base file is reported as Copied, from the
+// first such file by path. Each removed or replaced file is the source of at most
+// one move, further matches are copies. Empty files and hard links are never
+// matched. Moved and copied files aren't part of GetAddedModified, their contents
+// are already in the base.
+func (d *FsDiff) DetectMoves(base FileFinder) {
+	// Base paths of the contents which were removed or replaced
+	gone := make(map[string][]*DiffEntry)
+	for _, e := range d.Entries {
+		if (e.Kind == Removed || e.Kind == Modified) && isMovable(e.Old) {
+			gone[e.Old.Hash] = append(gone[e.Old.Hash], e)
+		}
+	}
+	moved := make(map[*DiffEntry]bool)
+	// Contents of the added files which weren't moved, to search the base for
+	wanted := make(map[string]bool)
+	entries := make([]*DiffEntry, 0, len(d.Entries))
+	for _, e := range d.Entries {
+		if e.Kind != Added || !isMovable(e.New) || e.New.HardLink != "" {
+			entries = append(entries, e)
+			continue
+		}
+		if srcs := gone[e.New.Hash]; len(srcs) > 0 {
+			src := srcs[0]
+			gone[e.New.Hash] = srcs[1:]
+			moved[src] = true
+			entries = append(entries, &DiffEntry{Path: e.Path, Kind: Moved, Old: src.Old, New: e.New, Source: src.Path})
+			continue
+		}
+		wanted[e.New.Hash] = true
+		entries = append(entries, e)
+	}
+
+	// Only search the base tree if it's needed
+	type source struct {
+		fpath string
+		fm    *FileMeta
+	}
+	sources := make(map[string]source)
+	if len(wanted) > 0 {
+		base.FindFiles(wanted, func(fpath string, fm *FileMeta) {
+			if src, ok := sources[fm.Hash]; !ok || fpath < src.fpath {
+				sources[fm.Hash] = source{fpath, fm}
+			}
+		})
+	}
+
+	// Rebuild the lists without the removed entries that were moved
+	d.resetKinds()
+	d.Entries = nil
+	for _, e := range entries {
+		if e.Kind == Removed && moved[e] {
+			continue
+		}
+		if e.Kind != Added {
+			d.Add(e)
+			continue
+		}
+		if src, ok := sources[e.New.Hash]; ok && e.New.HardLink == "" && isMovable(e.New) {
+			e = &DiffEntry{Path: e.Path, Kind: Copied, Old: src.fm, New: e.New, Source: src.fpath}
+		}
+		d.Add(e)
+	}
+}
+
+// Returns true if the contents of the file can be matched.
+func isMovable(fm *FileMeta) bool {
+	return fm.Mode.IsRegular() && fm.Hash != "" && fm.Size > 0
+}
+
+// Implement FileFinder.FindFiles
+func (d *DirMeta) FindFiles(hashes map[string]bool, fn func(fpath string, fm *FileMeta)) {
+	d.findFiles("", hashes, fn)
+}
+
+func (d *DirMeta) findFiles(root string, hashes map[string]bool, fn func(fpath string, fm *FileMeta)) {
+	for name, fm := range d.Files {
+		if isMovable(fm) && hashes[fm.Hash] {
+			fn(path.Join(root, name), fm)
+		}
+	}
+	for name, sub := range d.Dirs {
+		sub.findFiles(path.Join(root, name), hashes, fn)
+	}
+}
@@ -0,0 +1,77 @@
+package fsdiff
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Error recorded for symbolic links when the filesystem does not implement ReadLinkFS
+var ErrReadLinkUnsupported = errors.New("filesystem cannot read symbolic links")
+
+// A filesystem that can read the target of a symbolic link without following it.
+type ReadLinkFS interface {
+	fs.FS
+	// Returns the target of the symbolic link at 'name'.
+	ReadLink(name string) (string, error)
+}
+
+// A filesystem that can list the extended attributes of a file.
+type XattrFS interface {
+	fs.FS
+	// Returns the extended attributes of 'name' (without following symlinks), or
+	// nil if it has none.
+	Xattrs(name string) (map[string]string, error)
+}
+
+// Filesystem rooted at a local directory. Similar to os.DirFS but it also
+// implements ReadLinkFS so symbolic links can be recorded instead of followed,
+// and XattrFS where the platform supports it.
+type OsFS struct {
+	fs.FS
+	// Local path the filesystem is rooted at
+	root string
+}
+
+func NewOsFS(root string) *OsFS {
+	return &OsFS{
+		FS:   os.DirFS(root),
+		root: root,
+	}
+}
+
+// Returns the local path of 'name', or an error if 'name' is not a valid path.
+func (f *OsFS) localPath(op string, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return filepath.Join(f.root, filepath.FromSlash(name)), nil
+}
+
+// Implement ReadLinkFS.ReadLink
+func (f *OsFS) ReadLink(name string) (string, error) {
+	fpath, err := f.localPath("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(fpath)
+}
+
+// Implement XattrFS.Xattrs
+func (f *OsFS) Xattrs(name string) (map[string]string, error) {
+	fpath, err := f.localPath("listxattr", name)
+	if err != nil {
+		return nil, err
+	}
+	return readXattrs(fpath)
+}
+
+// Implement fs.SubFS, so fs.Sub keeps ReadLinkFS and XattrFS support
+func (f *OsFS) Sub(dir string) (fs.FS, error) {
+	fpath, err := f.localPath("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	return NewOsFS(fpath), nil
+}
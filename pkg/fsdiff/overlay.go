@@ -0,0 +1,339 @@
+package fsdiff
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Prefixes of the extended attributes overlayfs uses for its own bookkeeping
+var overlayXattrPrefixes = []string{"trusted.overlay.", "user.overlay."}
+
+// Error recorded for a metadata-only copy whose contents aren't in any lower layer
+var errMetacopyData = errors.New("contents of metadata-only copy not found in the lower layers")
+
+// Compares the layers of an overlay filesystem. 'upper' is the upper directory, which
+// holds every file that was created, modified or copied up, and 'lowers' are the lower
+// directories from top to bottom. Only the paths in the upper directory are compared,
+// so the lower layers are never walked in full. Whiteouts (0/0 character devices) and
+// directories replaced by opaque ones are reported as removed.
+//
+// Files copied up with metacopy=on only hold their metadata in the upper directory,
+// their contents are read from the lower layers (data-only layers aren't searched).
+// Directories renamed with redirect_dir=on are merged with the lower directory they
+// were renamed from, so their contents are reported as removed from the old path and
+// added to the new one, see FsDiff.DetectMoves.
+//
+// Metadata for all layers is collected with b, see CompareFs. If the lower layers are
+// missing every entry of the upper directory is reported as added.
+func CompareOverlay(upper fs.FS, lowers []fs.FS, b *DirMetaBuilder, fn DiffFunc) error {
+	o := &overlayLayers{upper: upper, lowers: lowers, b: b}
+	c := &comparer{fn: fn, skip: b.IsExcluded}
+	return c.compareDirs(".", &lowerDir{o: o, fpath: ".", layers: o.allLayers()}, &upperDir{o: o, fpath: "."})
+}
+
+type overlayLayers struct {
+	upper  fs.FS
+	lowers []fs.FS
+	b      *DirMetaBuilder
+}
+
+// Returns the index of every lower layer, from top to bottom.
+func (o *overlayLayers) allLayers() []int {
+	layers := make([]int, len(o.lowers))
+	for i := range layers {
+		layers[i] = i
+	}
+	return layers
+}
+
+// Hashes the regular file at 'fpath' in the upper directory. The contents of a
+// metadata-only copy are read from the topmost lower layer with a file at 'src'.
+func (o *overlayLayers) hashUpper(fpath string, fm *FileMeta, src string) error {
+	if !hasOverlayXattr(fm, "metacopy") {
+		return o.b.rehash(o.upper, fpath, fm, true)
+	}
+	for _, lower := range o.lowers {
+		if info, err := fs.Stat(lower, src); err == nil && info.Mode().IsRegular() {
+			return o.b.rehash(lower, src, fm, true)
+		}
+	}
+	return &fs.PathError{Op: "open", Path: src, Err: errMetacopyData}
+}
+
+// Returns true if 'fm' marks a removed entry: a 0/0 character device, or a file with
+// the whiteout attribute used by newer kernels.
+func isWhiteout(fm *FileMeta) bool {
+	if fm.Mode&fs.ModeCharDevice != 0 && fm.DevMajor == 0 && fm.DevMinor == 0 {
+		return true
+	}
+	return hasOverlayXattr(fm, "whiteout")
+}
+
+// Returns true if 'fm' is a directory which hides the contents of the layers below.
+func isOpaque(fm *FileMeta) bool {
+	for _, prefix := range overlayXattrPrefixes {
+		if fm.Xattrs[prefix+"opaque"] == "y" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasOverlayXattr(fm *FileMeta, name string) bool {
+	_, ok := overlayXattr(fm, name)
+	return ok
+}
+
+// Returns the value of the overlayfs attribute 'name'.
+func overlayXattr(fm *FileMeta, name string) (string, bool) {
+	for _, prefix := range overlayXattrPrefixes {
+		if value, ok := fm.Xattrs[prefix+name]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// Returns the path in the lower layers an upper entry was renamed from, if it was.
+// Relative redirects are names within the lower directory 'lowerParent'.
+func redirectPath(fm *FileMeta, lowerParent string) (string, bool) {
+	target, ok := overlayXattr(fm, "redirect")
+	if !ok {
+		return "", false
+	}
+	if path.IsAbs(target) {
+		return cleanPath(target), true
+	}
+	return path.Join(lowerParent, target), true
+}
+
+// Removes the overlayfs attributes, which differ between layers without the
+// files themselves being different.
+func stripOverlayXattrs(fm *FileMeta) {
+	for key := range fm.Xattrs {
+		for _, prefix := range overlayXattrPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				delete(fm.Xattrs, key)
+			}
+		}
+	}
+	if len(fm.Xattrs) == 0 {
+		fm.Xattrs = nil
+	}
+}
+
+// A directory of the upper layer, without its whiteouts. Regular files are hashed
+// here rather than by fsDir, because metadata-only copies have their contents in a
+// lower layer.
+type upperDir struct {
+	o     *overlayLayers
+	fpath string
+	// Lower directory this one was renamed from, or is within one that was, whose
+	// entries are merged in. Nil if the lower entries are compared separately, see
+	// lowerDir.
+	lower *lowerDir
+}
+
+// Implement treeDir.list
+func (d *upperDir) list() ([]treeEntry, error) {
+	dir := &fsDir{fsys: d.o.upper, b: d.o.b, fpath: d.fpath, noHash: true}
+	entries, err := dir.list()
+	if err != nil {
+		return nil, err
+	}
+	// Path of the directory's contents in the lower layers
+	lowerPath := d.fpath
+	lowerEntries := make(map[string]treeEntry)
+	if d.lower != nil {
+		lowerPath = d.lower.fpath
+		list, err := d.lower.list()
+		if err != nil {
+			return nil, err
+		}
+		for _, te := range list {
+			lowerEntries[te.meta.Name] = te
+		}
+	}
+
+	jobs := newJobGroup(d.o.b.workers())
+	// There's room for every upper entry, so the jobs' entries don't move while it grows
+	out := make([]treeEntry, 0, len(entries))
+	for _, te := range entries {
+		name := te.meta.Name
+		// Whiteouts and upper entries hide the lower ones
+		lt := lowerEntries[name]
+		delete(lowerEntries, name)
+		if isWhiteout(te.meta) {
+			continue
+		}
+		fpath := path.Join(d.fpath, name)
+		src, renamed := redirectPath(te.meta, lowerPath)
+		if !renamed {
+			src = path.Join(lowerPath, name)
+		}
+		if te.dir != nil {
+			child := &upperDir{o: d.o, fpath: fpath}
+			if renamed {
+				// Which layers the old directory is visible in isn't known, so all
+				// of them are merged
+				child.lower = &lowerDir{o: d.o, fpath: src, layers: d.o.allLayers(), all: true}
+			} else if ld, ok := lt.dir.(*lowerDir); ok && !isOpaque(te.meta) {
+				child.lower = ld
+			}
+			te.dir = child
+		}
+		out = append(out, te)
+		if !te.excluded && te.meta.Mode.IsRegular() {
+			te := &out[len(out)-1]
+			jobs.Go(func() {
+				if err := d.o.hashUpper(fpath, te.meta, src); err != nil {
+					d.o.b.addError(fpath, err)
+					te.unreadable = true
+				}
+				stripOverlayXattrs(te.meta)
+			})
+		} else {
+			stripOverlayXattrs(te.meta)
+		}
+	}
+	jobs.Wait()
+	for _, te := range lowerEntries {
+		out = append(out, te)
+	}
+	slices.SortFunc(out, func(a, b treeEntry) bool {
+		return a.meta.Name < b.meta.Name
+	})
+	return out, nil
+}
+
+// The merged lower layers of a directory. Unless 'all' is set, only the entries
+// that also exist in the upper directory are listed, the others are unchanged.
+type lowerDir struct {
+	o     *overlayLayers
+	fpath string
+	// Lower layers this directory is visible in, from top to bottom
+	layers []int
+	// List every entry, because the upper directory is missing, opaque or not a
+	// directory
+	all bool
+}
+
+// Implement treeDir.list
+func (d *lowerDir) list() ([]treeEntry, error) {
+	b := d.o.b
+	// Entries of the directory in each layer
+	layerEntries := make([]map[string]fs.DirEntry, len(d.layers))
+	names := make(map[string]bool)
+	for i, layer := range d.layers {
+		release := b.acquireIO()
+		dirEntries, err := fs.ReadDir(d.o.lowers[layer], d.fpath)
+		release()
+		if err != nil {
+			continue
+		}
+		layerEntries[i] = make(map[string]fs.DirEntry, len(dirEntries))
+		for _, de := range dirEntries {
+			layerEntries[i][de.Name()] = de
+			if d.all {
+				names[de.Name()] = true
+			}
+		}
+	}
+	// Which names in the upper directory are directories merged with the lower ones.
+	// Any other entry hides them, including opaque and renamed directories.
+	upperDirs := make(map[string]bool)
+	if !d.all {
+		release := b.acquireIO()
+		dirEntries, err := fs.ReadDir(d.o.upper, d.fpath)
+		release()
+		if err != nil {
+			b.addError(d.fpath, err)
+			return nil, errUnreadable
+		}
+		for _, de := range dirEntries {
+			names[de.Name()] = true
+			if de.IsDir() {
+				fm, err := EntryMeta(de)
+				if err == nil && b.readFsMeta(d.o.upper, path.Join(d.fpath, de.Name()), fm, hashNone) == nil {
+					upperDirs[de.Name()] = !isOpaque(fm) && !hasOverlayXattr(fm, "redirect")
+				}
+			}
+		}
+	}
+
+	jobs := newJobGroup(b.workers())
+	entries := make([]treeEntry, 0, len(names))
+	for _, name := range maps.Keys(names) {
+		fpath := path.Join(d.fpath, name)
+		te, layer, childLayers := d.lookup(layerEntries, name)
+		if te.meta == nil {
+			continue
+		}
+		te.excluded = b.IsExcluded(fpath, te.meta)
+		if !te.excluded && te.meta.Mode.IsDir() {
+			te.dir = &lowerDir{o: d.o, fpath: fpath, layers: childLayers, all: !upperDirs[name]}
+		}
+		entries = append(entries, te)
+		if te.excluded || te.meta.Mode.IsDir() {
+			stripOverlayXattrs(te.meta)
+			continue
+		}
+		fm := te.meta
+		jobs.Go(func() {
+			if err := b.readFsMeta(d.o.lowers[layer], fpath, fm, hashPrimary); err != nil {
+				b.addError(fpath, err)
+			}
+			stripOverlayXattrs(fm)
+		})
+	}
+	jobs.Wait()
+	slices.SortFunc(entries, func(a, b treeEntry) bool {
+		return a.meta.Name < b.meta.Name
+	})
+	return entries, nil
+}
+
+// Returns the topmost visible entry named 'name', the layer it's in, and if it's a
+// directory, the layers it's merged from. The metadata is nil if no layer has the
+// entry or it was removed by a whiteout.
+func (d *lowerDir) lookup(layerEntries []map[string]fs.DirEntry, name string) (te treeEntry, layer int, childLayers []int) {
+	b := d.o.b
+	fpath := path.Join(d.fpath, name)
+	for i, entries := range layerEntries {
+		de := entries[name]
+		if de == nil {
+			continue
+		}
+		fm, err := EntryMeta(de)
+		if err != nil {
+			b.addError(fpath, err)
+			return
+		}
+		if te.meta != nil && !fm.Mode.IsDir() {
+			// A lower file is hidden by the directory above it
+			return
+		}
+		if !fm.Mode.IsDir() {
+			if !isWhiteout(fm) {
+				te.meta, layer = fm, d.layers[i]
+			}
+			return
+		}
+		if err := b.readFsMeta(d.o.lowers[d.layers[i]], fpath, fm, hashNone); err != nil {
+			b.addError(fpath, err)
+		}
+		if te.meta == nil {
+			te.meta, layer = fm, d.layers[i]
+		}
+		childLayers = append(childLayers, d.layers[i])
+		if isOpaque(fm) {
+			return
+		}
+	}
+	return
+}
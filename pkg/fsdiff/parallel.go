@@ -0,0 +1,91 @@
+package fsdiff
+
+import (
+	"sync"
+)
+
+// Size of the buffers used to read files while hashing
+const HASH_BUFFER_SIZE = 64 * 1024
+
+// State shared between a builder and any copies made with withRoot.
+type builderShared struct {
+	// Protects the tree and PathErrors while files are hashed in parallel
+	lck sync.Mutex
+	// Read buffers, one is used by each hashing goroutine
+	bufs sync.Pool
+	// Limits the number of filesystem reads in progress, created on first use
+	ioSem     chan struct{}
+	ioSemOnce sync.Once
+	// First path seen for each local inode with more than one link
+	links map[Inode]string
+	// First paths of hard link groups whose contents were hashed and matched the
+	// base, see DirMetaBuilder.MatchedLink
+	matchedLinks map[string]bool
+	// Live subtrees of partial base directories that didn't match, by path, see
+	// DirMetaBuilder.sameSubtree
+	probed map[string]*DirMeta
+}
+
+func newBuilderShared() *builderShared {
+	return &builderShared{
+		bufs: sync.Pool{
+			New: func() any {
+				buf := make([]byte, HASH_BUFFER_SIZE)
+				return &buf
+			},
+		},
+		links:        make(map[Inode]string),
+		matchedLinks: make(map[string]bool),
+		probed:       make(map[string]*DirMeta),
+	}
+}
+
+// Returns the number of files to hash at once.
+func (b *DirMetaBuilder) workers() int {
+	if b.Workers < 1 {
+		return 1
+	}
+	return b.Workers
+}
+
+// Blocks until another filesystem read may start, the returned function must be
+// called once the read is done.
+func (b *DirMetaBuilder) acquireIO() func() {
+	b.shared.ioSemOnce.Do(func() {
+		n := b.MaxIO
+		if n < 1 {
+			n = b.workers()
+		}
+		b.shared.ioSem = make(chan struct{}, n)
+	})
+	b.shared.ioSem <- struct{}{}
+	return func() { <-b.shared.ioSem }
+}
+
+// Runs functions in parallel, with a limit on how many run at once.
+type jobGroup struct {
+	sem chan struct{}
+	wg  sync.WaitGroup
+}
+
+func newJobGroup(limit int) *jobGroup {
+	return &jobGroup{sem: make(chan struct{}, limit)}
+}
+
+// Runs fn in a new goroutine, first waiting until fewer than the limit are running.
+func (g *jobGroup) Go(fn func()) {
+	g.sem <- struct{}{}
+	g.wg.Add(1)
+	go func() {
+		defer func() {
+			<-g.sem
+			g.wg.Done()
+		}()
+		fn()
+	}()
+}
+
+// Waits for all started functions to return.
+func (g *jobGroup) Wait() {
+	g.wg.Wait()
+}
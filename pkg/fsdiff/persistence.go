@@ -0,0 +1,160 @@
+package fsdiff
+
+import (
+	"encoding/csv"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// How urgently a finding should be looked at
+type Severity int
+
+const (
+	SeverityLow Severity = iota
+	SeverityMedium
+	SeverityHigh
+	SeverityCritical
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityLow:
+		return "low"
+	case SeverityMedium:
+		return "medium"
+	case SeverityHigh:
+		return "high"
+	case SeverityCritical:
+		return "critical"
+	default:
+		return "unknown"
+	}
+}
+
+// Files where a change can make code run again later, e.g. at boot or login
+type PersistenceLocation struct {
+	Category string
+	Severity Severity
+	// Glob patterns in the same syntax as exclude rules, see Rule
+	Patterns []string
+	res      []*regexp.Regexp
+}
+
+// Known persistence locations. A path is reported for the first location it
+// matches, so more specific locations come first.
+var PersistenceLocations = []*PersistenceLocation{
+	{Category: "preload", Severity: SeverityCritical, Patterns: []string{
+		"/etc/ld.so.preload"}},
+	{Category: "ssh", Severity: SeverityCritical, Patterns: []string{
+		"**/.ssh/authorized_keys", "**/.ssh/authorized_keys2"}},
+	{Category: "accounts", Severity: SeverityCritical, Patterns: []string{
+		"/etc/passwd", "/etc/shadow", "/etc/group", "/etc/gshadow"}},
+	{Category: "sudo", Severity: SeverityCritical, Patterns: []string{
+		"/etc/sudoers", "/etc/sudoers.d/**", "/etc/doas.conf"}},
+	{Category: "pam", Severity: SeverityCritical, Patterns: []string{
+		"**/security/pam_*.so"}},
+	{Category: "pam", Severity: SeverityHigh, Patterns: []string{
+		"/etc/pam.d/**", "/etc/pam.conf", "/etc/security/**"}},
+	{Category: "ssh", Severity: SeverityHigh, Patterns: []string{
+		"/etc/ssh/sshd_config", "/etc/ssh/sshd_config.d/**", "/etc/ssh/sshrc", "**/.ssh/rc"}},
+	{Category: "preload", Severity: SeverityHigh, Patterns: []string{
+		"/etc/ld.so.conf", "/etc/ld.so.conf.d/**"}},
+	{Category: "cron", Severity: SeverityHigh, Patterns: []string{
+		"/etc/crontab", "/etc/anacrontab", "/etc/cron.d/**", "/etc/cron.hourly/**",
+		"/etc/cron.daily/**", "/etc/cron.weekly/**", "/etc/cron.monthly/**",
+		"/etc/periodic/**", "/var/spool/cron/**"}},
+	{Category: "systemd", Severity: SeverityHigh, Patterns: []string{
+		"/etc/systemd/**", "/lib/systemd/system/**", "/usr/lib/systemd/system/**",
+		"/lib/systemd/user/**", "/usr/lib/systemd/user/**", "/run/systemd/system/**",
+		"**/.config/systemd/**"}},
+	{Category: "init", Severity: SeverityHigh, Patterns: []string{
+		"/etc/init.d/**", "/etc/rc.local", "/etc/rc.d/**", "/etc/rc[0-6S].d/**",
+		"/etc/init/**", "/etc/inittab", "/etc/local.d/**", "/etc/runlevels/**"}},
+	{Category: "shell", Severity: SeverityMedium, Patterns: []string{
+		"/etc/profile", "/etc/profile.d/**", "/etc/bash.bashrc", "/etc/bashrc",
+		"/etc/environment", "/etc/zsh/**", "/etc/zshrc", "/etc/zprofile",
+		".bashrc", ".bash_profile", ".bash_login", ".bash_logout", ".profile",
+		".zshrc", ".zshenv", ".zprofile", ".zlogin"}},
+	{Category: "autostart", Severity: SeverityMedium, Patterns: []string{
+		"/etc/xdg/autostart/**", "**/.config/autostart/**", "/etc/update-motd.d/**"}},
+}
+
+func init() {
+	for _, loc := range PersistenceLocations {
+		for _, pattern := range loc.Patterns {
+			re, err := globRegexp(pattern)
+			if err != nil {
+				panic(err)
+			}
+			loc.res = append(loc.res, re)
+		}
+	}
+}
+
+// Returns true if 'fpath' is in this location.
+func (loc *PersistenceLocation) Matches(fpath string) bool {
+	fpath = cleanPath(fpath)
+	for _, re := range loc.res {
+		if re.MatchString(fpath) {
+			return true
+		}
+	}
+	return false
+}
+
+// A change in a persistence location
+type PersistenceFinding struct {
+	Path     string
+	Category string
+	Severity Severity
+	// The change the finding is about
+	Entry *DiffEntry
+}
+
+// Returns the changes in 'd' to files in known persistence locations, including
+// removed files and metadata changes. Directories are left out, their contents
+// are reported instead.
+func FindPersistence(d *FsDiff) []PersistenceFinding {
+	findings := make([]PersistenceFinding, 0)
+	for _, e := range d.Entries {
+		if e.IsDir() {
+			continue
+		}
+		for _, loc := range PersistenceLocations {
+			if loc.Matches(e.Path) {
+				findings = append(findings, PersistenceFinding{
+					Path:     e.Path,
+					Category: loc.Category,
+					Severity: loc.Severity,
+					Entry:    e,
+				})
+				break
+			}
+		}
+	}
+	return findings
+}
+
+// Writes the findings of FindPersistence in 'd' as a CSV.
+func WritePersistence(w io.Writer, d *FsDiff) error {
+	cw := csv.NewWriter(w)
+	header := []string{"path", "category", "severity", "change", "type", "size", "mtime", string(PRIMARY_HASH), "source"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, f := range FindPersistence(d) {
+		e := f.Entry
+		fm := e.New
+		if fm == nil {
+			fm = e.Old
+		}
+		row := []string{f.Path, f.Category, f.Severity.String(), e.Kind.String(), e.Type().String(),
+			strconv.FormatInt(fm.Size, 10), csvTime(fm.ModTime), fm.Hash, e.Source}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,486 @@
+package fsdiff
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Query format for 'rpm -qa --qf' whose output ReadRpm parses, one line per file:
+// package, path, digest algorithm and digest separated by tabs. NAME and
+// FILEDIGESTALGO have one value per package, so they're repeated with '=' as rpm
+// refuses to iterate arrays of different sizes together.
+const RPM_QUERY_FORMAT = `[%{=NAME}\t%{FILENAMES}\t%{=FILEDIGESTALGO}\t%{FILEDIGESTS}\n]`
+
+// Locations of the apk database, newer versions keep it under /usr
+var apkDbPaths = []string{"lib/apk/db/installed", "usr/lib/apk/db/installed"}
+
+// A file installed by a package
+type PackageFile struct {
+	// Name of the package that owns the file
+	Package string
+	// Algorithm of Digest
+	Algo HashAlgo
+	// Expected hex digest of the contents, empty for directories, symlinks and
+	// files the database has no digest for
+	Digest string
+}
+
+// The files owned by the packages installed in a root filesystem
+type PackageDB struct {
+	// Owned files by path, relative to the root
+	Files map[string]*PackageFile
+	// Package managers whose databases were read, e.g. "dpkg"
+	Sources []string
+}
+
+func NewPackageDB() *PackageDB {
+	return &PackageDB{Files: make(map[string]*PackageFile)}
+}
+
+// Reads the dpkg and apk databases found in fsys. The rpm database can't be read
+// directly, see ReadRpm. Returns an empty database if fsys has neither.
+func ReadPackageDB(fsys fs.FS) (db *PackageDB, err error) {
+	db = NewPackageDB()
+	if err = db.ReadDpkg(fsys); err != nil {
+		return nil, fmt.Errorf("dpkg: %w", err)
+	}
+	for _, fpath := range apkDbPaths {
+		var file fs.File
+		if file, err = fsys.Open(fpath); errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("apk: %w", err)
+		}
+		err = db.ReadApk(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("apk: %w", err)
+		}
+		break
+	}
+	return db, nil
+}
+
+// Adds a file owned by 'pkg'. If the file is listed more than once, the first
+// entry with a digest is kept.
+func (db *PackageDB) add(fpath, pkg string, algo HashAlgo, digest string) {
+	fpath = cleanPath(fpath)
+	if pf := db.Files[fpath]; pf != nil && (pf.Digest != "" || digest == "") {
+		return
+	}
+	db.Files[fpath] = &PackageFile{Package: pkg, Algo: algo, Digest: strings.ToLower(digest)}
+}
+
+func (db *PackageDB) addSource(name string) {
+	if !slices.Contains(db.Sources, name) {
+		db.Sources = append(db.Sources, name)
+	}
+}
+
+// Returns the digest algorithms needed to verify the files.
+func (db *PackageDB) Algos() []HashAlgo {
+	algos := make([]HashAlgo, 0)
+	for _, pf := range db.Files {
+		if pf.Digest != "" && !slices.Contains(algos, pf.Algo) {
+			algos = append(algos, pf.Algo)
+		}
+	}
+	return algos
+}
+
+// Reads the dpkg database: the file lists and MD5 sums under /var/lib/dpkg/info and
+// the MD5 sums of configuration files from /var/lib/dpkg/status. Diverted files are
+// listed where they were moved to, see readDpkgDiversions.
+func (db *PackageDB) ReadDpkg(fsys fs.FS) error {
+	const infoDir = "var/lib/dpkg/info"
+	lists, err := fs.Glob(fsys, infoDir+"/*.list")
+	if err != nil {
+		return err
+	}
+	if len(lists) == 0 {
+		return nil
+	}
+	db.addSource("dpkg")
+	diversions, err := readDpkgDiversions(fsys)
+	if err != nil {
+		return err
+	}
+	for _, fpath := range lists {
+		pkg := strings.TrimSuffix(path.Base(fpath), ".list")
+		err := readLines(fsys, fpath, func(ln string) error {
+			if ln != "" && ln != "/." {
+				db.add(diversions.path(ln, pkg), pkg, MD5, "")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fpath = path.Join(infoDir, pkg+".md5sums")
+		err = readLines(fsys, fpath, func(ln string) error {
+			digest, rest, ok := strings.Cut(ln, " ")
+			if !ok {
+				return fmt.Errorf("%s: invalid line '%s'", fpath, ln)
+			}
+			db.add(diversions.path(strings.TrimLeft(rest, " *"), pkg), pkg, MD5, digest)
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return db.readDpkgStatus(fsys, diversions)
+}
+
+// A file moved aside by 'dpkg-divert', so a package can install its own version
+type dpkgDiversion struct {
+	// Where the diverted file is installed instead
+	To string
+	// Package which diverted it, which still installs the original path. Empty for
+	// local diversions, which apply to every package.
+	Package string
+}
+
+// Diversions by original path
+type dpkgDiversions map[string]dpkgDiversion
+
+// Reads /var/lib/dpkg/diversions, which lists each diversion as three lines: the
+// original path, the path it's diverted to, and the diverting package or ":" for
+// a local diversion.
+func readDpkgDiversions(fsys fs.FS) (dpkgDiversions, error) {
+	diversions := make(dpkgDiversions)
+	lines := make([]string, 0, 3)
+	err := readLines(fsys, "var/lib/dpkg/diversions", func(ln string) error {
+		if lines = append(lines, ln); len(lines) < 3 {
+			return nil
+		}
+		div := dpkgDiversion{To: cleanPath(lines[1]), Package: lines[2]}
+		if div.Package == ":" {
+			div.Package = ""
+		}
+		diversions[cleanPath(lines[0])] = div
+		lines = lines[:0]
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return diversions, nil
+	}
+	return diversions, err
+}
+
+// Returns where the file at 'fpath' installed by 'pkg' actually is.
+func (d dpkgDiversions) path(fpath, pkg string) string {
+	div, ok := d[cleanPath(fpath)]
+	// Packages are named with their architecture in the info directory, e.g.
+	// "libc6:amd64", but not in the diversions
+	if name, _, _ := strings.Cut(pkg, ":"); !ok || (div.Package != "" && div.Package == name) {
+		return fpath
+	}
+	return div.To
+}
+
+// Reads the configuration files of each package from the dpkg status file, which
+// lists them in a Conffiles field as " <path> <md5> [obsolete]".
+func (db *PackageDB) readDpkgStatus(fsys fs.FS, diversions dpkgDiversions) error {
+	pkg, inConffiles := "", false
+	err := readLines(fsys, "var/lib/dpkg/status", func(ln string) error {
+		if strings.HasPrefix(ln, " ") {
+			fields := strings.Fields(ln)
+			if inConffiles && len(fields) >= 2 && len(fields[1]) == 32 {
+				db.add(diversions.path(fields[0], pkg), pkg, MD5, fields[1])
+			}
+			return nil
+		}
+		inConffiles = strings.HasPrefix(ln, "Conffiles:")
+		if strings.HasPrefix(ln, "Package:") {
+			pkg = strings.TrimSpace(strings.TrimPrefix(ln, "Package:"))
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Reads an apk installed database. Each package lists its directories (F:) followed
+// by the files in them (R:), each with the base64 SHA-1 of its contents prefixed by
+// "Q1" (Z:).
+func (db *PackageDB) ReadApk(r io.Reader) error {
+	db.addSource("apk")
+	var pkg, dir, file string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			// Blank line between packages
+			pkg, dir, file = "", "", ""
+			continue
+		}
+		switch key {
+		case "P":
+			pkg = value
+		case "F":
+			dir, file = value, ""
+			db.add(dir, pkg, SHA1, "")
+		case "R":
+			file = path.Join(dir, value)
+			db.add(file, pkg, SHA1, "")
+		case "Z":
+			if file == "" {
+				continue
+			}
+			digest, err := apkDigest(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+			db.add(file, pkg, SHA1, digest)
+		}
+	}
+	return scanner.Err()
+}
+
+// Converts an apk "Q1<base64>" checksum to a hex SHA-1 digest. Other checksum types
+// are ignored.
+func apkDigest(value string) (string, error) {
+	if !strings.HasPrefix(value, "Q1") {
+		return "", nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(value[2:])
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// Reads the output of 'rpm -qa --qf RPM_QUERY_FORMAT'.
+func (db *PackageDB) ReadRpm(r io.Reader) error {
+	db.addSource("rpm")
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 4 {
+			return fmt.Errorf("line %d: expected 4 fields, got %d", lineNo, len(fields))
+		}
+		if algo, ok := rpmDigestAlgo(fields[2]); ok {
+			db.add(fields[1], fields[0], algo, fields[3])
+		} else {
+			db.add(fields[1], fields[0], MD5, "")
+		}
+	}
+	return scanner.Err()
+}
+
+// Returns the algorithm for an rpm FILEDIGESTALGO value, which uses the OpenPGP
+// hash algorithm numbers. Packages without the tag use MD5.
+func rpmDigestAlgo(value string) (HashAlgo, bool) {
+	switch value {
+	case "1", "(none)", "":
+		return MD5, true
+	case "2":
+		return SHA1, true
+	case "8":
+		return SHA256, true
+	default:
+		return "", false
+	}
+}
+
+// Calls fn for each line of the file at 'fpath'.
+func readLines(fsys fs.FS, fpath string, fn func(ln string) error) error {
+	file, err := fsys.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if err := fn(scanner.Text()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Verifies fsys against the package database, reading its metadata with b. Owned
+// files whose contents don't match their package's digest are reported as Modified,
+// entries other than directories that no package owns as Added, and owned files with
+// a digest that don't exist as Removed. The old metadata of modified and removed files
+// only has the expected digest. Paths in the database are resolved through symlinked
+// directories, so files listed under e.g. /bin match those in /usr/bin.
+//
+// Entries are reported as each directory is read, and b.Root isn't filled in, so
+// memory use doesn't grow with the size of the filesystem.
+func VerifyPackages(db *PackageDB, fsys fs.FS, b *DirMetaBuilder, fn DiffFunc) error {
+	for _, algo := range db.Algos() {
+		if algo != PRIMARY_HASH && !slices.Contains(b.Digests, algo) {
+			b.Digests = append(b.Digests, algo)
+		}
+	}
+	owned := db.resolve(fsys)
+	if err := b.verifyDir(fsys, ".", owned, fn); err != nil {
+		return err
+	}
+
+	// Whatever is left doesn't exist, unless it was excluded or couldn't be read
+	missing := maps.Keys(owned)
+	slices.Sort(missing)
+	for _, fpath := range missing {
+		pf := owned[fpath]
+		if pf.Digest == "" || b.unseenPath(fpath) {
+			continue
+		}
+		fm := pf.meta(path.Base(fpath), 0)
+		if b.IsExcluded(fpath, fm) {
+			continue
+		}
+		if err := fn(&DiffEntry{Path: fpath, Kind: Removed, Old: fm}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks the entries of 'dir' against the owned files, then its subdirectories.
+// Every entry found is removed from 'owned'. Only files that are checked or
+// reported are read.
+func (b *DirMetaBuilder) verifyDir(fsys fs.FS, dir string, owned map[string]*PackageFile, fn DiffFunc) error {
+	dirEntries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		b.addError(dir, err)
+		return nil
+	}
+	metas := make([]*FileMeta, len(dirEntries))
+	jobs := newJobGroup(b.workers())
+	for i, d := range dirEntries {
+		fpath := path.Join(dir, d.Name())
+		fm, err := EntryMeta(d)
+		if err != nil {
+			b.addError(fpath, err)
+			continue
+		}
+		if b.IsExcluded(fpath, fm) {
+			continue
+		}
+		metas[i] = fm
+		pf := owned[fpath]
+		// Owned entries are only compared by the digest
+		if fm.Mode.IsDir() || (pf != nil && (!fm.Mode.IsRegular() || pf.Digest == "")) {
+			continue
+		}
+		if fm.Mode.IsRegular() {
+			b.addHardLink(fpath, fm)
+		}
+		i := i
+		jobs.Go(func() {
+			if err := b.ReadFsMeta(fsys, fpath, fm); err != nil {
+				b.addError(fpath, err)
+				metas[i] = nil
+			}
+		})
+	}
+	jobs.Wait()
+
+	for i, fm := range metas {
+		if fm == nil || fm.Mode.IsDir() {
+			continue
+		}
+		fpath := path.Join(dir, dirEntries[i].Name())
+		pf := owned[fpath]
+		delete(owned, fpath)
+		var err error
+		if pf == nil {
+			err = fn(&DiffEntry{Path: fpath, Kind: Added, New: fm})
+		} else if fm.Mode.IsRegular() && pf.Digest != "" {
+			if digest := fm.Digest(pf.Algo); digest != "" && digest != pf.Digest {
+				err = fn(&DiffEntry{Path: fpath, Kind: Modified, Old: pf.meta(fm.Name, fm.Mode), New: fm})
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for i, fm := range metas {
+		if fm == nil || !fm.Mode.IsDir() {
+			continue
+		}
+		fpath := path.Join(dir, dirEntries[i].Name())
+		delete(owned, fpath)
+		if err := b.verifyDir(fsys, fpath, owned, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the expected metadata of the file, which only has the digest.
+func (pf *PackageFile) meta(name string, mode fs.FileMode) *FileMeta {
+	fm := &FileMeta{Name: name, Mode: mode}
+	if pf.Algo == PRIMARY_HASH {
+		fm.Hash = pf.Digest
+	} else {
+		fm.Hashes = map[HashAlgo]string{pf.Algo: pf.Digest}
+	}
+	return fm
+}
+
+// Returns true if 'fpath' or one of its parents was excluded or couldn't be read.
+func (b *DirMetaBuilder) unseenPath(fpath string) bool {
+	for p := fpath; p != "."; p = path.Dir(p) {
+		if b.PathErrors[b.fullPath(p)] != nil {
+			return true
+		}
+		if p != fpath && b.IsExcluded(p, &FileMeta{Name: path.Base(p), Mode: fs.ModeDir}) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the owned files by their path in fsys, with symlinked parent directories
+// resolved.
+func (db *PackageDB) resolve(fsys fs.FS) map[string]*PackageFile {
+	dirs := make(map[string]string)
+	owned := make(map[string]*PackageFile, len(db.Files))
+	for fpath, pf := range db.Files {
+		fpath = path.Join(resolveDir(fsys, dirs, path.Dir(fpath), 0), path.Base(fpath))
+		if prev := owned[fpath]; prev == nil || prev.Digest == "" {
+			owned[fpath] = pf
+		}
+	}
+	return owned
+}
+
+// Returns 'dir' with every symlink in fsys replaced by its target, caching the result
+// for each directory in 'dirs'. Components that don't exist or aren't symlinks are
+// kept as they are. Nothing is resolved if fsys doesn't implement ReadLinkFS.
+func resolveDir(fsys fs.FS, dirs map[string]string, dir string, links int) string {
+	const maxLinks = 40
+	dir = cleanPath(dir)
+	if dir == "." {
+		return dir
+	}
+	if real, ok := dirs[dir]; ok {
+		return real
+	}
+	parent := resolveDir(fsys, dirs, path.Dir(dir), links)
+	real := path.Join(parent, path.Base(dir))
+	if target, err := readLink(fsys, real); err == nil && links < maxLinks {
+		if !path.IsAbs(target) {
+			target = path.Join(parent, target)
+		}
+		real = resolveDir(fsys, dirs, target, links+1)
+	}
+	dirs[dir] = real
+	return real
+}
@@ -0,0 +1,233 @@
+package fsdiff
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+// Extended attribute holding a file's capabilities
+const CAPABILITY_XATTR = "security.capability"
+
+// A kind of privilege escalation surface
+type PrivKind int
+
+const (
+	// Regular file with the setuid bit
+	PrivSetuid PrivKind = iota
+	// Regular file with the setgid bit
+	PrivSetgid
+	// File with capabilities
+	PrivCapability
+	// File or directory anyone can write to
+	PrivWorldWritable
+	// Directory whose sticky bit was set or cleared
+	PrivSticky
+)
+
+func (k PrivKind) String() string {
+	switch k {
+	case PrivSetuid:
+		return "setuid"
+	case PrivSetgid:
+		return "setgid"
+	case PrivCapability:
+		return "capability"
+	case PrivWorldWritable:
+		return "world-writable"
+	case PrivSticky:
+		return "sticky"
+	default:
+		return "unknown"
+	}
+}
+
+// How a privilege escalation surface relates to the base
+type PrivStatus int
+
+const (
+	// The base doesn't have it at this path
+	PrivNew PrivStatus = iota
+	// The base has it too, but the file changed
+	PrivChanged
+	// The base has it and the new tree doesn't, only used for the sticky bit
+	PrivRemoved
+)
+
+func (s PrivStatus) String() string {
+	switch s {
+	case PrivNew:
+		return "new"
+	case PrivChanged:
+		return "changed"
+	case PrivRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// A security-relevant attribute of a changed entry
+type PrivItem struct {
+	Path   string
+	Kind   PrivKind
+	Status PrivStatus
+	// The change the item was found in
+	Entry *DiffEntry
+}
+
+// Returns the setuid and setgid files, files with capabilities, world-writable
+// entries and sticky bit changes among the changes in 'd'. Since the diff only holds
+// changes, everything else is the same as in the base. Removed entries are ignored.
+func FindPrivEsc(d *FsDiff) []PrivItem {
+	items := make([]PrivItem, 0)
+	for _, e := range d.Entries {
+		fm := e.New
+		if fm == nil {
+			continue
+		}
+		old := e.Old
+		if e.Kind == Moved || e.Kind == Copied {
+			// Old is the source, whose attributes were never at this path
+			old = nil
+		}
+		add := func(kind PrivKind, has func(*FileMeta) bool) {
+			switch {
+			case !has(fm):
+				if kind == PrivSticky && old != nil && has(old) {
+					items = append(items, PrivItem{Path: e.Path, Kind: kind, Status: PrivRemoved, Entry: e})
+				}
+			case old == nil || !has(old):
+				items = append(items, PrivItem{Path: e.Path, Kind: kind, Status: PrivNew, Entry: e})
+			case kind != PrivSticky:
+				items = append(items, PrivItem{Path: e.Path, Kind: kind, Status: PrivChanged, Entry: e})
+			}
+		}
+		add(PrivSetuid, func(fm *FileMeta) bool {
+			return fm.Mode.IsRegular() && fm.Mode&fs.ModeSetuid != 0
+		})
+		add(PrivSetgid, func(fm *FileMeta) bool {
+			return fm.Mode.IsRegular() && fm.Mode&fs.ModeSetgid != 0
+		})
+		add(PrivCapability, func(fm *FileMeta) bool {
+			_, ok := fm.Xattrs[CAPABILITY_XATTR]
+			return ok
+		})
+		add(PrivWorldWritable, func(fm *FileMeta) bool {
+			return !fm.IsSymlink() && fm.Mode.Perm()&0002 != 0
+		})
+		if fm.Mode.IsDir() {
+			add(PrivSticky, func(fm *FileMeta) bool {
+				return fm.Mode.IsDir() && fm.Mode&fs.ModeSticky != 0
+			})
+		}
+	}
+	return items
+}
+
+// Writes the items found by FindPrivEsc in 'd' as a CSV, with the mode, owner and
+// capabilities before and after the change.
+func WritePrivEsc(w io.Writer, d *FsDiff) error {
+	cw := csv.NewWriter(w)
+	header := []string{"path", "finding", "status", "change", "type", "mode", "uid", "gid", "capabilities",
+		"old_mode", "old_uid", "old_gid", "old_capabilities"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, item := range FindPrivEsc(d) {
+		e := item.Entry
+		row := []string{item.Path, item.Kind.String(), item.Status.String(), e.Kind.String(), e.Type().String()}
+		row = append(row, privColumns(e.New)...)
+		row = append(row, privColumns(e.Old)...)
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func privColumns(fm *FileMeta) []string {
+	if fm == nil {
+		return make([]string, 4)
+	}
+	caps := ""
+	if raw, ok := fm.Xattrs[CAPABILITY_XATTR]; ok {
+		caps = FormatCapabilities([]byte(raw))
+	}
+	return []string{fmt.Sprintf("%04o", unixMode(fm.Mode)), strconv.Itoa(fm.Uid), strconv.Itoa(fm.Gid), caps}
+}
+
+// Capability names by number, see capabilities(7)
+var capNames = []string{
+	"cap_chown", "cap_dac_override", "cap_dac_read_search", "cap_fowner", "cap_fsetid",
+	"cap_kill", "cap_setgid", "cap_setuid", "cap_setpcap", "cap_linux_immutable",
+	"cap_net_bind_service", "cap_net_broadcast", "cap_net_admin", "cap_net_raw",
+	"cap_ipc_lock", "cap_ipc_owner", "cap_sys_module", "cap_sys_rawio", "cap_sys_chroot",
+	"cap_sys_ptrace", "cap_sys_pacct", "cap_sys_admin", "cap_sys_boot", "cap_sys_nice",
+	"cap_sys_resource", "cap_sys_time", "cap_sys_tty_config", "cap_mknod", "cap_lease",
+	"cap_audit_write", "cap_audit_control", "cap_setfcap", "cap_mac_override",
+	"cap_mac_admin", "cap_syslog", "cap_wake_alarm", "cap_block_suspend", "cap_audit_read",
+	"cap_perfmon", "cap_bpf", "cap_checkpoint_restore",
+}
+
+// Formats a security.capability value like getcap does, e.g. "cap_net_raw=ep".
+// Values that can't be decoded are returned in hex.
+func FormatCapabilities(raw []byte) string {
+	const effective = 0x000001
+	if len(raw) < 4 {
+		return fmt.Sprintf("%x", raw)
+	}
+	magic := binary.LittleEndian.Uint32(raw)
+	words := 0
+	switch magic &^ effective {
+	case 0x01000000:
+		words = 1
+	case 0x02000000, 0x03000000:
+		words = 2
+	}
+	if words == 0 || len(raw) < 4+8*words {
+		return fmt.Sprintf("%x", raw)
+	}
+	var permitted, inheritable uint64
+	for i := 0; i < words; i++ {
+		permitted |= uint64(binary.LittleEndian.Uint32(raw[4+8*i:])) << (32 * i)
+		inheritable |= uint64(binary.LittleEndian.Uint32(raw[8+8*i:])) << (32 * i)
+	}
+	// Group the capabilities with the same flags
+	groups := make(map[string][]string)
+	order := make([]string, 0)
+	for bit := 0; bit < 64; bit++ {
+		p, i := permitted&(1<<bit) != 0, inheritable&(1<<bit) != 0
+		if !p && !i {
+			continue
+		}
+		flags := ""
+		if p && magic&effective != 0 {
+			flags += "e"
+		}
+		if i {
+			flags += "i"
+		}
+		if p {
+			flags += "p"
+		}
+		name := "cap_" + strconv.Itoa(bit)
+		if bit < len(capNames) {
+			name = capNames[bit]
+		}
+		if groups[flags] == nil {
+			order = append(order, flags)
+		}
+		groups[flags] = append(groups[flags], name)
+	}
+	out := make([]string, 0, len(order))
+	for _, flags := range order {
+		out = append(out, strings.Join(groups[flags], ",")+"="+flags)
+	}
+	return strings.Join(out, " ")
+}
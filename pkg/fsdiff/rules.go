@@ -0,0 +1,332 @@
+package fsdiff
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A single exclude rule. Rules are written one per line as a pattern followed by
+// optional conditions, separated by whitespace:
+//
+//	# comments and blank lines are ignored
+//	/proc/**            anchored to the root because it contains a '/'
+//	**/__pycache__      '**' matches any number of directories
+//	*.log size>1G       no '/', so it matches the name at any depth
+//	!/var/log/keep.log  '!' includes paths a previous rule excluded
+//	/tmp/** type=f,l    only files and symbolic links under /tmp
+//	cache/              a trailing '/' only matches directories
+//
+// '*' and '?' never match '/', '[...]' matches a character class. Conditions are
+// 'size' compared with <, <=, >, >= or = to a number of bytes with an optional
+// K, M, G or T suffix (only regular files match), and 'type' followed by a
+// comma-separated list of f (file), d (directory), l (symlink), p (pipe),
+// s (socket), c (char device) or b (block device).
+type Rule struct {
+	// Original text of the rule
+	Text string
+	// Paths matching this rule are included rather than excluded
+	Negate bool
+	// Compiled pattern, matched against the path relative to the root
+	re *regexp.Regexp
+	// Size condition, sizeOp is empty if there is none
+	sizeOp string
+	size   int64
+	// Allowed types, empty if there is no type condition
+	types string
+}
+
+// An ordered list of exclude rules. The last rule that matches a path decides
+// whether it's excluded, like .gitignore. Paths inside an excluded directory are
+// never seen, so they can't be included again.
+type RuleSet struct {
+	Rules []*Rule
+}
+
+// Parses rules from 'r', one per line.
+func ParseRules(r io.Reader) (*RuleSet, error) {
+	rs := &RuleSet{}
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if err := rs.Add(scanner.Text()); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Parses each string in 'lines' as a rule.
+func ParseRuleLines(lines []string) (*RuleSet, error) {
+	return ParseRules(strings.NewReader(strings.Join(lines, "\n")))
+}
+
+// Reads rules from the file at 'fpath'.
+func LoadRules(fpath string) (*RuleSet, error) {
+	file, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rs, err := ParseRules(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fpath, err)
+	}
+	return rs, nil
+}
+
+// Parses 'line' and appends it to the rule set. Blank lines and comments are ignored.
+func (rs *RuleSet) Add(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return nil
+	}
+	rule, err := parseRule(fields)
+	if err != nil {
+		return err
+	}
+	rule.Text = strings.TrimSpace(line)
+	rs.Rules = append(rs.Rules, rule)
+	return nil
+}
+
+// Returns true if the entry at 'fpath' is excluded. A nil RuleSet excludes nothing.
+func (rs *RuleSet) Excluded(fpath string, fm *FileMeta) bool {
+	if rs == nil {
+		return false
+	}
+	fpath = cleanPath(fpath)
+	for i := len(rs.Rules) - 1; i >= 0; i-- {
+		if rs.Rules[i].Matches(fpath, fm) {
+			return !rs.Rules[i].Negate
+		}
+	}
+	return false
+}
+
+// Returns true if the entry at 'fpath' is excluded whatever its metadata is. Entries
+// that a rule with conditions may exclude or include are not, as it depends on the
+// metadata. A nil RuleSet excludes nothing.
+func (rs *RuleSet) PathExcluded(fpath string) bool {
+	if rs == nil {
+		return false
+	}
+	fpath = cleanPath(fpath)
+	for i := len(rs.Rules) - 1; i >= 0; i-- {
+		rule := rs.Rules[i]
+		if !rule.re.MatchString(fpath) {
+			continue
+		}
+		if rule.types == "" && rule.sizeOp == "" {
+			return !rule.Negate
+		}
+		if rule.Negate {
+			return false
+		}
+		// An exclusion that may not apply, then an earlier rule decides
+	}
+	return false
+}
+
+// Returns the text of each rule, which parses back to the same rule set.
+func (rs *RuleSet) Lines() []string {
+	if rs == nil {
+		return nil
+	}
+	lines := make([]string, len(rs.Rules))
+	for i, rule := range rs.Rules {
+		lines[i] = rule.Text
+	}
+	return lines
+}
+
+// Returns a copy of 'dm' without the entries the rules exclude by path alone (see
+// PathExcluded), with its tree hashes updated. Entries that rules with conditions may
+// exclude are kept, the comparison ignores them if either side is excluded, so an
+// entry that only matches in the base doesn't show up as added. File metadata is
+// shared with 'dm'. A nil or empty RuleSet returns 'dm' itself.
+func (rs *RuleSet) Filter(dm *DirMeta) *DirMeta {
+	if rs == nil || len(rs.Rules) == 0 {
+		return dm
+	}
+	out := rs.filterDir("", dm)
+	out.UpdateTreeHash()
+	return out
+}
+
+func (rs *RuleSet) filterDir(root string, dm *DirMeta) *DirMeta {
+	out := &DirMeta{FileMeta: dm.FileMeta, Implicit: dm.Implicit}
+	out.InitMaps()
+	for name, fm := range dm.Files {
+		if !rs.PathExcluded(root + name) {
+			out.Files[name] = fm
+		}
+	}
+	for name, sub := range dm.Dirs {
+		if !rs.PathExcluded(root + name) {
+			out.Dirs[name] = rs.filterDir(root+name+"/", sub)
+		}
+	}
+	return out
+}
+
+// Returns true if the rule's pattern and conditions match the entry at 'fpath'.
+func (r *Rule) Matches(fpath string, fm *FileMeta) bool {
+	if r.types != "" && !strings.ContainsRune(r.types, rune(typeLetters[fm.Type()])) {
+		return false
+	}
+	if r.sizeOp != "" {
+		if !fm.Mode.IsRegular() || !compareSize(fm.Size, r.sizeOp, r.size) {
+			return false
+		}
+	}
+	return r.re.MatchString(cleanPath(fpath))
+}
+
+func parseRule(fields []string) (*Rule, error) {
+	rule := &Rule{}
+	pattern := fields[0]
+	if strings.HasPrefix(pattern, "!") {
+		rule.Negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") && pattern != "/" {
+		rule.types = "d"
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	if pattern == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	re, err := globRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	rule.re = re
+	for _, cond := range fields[1:] {
+		if err := rule.parseCondition(cond); err != nil {
+			return nil, err
+		}
+	}
+	return rule, nil
+}
+
+func (r *Rule) parseCondition(cond string) error {
+	switch {
+	case strings.HasPrefix(cond, "type="):
+		types := strings.ReplaceAll(strings.TrimPrefix(cond, "type="), ",", "")
+		if types == "" || strings.Trim(types, typeLetters) != "" {
+			return fmt.Errorf("invalid type condition '%s'", cond)
+		}
+		r.types = types
+	case strings.HasPrefix(cond, "size"):
+		rest := strings.TrimPrefix(cond, "size")
+		op := ""
+		for _, o := range []string{"<=", ">=", "<", ">", "="} {
+			if strings.HasPrefix(rest, o) {
+				op = o
+				break
+			}
+		}
+		if op == "" {
+			return fmt.Errorf("invalid size condition '%s'", cond)
+		}
+		size, err := ParseSize(strings.TrimPrefix(rest, op))
+		if err != nil {
+			return fmt.Errorf("invalid size condition '%s': %w", cond, err)
+		}
+		r.sizeOp, r.size = op, size
+	default:
+		return fmt.Errorf("unknown condition '%s'", cond)
+	}
+	return nil
+}
+
+// Parses a number of bytes with an optional K, M, G or T (binary) suffix.
+func ParseSize(s string) (int64, error) {
+	mult := int64(1)
+	if s != "" {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			mult = 1 << 10
+		case "M":
+			mult = 1 << 20
+		case "G":
+			mult = 1 << 30
+		case "T":
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * mult, nil
+}
+
+func compareSize(size int64, op string, limit int64) bool {
+	switch op {
+	case "<":
+		return size < limit
+	case "<=":
+		return size <= limit
+	case ">":
+		return size > limit
+	case ">=":
+		return size >= limit
+	default:
+		return size == limit
+	}
+}
+
+// Letters used by 'type=' conditions, indexed by FileType
+const typeLetters = "fdlpscb"
+
+// Converts a glob pattern to a regular expression matching whole relative paths.
+// Patterns without a '/' match the name at any depth.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	sb := strings.Builder{}
+	sb.WriteString("^")
+	if !strings.Contains(pattern, "/") {
+		sb.WriteString("(?:.*/)?")
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated '[' in '%s'", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
@@ -0,0 +1,195 @@
+package fsdiff
+
+import (
+	"context"
+	"io/fs"
+	"path"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// Number of entries StreamCompareFs buffers before waiting for the consumer
+const STREAM_BUFFER = 64
+
+// Compares the base tree against the filesystem fsys, calling fn with each change as
+// soon as it's found. Unlike building a DirMeta for fsys and calling FsDiff.Compare,
+// only the directory currently being compared is held in memory for fsys.
+//
+// Metadata for fsys is collected with b (see DirMetaBuilder.ReadFsMeta), paths that
+// it excludes are ignored in both trees, and paths that can't be read are recorded in
+// b.PathErrors. Directories that can't be listed are skipped entirely, as are files
+// which exist in both trees but can't be read. In fast mode (b.Fast) files which look
+// unchanged aren't hashed, they are counted in b.UnhashedCount and listed in
+// b.UnhashedList instead.
+//
+// The base tree may be partial (see DirMeta.Truncate). The live subtree of a Partial
+// directory is read in full and hashed (in fast mode only its StatHash is computed),
+// and if it doesn't match the base the path is added to b.Pending. Those subtrees
+// must then be compared with CompareFsAt once the full base subtree is available,
+// which reuses what was read instead of reading it again.
+func CompareFs(base *DirMeta, fsys fs.FS, b *DirMetaBuilder, fn DiffFunc) error {
+	return CompareFsAt(base, fsys, ".", b, fn)
+}
+
+// Runs CompareFs in a new goroutine and sends each change to the returned channel, so
+// the consumer can start working before the walk is finished. The entry channel is
+// closed when the walk ends, after which the result is sent to the error channel.
+// Cancelling ctx stops the walk.
+func StreamCompareFs(ctx context.Context, base *DirMeta, fsys fs.FS, b *DirMetaBuilder) (<-chan *DiffEntry, <-chan error) {
+	entryC := make(chan *DiffEntry, STREAM_BUFFER)
+	errC := make(chan error, 1)
+	go func() {
+		err := CompareFs(base, fsys, b, func(e *DiffEntry) error {
+			select {
+			case entryC <- e:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		close(entryC)
+		errC <- err
+		close(errC)
+	}()
+	return entryC, errC
+}
+
+// A directory in a live filesystem, which is only read when it's compared.
+type fsDir struct {
+	fsys fs.FS
+	// Builder used to collect metadata
+	b *DirMetaBuilder
+	// Path of the directory in fsys
+	fpath string
+	// Matching directory in the base tree, may be nil
+	base treeDir
+	// The directory as it was read while probing a partial base directory, see
+	// DirMetaBuilder.sameSubtree. Its entries are used instead of reading the
+	// directory again. Nil if it wasn't probed.
+	live *DirMeta
+	// Only read the metadata of regular files, the caller hashes them
+	noHash bool
+}
+
+// Returns the metadata of the entries in the directory, without reading their
+// contents.
+func (d *fsDir) readEntries() ([]*FileMeta, error) {
+	if d.live != nil {
+		metas := make([]*FileMeta, 0, len(d.live.Files)+len(d.live.Dirs))
+		metas = append(metas, maps.Values(d.live.Files)...)
+		for _, dm := range d.live.Dirs {
+			metas = append(metas, &dm.FileMeta)
+		}
+		slices.SortFunc(metas, func(a, b *FileMeta) bool {
+			return a.Name < b.Name
+		})
+		return metas, nil
+	}
+	release := d.b.acquireIO()
+	dirEntries, err := fs.ReadDir(d.fsys, d.fpath)
+	release()
+	if err != nil {
+		d.b.addError(d.fpath, err)
+		return nil, errUnreadable
+	}
+	metas := make([]*FileMeta, 0, len(dirEntries))
+	for _, de := range dirEntries {
+		fm, err := EntryMeta(de)
+		if err != nil {
+			d.b.addError(path.Join(d.fpath, de.Name()), err)
+			continue
+		}
+		metas = append(metas, fm)
+	}
+	return metas, nil
+}
+
+// Implement treeDir.list
+// The metadata of the entries is read in parallel, up to b.Workers at once.
+func (d *fsDir) list() ([]treeEntry, error) {
+	metas, err := d.readEntries()
+	if err != nil {
+		return nil, err
+	}
+	// The base entries are only needed by name, to match subdirectories and files
+	baseEntries := make(map[string]treeEntry)
+	if d.base != nil {
+		list, _ := d.base.list()
+		for _, te := range list {
+			baseEntries[te.meta.Name] = te
+		}
+	}
+	jobs := newJobGroup(d.b.workers())
+	entries := make([]treeEntry, 0, len(metas))
+	for _, fm := range metas {
+		fpath := path.Join(d.fpath, fm.Name)
+		// Excluded entries are kept so the matching base entry is ignored as well,
+		// instead of being reported as removed
+		te := treeEntry{meta: fm, excluded: d.b.IsExcluded(fpath, fm)}
+		if !te.excluded && fm.Mode.IsDir() {
+			child := &fsDir{fsys: d.fsys, b: d.b, fpath: fpath, base: baseEntries[fm.Name].dir}
+			if d.live != nil {
+				child.live = d.live.Dirs[fm.Name]
+			}
+			te.dir = child
+		} else if !te.excluded && fm.Mode.IsRegular() {
+			d.b.addHardLink(fpath, fm)
+		}
+		entries = append(entries, te)
+	}
+	// Entries are only modified by their own job, so no locking is needed
+	for i := range entries {
+		te := &entries[i]
+		if te.excluded {
+			continue
+		}
+		fpath := path.Join(d.fpath, te.meta.Name)
+		var baseFile *FileMeta
+		if bt, ok := baseEntries[te.meta.Name]; ok && bt.dir == nil {
+			baseFile = bt.meta
+		}
+		jobs.Go(func() {
+			skipHash := d.b.Fast && baseFile != nil && baseFile.SameStat(te.meta)
+			// Extra digests are only wanted for added and modified files. They're
+			// computed in the same read unless the file may match the base, then
+			// only once it turned out not to. Anything else than a regular file is
+			// never read, even if it replaced an empty one.
+			mayMatch := baseFile != nil && baseFile.Mode.IsRegular() && te.meta.Mode.IsRegular() &&
+				baseFile.Size == te.meta.Size
+			level := hashDigests
+			if skipHash || d.noHash {
+				level = hashNone
+			} else if mayMatch && len(d.b.Digests) > 0 {
+				level = hashPrimary
+			}
+			var err error
+			switch {
+			case d.live == nil:
+				err = d.b.readFsMeta(d.fsys, fpath, te.meta, level)
+			case level == hashNone || !te.meta.Mode.IsRegular():
+				// The probe read everything else
+			case te.meta.Hash == "":
+				err = d.b.rehash(d.fsys, fpath, te.meta, level == hashDigests)
+			case level == hashDigests && len(d.b.Digests) > 0:
+				// The probe only computed PRIMARY_HASH
+				err = d.b.rehash(d.fsys, fpath, te.meta, true)
+			}
+			if err == nil && level == hashPrimary && te.meta.Mode.IsRegular() && te.meta.Hash != baseFile.Hash {
+				err = d.b.rehash(d.fsys, fpath, te.meta, true)
+			}
+			if err != nil {
+				d.b.addError(fpath, err)
+				te.unreadable = true
+			} else if skipHash {
+				te.meta.Hash = baseFile.Hash
+				te.meta.Hashes = baseFile.Hashes
+				d.b.addUnhashed(fpath)
+			} else {
+				d.b.addMatchedLink(fpath, te.meta, baseFile)
+			}
+		})
+	}
+	jobs.Wait()
+	return entries, nil
+}
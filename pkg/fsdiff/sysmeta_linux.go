@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package fsdiff
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// Fills in ownership and timestamps from the platform-specific stat data, if present.
+func fillSysMeta(fm *FileMeta, sys any) {
+	st, ok := sys.(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	fm.Uid = int(st.Uid)
+	fm.Gid = int(st.Gid)
+	fm.ChangeTime = time.Unix(st.Ctim.Unix())
+	fm.AccessTime = time.Unix(st.Atim.Unix())
+	fm.inode = Inode{Dev: uint64(st.Dev), Ino: uint64(st.Ino)}
+	fm.nlink = uint64(st.Nlink)
+	if fm.Mode&fs.ModeDevice != 0 {
+		// Decode the dev_t the same way glibc's major() and minor() do
+		rdev := uint64(st.Rdev)
+		fm.DevMajor = uint32((rdev>>8)&0xfff | (rdev>>32)&^0xfff)
+		fm.DevMinor = uint32(rdev&0xff | (rdev>>12)&^0xff)
+	}
+}
+
+// Reads all extended attributes of the file at 'fpath'. Filesystems without xattr
+// support are treated as having none.
+func readXattrs(fpath string) (map[string]string, error) {
+	size, err := syscall.Listxattr(fpath, nil)
+	if err != nil {
+		return nil, ignoreXattrErr(err)
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(fpath, buf); err != nil {
+		return nil, ignoreXattrErr(err)
+	}
+	attrs := make(map[string]string)
+	for _, key := range bytes.Split(buf[:size], []byte{0}) {
+		if len(key) == 0 {
+			continue
+		}
+		value, err := getXattr(fpath, string(key))
+		if errors.Is(err, syscall.ENODATA) {
+			// Removed since we listed it
+			continue
+		} else if err != nil {
+			return nil, ignoreXattrErr(err)
+		}
+		attrs[string(key)] = value
+	}
+	return attrs, nil
+}
+
+// Reads a single extended attribute value.
+func getXattr(fpath string, key string) (string, error) {
+	size, err := syscall.Getxattr(fpath, key, nil)
+	if err != nil || size == 0 {
+		return "", err
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Getxattr(fpath, key, buf); err != nil {
+		return "", err
+	}
+	return string(buf[:size]), nil
+}
+
+// Returns nil if 'err' only means xattrs aren't supported by the filesystem.
+func ignoreXattrErr(err error) error {
+	if errors.Is(err, syscall.ENOTSUP) {
+		return nil
+	}
+	return err
+}
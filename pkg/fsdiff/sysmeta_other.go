@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package fsdiff
+
+// Ownership and extra timestamps are only collected on linux.
+func fillSysMeta(fm *FileMeta, sys any) {}
+
+// Extended attributes are only collected on linux.
+func readXattrs(fpath string) (map[string]string, error) {
+	return nil, nil
+}
@@ -0,0 +1,254 @@
+package fsdiff
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Lines of context around each hunk of a text diff
+const DIFF_CONTEXT = 3
+
+// Most lines inserted plus deleted that a text diff searches for a minimal edit,
+// beyond that the differing part is replaced as a whole
+const diffMaxEdits = 1000
+
+// Returns true if 'data' looks like text: valid UTF-8 without NUL bytes, checking
+// the first 8000 bytes like git does.
+func IsText(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+		// Don't fail on a multi-byte character cut in half
+		for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(data[i]) {
+				if !utf8.FullRune(data[i:]) {
+					data = data[:i]
+				}
+				break
+			}
+		}
+	}
+	return bytes.IndexByte(data, 0) < 0 && utf8.Valid(data)
+}
+
+// One line of an edit script
+type diffOp struct {
+	// ' ' if the line is in both, '-' if it was deleted, '+' if it was inserted
+	kind byte
+	line string
+	// Lines of each side before this one
+	aPos, bPos int
+}
+
+// Returns a unified diff turning 'old' into 'new', with "a/" and "b/" prefixed to
+// 'fpath' in the header like git. Returns an empty string if they're the same.
+func UnifiedDiff(fpath string, old, new []byte) string {
+	ops := diffLines(splitLines(old), splitLines(new))
+	var sb strings.Builder
+	for start := 0; start < len(ops); {
+		// Find the next change, and the end of the hunk it starts, which runs until
+		// there are more than two contexts worth of unchanged lines
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		last := first
+		for i := first; i < len(ops) && i-last <= 2*DIFF_CONTEXT; i++ {
+			if ops[i].kind != ' ' {
+				last = i
+			}
+		}
+		from := first - DIFF_CONTEXT
+		if from < start {
+			from = start
+		}
+		to := last + 1 + DIFF_CONTEXT
+		if to > len(ops) {
+			to = len(ops)
+		}
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- a/%s\n+++ b/%s\n", fpath, fpath)
+		}
+		writeHunk(&sb, ops[from:to])
+		start = to
+	}
+	return sb.String()
+}
+
+func writeHunk(sb *strings.Builder, ops []diffOp) {
+	aLen, bLen := 0, 0
+	for _, op := range ops {
+		if op.kind != '+' {
+			aLen++
+		}
+		if op.kind != '-' {
+			bLen++
+		}
+	}
+	fmt.Fprintf(sb, "@@ -%s +%s @@\n", hunkRange(ops[0].aPos, aLen), hunkRange(ops[0].bPos, bLen))
+	for _, op := range ops {
+		sb.WriteByte(op.kind)
+		sb.WriteString(op.line)
+		if !strings.HasSuffix(op.line, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// Formats the range of a hunk, where 'pos' is the number of lines before it.
+func hunkRange(pos, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%d,0", pos)
+	case 1:
+		return fmt.Sprintf("%d", pos+1)
+	default:
+		return fmt.Sprintf("%d,%d", pos+1, n)
+	}
+}
+
+// Splits 'data' into lines, keeping the line endings so a missing final newline
+// counts as a change.
+func splitLines(data []byte) []string {
+	lines := make([]string, 0)
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n') + 1
+		if i == 0 {
+			i = len(data)
+		}
+		lines = append(lines, string(data[:i]))
+		data = data[i:]
+	}
+	return lines
+}
+
+// Returns an edit script turning 'a' into 'b'. Lines common to the start and end are
+// skipped before searching for the shortest script with Myers' algorithm.
+func diffLines(a, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	ops := make([]diffOp, 0, len(a)+len(b)-prefix-suffix)
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{kind: ' ', line: a[i], aPos: i, bPos: i})
+	}
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	middle := myersDiff(ma, mb)
+	if middle == nil {
+		for _, line := range ma {
+			middle = append(middle, diffOp{kind: '-', line: line})
+		}
+		for _, line := range mb {
+			middle = append(middle, diffOp{kind: '+', line: line})
+		}
+	}
+	aPos, bPos := prefix, prefix
+	for _, op := range middle {
+		op.aPos, op.bPos = aPos, bPos
+		if op.kind != '+' {
+			aPos++
+		}
+		if op.kind != '-' {
+			bPos++
+		}
+		ops = append(ops, op)
+	}
+	for i := 0; i < suffix; i++ {
+		ops = append(ops, diffOp{kind: ' ', line: a[aPos+i], aPos: aPos + i, bPos: bPos + i})
+	}
+	return ops
+}
+
+// Returns the shortest edit script turning 'a' into 'b', without positions, or nil if
+// it's longer than diffMaxEdits.
+func myersDiff(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	maxD := n + m
+	if maxD > diffMaxEdits {
+		maxD = diffMaxEdits
+	}
+	// v[off+k] is the furthest x reached on diagonal k, and trace holds v before
+	// each round so the path can be walked back
+	off := maxD + 1
+	v := make([]int, 2*maxD+3)
+	trace := make([][]int, 0)
+	for d := 0; d <= maxD; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return myersBacktrack(a, b, trace, off)
+			}
+		}
+	}
+	return nil
+}
+
+func myersBacktrack(a, b []string, trace [][]int, off int) []diffOp {
+	ops := make([]diffOp, 0)
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[off+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			ops = append(ops, diffOp{kind: ' ', line: a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, diffOp{kind: '+', line: b[y-1]})
+				y--
+			} else {
+				ops = append(ops, diffOp{kind: '-', line: a[x-1]})
+				x--
+			}
+		}
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// Writes the text diffs in 'd' as a single patch.
+func WritePatch(w io.Writer, d *FsDiff) error {
+	for _, e := range d.Entries {
+		if e.TextDiff == "" {
+			continue
+		}
+		if _, err := io.WriteString(w, e.TextDiff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
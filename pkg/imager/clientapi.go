@@ -32,13 +32,55 @@ func (c *ClientApi) GetTargetRoots() ([]string, error) {
 	return res.Roots, nil
 }
 
-func (c *ClientApi) GenerateDiff(meta *fsdiff.DirMeta) (err error) {
-	req := tkserver.GenerateDiffReq{Base: meta}
-	res := tkserver.Empty{}
-	if err = c.RpcCall("GenerateDiff", &req, &res); err != nil {
-		return
+// Starts a new diff against 'base'. Returns the paths of partial directories whose
+// subtrees must be sent with GenerateDiffAt. If 'collect' is set the server collects
+// the changed files as it finds them, see tkserver.GenerateDiffReq.Collect.
+func (c *ClientApi) GenerateDiff(base *fsdiff.CompactTree, collect bool) ([]string, error) {
+	req := tkserver.GenerateDiffReq{Base: base, Collect: collect}
+	return c.generateDiff(&req)
+}
+
+// Continues the diff with the base subtree at 'fpath', see GenerateDiff.
+func (c *ClientApi) GenerateDiffAt(fpath string, base *fsdiff.CompactTree) ([]string, error) {
+	req := tkserver.GenerateDiffReq{Base: base, Path: fpath}
+	return c.generateDiff(&req)
+}
+
+func (c *ClientApi) generateDiff(req *tkserver.GenerateDiffReq) ([]string, error) {
+	res := tkserver.GenerateDiffRes{}
+	if err := c.RpcCall("GenerateDiff", req, &res); err != nil {
+		return nil, err
+	}
+	return res.Pending, nil
+}
+
+// Has the server generate the diff from the package databases in the container
+// instead of a base image. Returns the package managers that were checked.
+func (c *ClientApi) VerifyPackages() ([]string, error) {
+	res := tkserver.VerifyPackagesRes{}
+	if err := c.RpcCall("VerifyPackages", tkserver.Empty{}, &res); err != nil {
+		return nil, err
+	}
+	return res.Sources, nil
+}
+
+// Has the server generate the diff from the upper directory of the container's
+// overlay root instead of a base image. Returns the upper directory.
+func (c *ClientApi) DiffOverlay() (string, error) {
+	res := tkserver.DiffOverlayRes{}
+	if err := c.RpcCall("DiffOverlay", tkserver.Empty{}, &res); err != nil {
+		return "", err
+	}
+	return res.Upper, nil
+}
+
+// Fetches the diff generated by GenerateDiff, VerifyPackages or DiffOverlay.
+func (c *ClientApi) GetDiff() (*fsdiff.FsDiff, error) {
+	res := &fsdiff.FsDiff{}
+	if err := c.RpcCall("GetDiff", tkserver.Empty{}, res); err != nil {
+		return nil, err
 	}
-	return
+	return res, nil
 }
 
 func (c *ClientApi) SetConfig(config *tkserver.ServerConfig) (err error) {
@@ -46,8 +88,10 @@ func (c *ClientApi) SetConfig(config *tkserver.ServerConfig) (err error) {
 	return c.RpcCall("SetConfig", config, &res)
 }
 
-func (c *ClientApi) TarStart() error {
-	return c.RpcCall("TarStart", tkserver.Empty{}, &tkserver.Empty{})
+// Starts collecting the changed files, except those in 'skip'.
+func (c *ClientApi) TarStart(skip []string) error {
+	req := tkserver.TarStartReq{Skip: skip}
+	return c.RpcCall("TarStart", &req, &tkserver.Empty{})
 }
 
 func (c *ClientApi) TarProgress() (float64, error) {
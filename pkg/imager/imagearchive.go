@@ -0,0 +1,571 @@
+package imager
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bindernews/taki/pkg/fsdiff"
+	"github.com/samber/lo"
+)
+
+// Docker 'save' manifest file name
+const DOCKER_MANIFEST = "manifest.json"
+
+// OCI image-layout index file name
+const OCI_INDEX = "index.json"
+
+const mediaTypeOciIndex = "application/vnd.oci.image.index.v1+json"
+const mediaTypeDockerList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+// Layer directories of older 'docker save' archives are named after the layer's hash
+var layerDirPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Error returned when a layer uses a compression format we can't read
+var ErrUnsupportedCompression = errors.New("unsupported layer compression")
+
+// Number of headers read from the start of a tar to tell an image archive from a
+// flattened root filesystem
+const IMAGE_PROBE_HEADERS = 64
+
+// A container image on disk. This may be a 'docker save' archive, an OCI image-layout
+// directory or tar, or a flattened root filesystem tar. Archives (and layers) may be
+// gzip-compressed.
+type ImageArchive struct {
+	// Digest of the image config. Flattened root filesystems have no config, they
+	// are identified by the sha256 of the file if it was requested when opening.
+	Digest string
+	// Names of the layer blobs within the archive, from lowest to highest. A flattened
+	// root filesystem has a single layer with an empty name.
+	Layers []string
+	// Path the archive was opened from
+	path string
+	// Platform to pick from multi-platform images, may be nil
+	platform *Platform
+	// Opens a file in the archive by name
+	open func(name string) (io.ReadCloser, error)
+	// Things to close
+	toClose []io.Closer
+	// Temporary file to remove on close, if the archive had to be decompressed
+	tempPath string
+}
+
+// Platform of an image in a multi-platform index
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Parses a platform such as "linux/amd64" or "linux/arm/v7". Returns nil if 's' is
+// empty.
+func ParsePlatform(s string) (*Platform, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || lo.Contains(parts, "") {
+		return nil, fmt.Errorf("invalid platform '%s', expected os/arch[/variant]", s)
+	}
+	p := &Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p *Platform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// Returns true if 'p' is the platform 'want'. The variant only has to match if 'want'
+// has one.
+func (p *Platform) matches(want *Platform) bool {
+	return p.OS == want.OS && p.Architecture == want.Architecture &&
+		(want.Variant == "" || p.Variant == want.Variant)
+}
+
+// Opens the image at 'fpath' and reads its manifest to determine the layers. The
+// image for 'platform' is picked from multi-platform images, see selectManifest.
+func OpenImageArchive(fpath string, platform *Platform) (*ImageArchive, error) {
+	return openImageArchive(fpath, platform, false)
+}
+
+// Same as OpenImageArchive, but if 'digest' is true a flattened root filesystem's
+// Digest is set to the sha256 of the file.
+func openImageArchive(fpath string, platform *Platform, digest bool) (img *ImageArchive, err error) {
+	var info fs.FileInfo
+	if info, err = os.Stat(fpath); err != nil {
+		return
+	}
+	img = &ImageArchive{path: fpath, platform: platform}
+	defer func() {
+		if err != nil {
+			img.Close()
+			img = nil
+		}
+	}()
+	if info.IsDir() {
+		img.open = func(name string) (io.ReadCloser, error) {
+			return os.Open(filepath.Join(fpath, filepath.FromSlash(name)))
+		}
+		err = img.readManifest()
+		return
+	}
+	// A flattened root filesystem is read as a single layer, so it's never indexed
+	// or decompressed up front
+	var isImage bool
+	if isImage, img.Digest, err = probeTar(fpath, digest); err != nil || !isImage {
+		img.Layers = []string{""}
+		return
+	}
+	if err = img.indexTar(fpath); err != nil {
+		return
+	}
+	err = img.readManifest()
+	return
+}
+
+// Reads the first headers of the (possibly gzip-compressed) tar at 'fpath' to tell
+// whether it's an image archive, see isImageMember. If it isn't and 'digest' is true,
+// the rest of the file is hashed in the same read and its sha256 digest returned.
+func probeTar(fpath string, digest bool) (isImage bool, fileDigest string, err error) {
+	var file *os.File
+	if file, err = os.Open(fpath); err != nil {
+		return
+	}
+	defer file.Close()
+	h := sha256.New()
+	rd := bufio.NewReader(io.TeeReader(file, h))
+	var tr *tar.Reader
+	if magic, _ := rd.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(rd); err != nil {
+			return
+		}
+		defer zr.Close()
+		tr = tar.NewReader(zr)
+	} else {
+		tr = tar.NewReader(rd)
+	}
+	for i := 0; i < IMAGE_PROBE_HEADERS; i++ {
+		var header *tar.Header
+		if header, err = tr.Next(); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		if isImageMember(cleanArchiveName(header.Name)) {
+			return true, "", nil
+		}
+	}
+	if !digest {
+		return
+	}
+	// Everything read so far went through the hash, so only the rest is left
+	if _, err = io.Copy(h, file); err != nil {
+		return
+	}
+	return false, "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Returns true if 'name' is a file only image archives have: the docker or OCI
+// manifests, OCI blobs, or the per-layer files of older 'docker save' archives.
+func isImageMember(name string) bool {
+	switch name {
+	case DOCKER_MANIFEST, OCI_INDEX, "oci-layout", "repositories":
+		return true
+	}
+	if strings.HasPrefix(name, "blobs/") {
+		return true
+	}
+	dir, base := path.Split(name)
+	return layerDirPattern.MatchString(strings.TrimSuffix(dir, "/")) && (base == "layer.tar" || base == "VERSION" || base == "json")
+}
+
+// Builds an index of the files in the image archive at 'fpath' so they can be opened
+// in any order. Compressed archives are first decompressed to a temporary file.
+func (img *ImageArchive) indexTar(fpath string) (err error) {
+	var file *os.File
+	if file, err = os.Open(fpath); err != nil {
+		return
+	}
+	img.toClose = append(img.toClose, file)
+	rd := bufio.NewReader(file)
+	magic, _ := rd.Peek(len(gzipMagic))
+	if bytes.Equal(magic, gzipMagic) {
+		if file, err = img.decompressTemp(rd); err != nil {
+			return
+		}
+	} else if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	// The tar reader stops exactly at the start of each entry's data, so the current
+	// file offset tells us where to read from later.
+	type member struct{ offset, size int64 }
+	members := make(map[string]member)
+	tr := tar.NewReader(file)
+	for {
+		var header *tar.Header
+		if header, err = tr.Next(); err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			return
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		var offset int64
+		if offset, err = file.Seek(0, io.SeekCurrent); err != nil {
+			return
+		}
+		members[cleanArchiveName(header.Name)] = member{offset, header.Size}
+	}
+	img.open = func(name string) (io.ReadCloser, error) {
+		m, ok := members[cleanArchiveName(name)]
+		if !ok {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return io.NopCloser(io.NewSectionReader(file, m.offset, m.size)), nil
+	}
+	return
+}
+
+// Decompresses 'rd' into a temporary file, which is removed when the image is closed.
+func (img *ImageArchive) decompressTemp(rd io.Reader) (file *os.File, err error) {
+	var zr *gzip.Reader
+	if zr, err = gzip.NewReader(rd); err != nil {
+		return
+	}
+	defer zr.Close()
+	if file, err = os.CreateTemp("", "taki-image-*.tar"); err != nil {
+		return
+	}
+	img.tempPath = file.Name()
+	img.toClose = append(img.toClose, file)
+	if _, err = io.Copy(file, zr); err != nil {
+		return
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return
+}
+
+// Determines the layers from the docker or OCI manifest. If there is neither, the
+// image is treated as a flattened root filesystem.
+func (img *ImageArchive) readManifest() error {
+	if err := img.readDockerManifest(); !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := img.readOciIndex(); !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	img.Layers = []string{""}
+	return nil
+}
+
+// Reads a 'docker save' manifest.json. If the archive contains several images the
+// first one is used.
+func (img *ImageArchive) readDockerManifest() error {
+	var manifest []struct {
+		Config   string
+		RepoTags []string
+		Layers   []string
+	}
+	if err := img.readJson(DOCKER_MANIFEST, &manifest); err != nil {
+		return err
+	}
+	if len(manifest) == 0 {
+		return fmt.Errorf("'%s' does not list any images", DOCKER_MANIFEST)
+	}
+	img.Layers = manifest[0].Layers
+	// Older versions name the config after its hash, newer ones store it as a blob
+	config := manifest[0].Config
+	if algo, hex, ok := strings.Cut(strings.TrimPrefix(config, "blobs/"), "/"); ok {
+		img.Digest = algo + ":" + hex
+	} else {
+		img.Digest = "sha256:" + strings.TrimSuffix(path.Base(config), ".json")
+	}
+	return nil
+}
+
+// OCI descriptor as found in index.json and image manifests
+type ociDescriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Platform  *Platform `json:"platform,omitempty"`
+}
+
+// Reads an OCI image-layout index.json and the image manifest it points to.
+func (img *ImageArchive) readOciIndex() error {
+	var index struct {
+		Manifests []ociDescriptor `json:"manifests"`
+	}
+	if err := img.readJson(OCI_INDEX, &index); err != nil {
+		return err
+	}
+	desc, err := selectManifest(index.Manifests, img.platform)
+	if err != nil {
+		return err
+	}
+	// Follow nested indexes (multi-platform images) down to an image manifest
+	for desc.MediaType == mediaTypeOciIndex || desc.MediaType == mediaTypeDockerList {
+		if err := img.readJson(blobPath(desc.Digest), &index); err != nil {
+			return err
+		}
+		if desc, err = selectManifest(index.Manifests, img.platform); err != nil {
+			return err
+		}
+	}
+	var manifest struct {
+		Config ociDescriptor   `json:"config"`
+		Layers []ociDescriptor `json:"layers"`
+	}
+	if err := img.readJson(blobPath(desc.Digest), &manifest); err != nil {
+		return err
+	}
+	img.Digest = manifest.Config.Digest
+	img.Layers = make([]string, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		img.Layers[i] = blobPath(layer.Digest)
+	}
+	return nil
+}
+
+// Opens layer 'i' for reading, decompressing it if necessary.
+func (img *ImageArchive) OpenLayer(i int) (io.ReadCloser, error) {
+	var raw io.ReadCloser
+	var err error
+	if img.Layers[i] == "" {
+		raw, err = os.Open(img.path)
+	} else {
+		raw, err = img.open(img.Layers[i])
+	}
+	if err != nil {
+		return nil, err
+	}
+	rd := bufio.NewReader(raw)
+	magic, _ := rd.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(rd)
+		if err != nil {
+			raw.Close()
+			return nil, err
+		}
+		return &layerReader{Reader: zr, toClose: []io.Closer{zr, raw}}, nil
+	case bytes.Equal(magic, zstdMagic):
+		raw.Close()
+		return nil, fmt.Errorf("layer '%s': %w (zstd)", img.Layers[i], ErrUnsupportedCompression)
+	default:
+		return &layerReader{Reader: rd, toClose: []io.Closer{raw}}, nil
+	}
+}
+
+// Reads the regular files at 'names' as they are with every layer applied. Files that
+// are missing, removed by a whiteout, not regular, or larger than 'maxSize' are left
+// out of the result. Hard links are only read if their target is one of 'names'.
+func (img *ImageArchive) ReadFiles(names []string, maxSize int64) (map[string][]byte, error) {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[cleanArchiveName(name)] = true
+	}
+	files := make(map[string][]byte)
+	// Removes 'fpath' and everything below it
+	remove := func(fpath string) {
+		for name := range files {
+			if name == fpath || strings.HasPrefix(name, fpath+"/") || fpath == "." {
+				delete(files, name)
+			}
+		}
+	}
+	for i := range img.Layers {
+		rd, err := img.OpenLayer(i)
+		if err != nil {
+			return nil, err
+		}
+		// Like fsdiff's AddLayer, whiteouts only apply to lower layers, so the layer's
+		// own files are merged after they've been applied
+		added := make(map[string][]byte)
+		replaced := make([]string, 0)
+		whiteouts := make([]string, 0)
+		opaques := make([]string, 0)
+		tr := tar.NewReader(rd)
+		for {
+			var hdr *tar.Header
+			if hdr, err = tr.Next(); err != nil {
+				break
+			}
+			name := cleanArchiveName(hdr.Name)
+			dir, base := path.Split(name)
+			dir = path.Clean(dir)
+			switch {
+			case base == fsdiff.WHITEOUT_OPAQUE:
+				opaques = append(opaques, dir)
+			case strings.HasPrefix(base, fsdiff.WHITEOUT_META_PREFIX):
+			case strings.HasPrefix(base, fsdiff.WHITEOUT_PREFIX):
+				whiteouts = append(whiteouts, path.Join(dir, strings.TrimPrefix(base, fsdiff.WHITEOUT_PREFIX)))
+			case !wanted[name]:
+				// Directories are merged, but anything else replaces what was below it
+				if hdr.Typeflag != tar.TypeDir {
+					replaced = append(replaced, name)
+				}
+			case hdr.Typeflag == tar.TypeLink:
+				target := cleanArchiveName(hdr.Linkname)
+				data, ok := added[target]
+				if !ok {
+					data, ok = files[target]
+				}
+				if ok {
+					added[name] = data
+				} else {
+					replaced = append(replaced, name)
+				}
+			case (hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA) && hdr.Size <= maxSize:
+				var data []byte
+				if data, err = io.ReadAll(tr); err == nil {
+					added[name] = data
+				}
+			default:
+				replaced = append(replaced, name)
+			}
+			if err != nil {
+				break
+			}
+		}
+		for _, dir := range opaques {
+			for name := range files {
+				if strings.HasPrefix(name, dir+"/") || dir == "." {
+					delete(files, name)
+				}
+			}
+		}
+		for _, fpath := range append(whiteouts, replaced...) {
+			remove(fpath)
+		}
+		for name, data := range added {
+			remove(name)
+			files[name] = data
+		}
+		rd.Close()
+		if err != io.EOF {
+			return nil, fmt.Errorf("layer '%s': %w", img.Layers[i], err)
+		}
+	}
+	return files, nil
+}
+
+func (img *ImageArchive) Close() error {
+	var err error
+	for _, c := range img.toClose {
+		if err2 := c.Close(); err == nil {
+			err = err2
+		}
+	}
+	img.toClose = nil
+	if img.tempPath != "" {
+		if err2 := os.Remove(img.tempPath); err == nil {
+			err = err2
+		}
+		img.tempPath = ""
+	}
+	return err
+}
+
+// Reads and decodes a JSON file from the archive.
+func (img *ImageArchive) readJson(name string, v any) error {
+	rd, err := img.open(name)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	if err := json.NewDecoder(rd).Decode(v); err != nil {
+		return fmt.Errorf("failed to parse '%s': %w", name, err)
+	}
+	return nil
+}
+
+// Picks the manifest for 'platform' from a list of descriptors. Without a platform
+// the list must hold a single image, so the wrong one is never picked silently.
+// Attestation manifests, whose platform is "unknown/unknown", are ignored.
+func selectManifest(descs []ociDescriptor, platform *Platform) (ociDescriptor, error) {
+	images := lo.Filter(descs, func(desc ociDescriptor, _ int) bool {
+		return desc.Platform == nil || desc.Platform.OS != "unknown"
+	})
+	if len(images) == 0 {
+		return ociDescriptor{}, errors.New("image index does not list any manifests")
+	}
+	// A single image which doesn't declare its platform can't be checked against it
+	if len(images) == 1 && (platform == nil || images[0].Platform == nil) {
+		return images[0], nil
+	}
+	platforms := strings.Join(lo.Map(images, func(desc ociDescriptor, _ int) string {
+		if desc.Platform == nil {
+			return "unknown"
+		}
+		return desc.Platform.String()
+	}), ", ")
+	if platform == nil {
+		return ociDescriptor{}, fmt.Errorf("image index lists several platforms (%s), one must be selected", platforms)
+	}
+	found := lo.Filter(images, func(desc ociDescriptor, _ int) bool {
+		return desc.Platform != nil && desc.Platform.matches(platform)
+	})
+	switch len(found) {
+	case 0:
+		return ociDescriptor{}, fmt.Errorf("image index has no manifest for platform '%s' (found %s)", platform, platforms)
+	case 1:
+		return found[0], nil
+	default:
+		return ociDescriptor{}, fmt.Errorf("several manifests match platform '%s' (found %s), a variant must be given", platform, platforms)
+	}
+}
+
+// Returns the path of a blob in an OCI image-layout given its digest.
+func blobPath(digest string) string {
+	algo, hex, _ := strings.Cut(digest, ":")
+	return path.Join("blobs", algo, hex)
+}
+
+// Normalizes a file name from an archive so "./a", "/a" and "a" match.
+func cleanArchiveName(name string) string {
+	return strings.TrimPrefix(path.Clean(name), "/")
+}
+
+// Reader for a (possibly decompressed) layer which closes all underlying readers.
+type layerReader struct {
+	io.Reader
+	toClose []io.Closer
+}
+
+func (l *layerReader) Close() error {
+	var err error
+	for _, c := range l.toClose {
+		if err2 := c.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
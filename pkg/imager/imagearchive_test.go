@@ -0,0 +1,419 @@
+package imager_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bindernews/taki/pkg/fsdiff"
+	"github.com/bindernews/taki/pkg/imager"
+)
+
+type tarEntry struct {
+	Name     string
+	Body     string
+	HardLink string
+	Type     byte
+}
+
+// Writes 'entries' to an in-memory tar.
+func writeTar(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.Name, Mode: 0755, Format: tar.FormatPAX}
+		switch {
+		case e.Type != 0:
+			hdr.Typeflag = e.Type
+		case e.HardLink != "":
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = e.HardLink
+		case e.Name[len(e.Name)-1] == '/':
+			hdr.Typeflag = tar.TypeDir
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(e.Body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.Body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipBytes(t *testing.T, data []byte) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Returns the file of an OCI blob holding 'data'.
+func blob(data []byte) tarEntry {
+	return tarEntry{Name: "blobs/sha256/" + strings.TrimPrefix(sha256Digest(data), "sha256:"), Body: string(data)}
+}
+
+func mustJson(t *testing.T, v any) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// A layer whose only file is etc/os-release containing 'release'.
+func releaseLayer(t *testing.T, release string) []byte {
+	return writeTar(t, []tarEntry{{Name: "etc/"}, {Name: "etc/os-release", Body: release}})
+}
+
+// Builds the blobs of an OCI image whose layers are 'layers', returning the
+// manifest's descriptor, the config digest and the blob files.
+func ociImage(t *testing.T, platform string, layers ...[]byte) (desc map[string]any, config string, files []tarEntry) {
+	t.Helper()
+	configData := mustJson(t, map[string]any{"architecture": platform})
+	manifest := map[string]any{
+		"config": map[string]any{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": sha256Digest(configData)},
+	}
+	files = []tarEntry{blob(configData)}
+	layerDescs := []any{}
+	for _, layer := range layers {
+		layerDescs = append(layerDescs, map[string]any{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": sha256Digest(layer)})
+		files = append(files, blob(layer))
+	}
+	manifest["layers"] = layerDescs
+	manifestData := mustJson(t, manifest)
+	files = append(files, blob(manifestData))
+	desc = map[string]any{"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": sha256Digest(manifestData)}
+	if platform != "" {
+		p, err := imager.ParsePlatform(platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc["platform"] = p
+	}
+	return desc, sha256Digest(configData), files
+}
+
+// Builds an OCI image-layout with an image per platform behind a nested index, like
+// 'docker save' and 'skopeo' write multi-platform images. Each image's os-release is
+// its platform. Returns the files and the config digest of each platform.
+func ociLayout(t *testing.T, platforms ...string) ([]tarEntry, map[string]string) {
+	t.Helper()
+	files := []tarEntry{{Name: "oci-layout", Body: `{"imageLayoutVersion":"1.0.0"}`}}
+	configs := make(map[string]string)
+	descs := []any{}
+	for _, platform := range platforms {
+		desc, config, blobs := ociImage(t, platform, releaseLayer(t, platform))
+		descs = append(descs, desc)
+		configs[platform] = config
+		files = append(files, blobs...)
+	}
+	nested := mustJson(t, map[string]any{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": descs})
+	files = append(files, blob(nested))
+	index := mustJson(t, map[string]any{"schemaVersion": 2, "manifests": []any{
+		map[string]any{"mediaType": "application/vnd.oci.image.index.v1+json", "digest": sha256Digest(nested)},
+	}})
+	files = append(files, tarEntry{Name: imager.OCI_INDEX, Body: string(index)})
+	return files, configs
+}
+
+// Writes 'entries' as files below 'dir'.
+func writeDir(t *testing.T, dir string, entries []tarEntry) {
+	t.Helper()
+	for _, e := range entries {
+		fpath := filepath.Join(dir, filepath.FromSlash(e.Name))
+		if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fpath, []byte(e.Body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestOpenImageArchive(t *testing.T) {
+	base := releaseLayer(t, "base")
+	upper := releaseLayer(t, "upper")
+	hash := func(data []byte) string { return strings.TrimPrefix(sha256Digest(data), "sha256:") }
+	configHash := hash([]byte("config"))
+
+	// Older 'docker save' archives store each layer in a directory named after it
+	dockerOld := []tarEntry{
+		{Name: hash(base) + "/"},
+		{Name: hash(base) + "/VERSION", Body: "1.0"},
+		{Name: hash(base) + "/layer.tar", Body: string(base)},
+		{Name: hash(upper) + "/layer.tar", Body: string(upper)},
+		{Name: configHash + ".json", Body: "config"},
+		{Name: imager.DOCKER_MANIFEST, Body: fmt.Sprintf(`[{"Config":"%s.json","RepoTags":["app:1"],"Layers":["%s/layer.tar","%s/layer.tar"]}]`,
+			configHash, hash(base), hash(upper))},
+	}
+	// Newer ones also have an OCI index, but the docker manifest is used
+	dockerBlobs := func(layers ...[]byte) []tarEntry {
+		entries := []tarEntry{blob([]byte("config")), {Name: imager.OCI_INDEX, Body: `{"manifests":[]}`}}
+		names := []string{}
+		for _, layer := range layers {
+			entries = append(entries, blob(layer))
+			names = append(names, `"blobs/sha256/`+hash(layer)+`"`)
+		}
+		return append(entries, tarEntry{Name: imager.DOCKER_MANIFEST,
+			Body: fmt.Sprintf(`[{"Config":"blobs/sha256/%s","Layers":[%s]}]`, configHash, strings.Join(names, ","))})
+	}
+	multi, configs := ociLayout(t, "linux/amd64", "linux/arm64", "linux/arm/v6", "linux/arm/v7", "unknown/unknown")
+	single, singleConfigs := ociLayout(t, "linux/arm64", "unknown/unknown")
+	desc, undeclaredConfig, undeclared := ociImage(t, "", base, upper)
+	undeclared = append(undeclared, tarEntry{Name: imager.OCI_INDEX, Body: string(mustJson(t, map[string]any{"manifests": []any{desc}}))})
+	zstdLayer := append([]byte{0x28, 0xb5, 0x2f, 0xfd}, base...)
+
+	tests := []struct {
+		name     string
+		entries  []tarEntry
+		gzip     bool
+		dir      bool
+		platform string
+		digest   string
+		release  string
+		err      string
+	}{
+		{name: "docker save", entries: dockerOld, digest: "sha256:" + configHash, release: "upper"},
+		{name: "docker save gzip", entries: dockerOld, gzip: true, digest: "sha256:" + configHash, release: "upper"},
+		{name: "docker save blobs", entries: dockerBlobs(base, upper), digest: "sha256:" + configHash, release: "upper"},
+		{name: "docker save gzip layers", entries: dockerBlobs(gzipBytes(t, base), gzipBytes(t, upper)), digest: "sha256:" + configHash, release: "upper"},
+		{name: "docker save zstd layer", entries: dockerBlobs(zstdLayer), err: imager.ErrUnsupportedCompression.Error()},
+		{name: "oci undeclared platform", entries: undeclared, platform: "linux/amd64", digest: undeclaredConfig, release: "upper"},
+		{name: "oci single platform", entries: single, digest: singleConfigs["linux/arm64"], release: "linux/arm64"},
+		{name: "oci platform", entries: multi, platform: "linux/arm64", digest: configs["linux/arm64"], release: "linux/arm64"},
+		{name: "oci variant", entries: multi, platform: "linux/arm/v7", digest: configs["linux/arm/v7"], release: "linux/arm/v7"},
+		{name: "oci dir", entries: multi, dir: true, platform: "linux/amd64", digest: configs["linux/amd64"], release: "linux/amd64"},
+		{name: "oci gzip", entries: multi, gzip: true, platform: "linux/amd64", digest: configs["linux/amd64"], release: "linux/amd64"},
+		{name: "oci no platform", entries: multi, err: "several platforms"},
+		{name: "oci missing platform", entries: multi, platform: "linux/s390x", err: "no manifest for platform 'linux/s390x'"},
+		{name: "oci ambiguous platform", entries: multi, platform: "linux/arm", err: "several manifests match platform 'linux/arm'"},
+		{name: "oci attestation", entries: multi, platform: "unknown/unknown", err: "no manifest for platform"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fpath := filepath.Join(t.TempDir(), "image")
+			if tt.dir {
+				writeDir(t, fpath, tt.entries)
+			} else {
+				data := writeTar(t, tt.entries)
+				if tt.gzip {
+					data = gzipBytes(t, data)
+				}
+				if err := os.WriteFile(fpath, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			platform, err := imager.ParsePlatform(tt.platform)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := imager.OpenImageArchive(fpath, platform)
+			var files map[string][]byte
+			if err == nil {
+				defer img.Close()
+				files, err = img.ReadFiles([]string{"etc/os-release"}, 1024)
+			}
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, expected '%s'", err, tt.err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if img.Digest != tt.digest {
+				t.Errorf("got digest %s, expected %s", img.Digest, tt.digest)
+			}
+			if got := string(files["etc/os-release"]); got != tt.release {
+				t.Errorf("got os-release '%s', expected '%s'", got, tt.release)
+			}
+		})
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+	for _, s := range []string{"linux", "linux/", "/amd64", "linux/arm/v7/x"} {
+		if _, err := imager.ParsePlatform(s); err == nil {
+			t.Errorf("expected an error for '%s'", s)
+		}
+	}
+	p, err := imager.ParsePlatform("linux/arm/v7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&imager.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}); !reflect.DeepEqual(p, want) || p.String() != "linux/arm/v7" {
+		t.Errorf("got %+v", p)
+	}
+	if p, err := imager.ParsePlatform(""); p != nil || err != nil {
+		t.Errorf("got %v, %v for an empty platform", p, err)
+	}
+}
+
+func TestReadFiles(t *testing.T) {
+	layers := [][]byte{
+		writeTar(t, []tarEntry{
+			{Name: "etc/"},
+			{Name: "etc/passwd", Body: "root"},
+			{Name: "etc/shadow", Body: "secret"},
+			{Name: "etc/big", Body: strings.Repeat("x", 100)},
+			{Name: "opt/app/config", Body: "old"},
+			{Name: "bin/busybox", Body: "busybox"},
+		}),
+		writeTar(t, []tarEntry{
+			{Name: "etc/" + fsdiff.WHITEOUT_PREFIX + "shadow"},
+			{Name: "opt/app/" + fsdiff.WHITEOUT_OPAQUE},
+			{Name: "opt/app/new", Body: "new"},
+			{Name: "bin/sh", HardLink: "bin/busybox"},
+			{Name: "etc/passwd", Type: tar.TypeFifo},
+		}),
+	}
+	fpath := filepath.Join(t.TempDir(), "image.tar")
+	entries := []tarEntry{blob([]byte("config"))}
+	names := []string{}
+	for _, layer := range layers {
+		entries = append(entries, blob(layer))
+		names = append(names, `"`+blob(layer).Name+`"`)
+	}
+	entries = append(entries, tarEntry{Name: imager.DOCKER_MANIFEST,
+		Body: fmt.Sprintf(`[{"Config":"%s","Layers":[%s]}]`, blob([]byte("config")).Name, strings.Join(names, ","))})
+	if err := os.WriteFile(fpath, writeTar(t, entries), 0644); err != nil {
+		t.Fatal(err)
+	}
+	img, err := imager.OpenImageArchive(fpath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+	files, err := img.ReadFiles([]string{"etc/passwd", "etc/shadow", "/etc/big", "./opt/app/config", "opt/app/new", "bin/sh", "bin/busybox", "missing"}, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"opt/app/new": []byte("new"), "bin/sh": []byte("busybox"), "bin/busybox": []byte("busybox")}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("got %q, expected %q", files, want)
+	}
+}
+
+func TestImageCache(t *testing.T) {
+	dir := t.TempDir()
+	// Image members after the first headers are just files of a root filesystem
+	entries := []tarEntry{}
+	for i := 0; i < imager.IMAGE_PROBE_HEADERS; i++ {
+		entries = append(entries, tarEntry{Name: fmt.Sprintf("usr/share/doc/%d", i), Body: "doc"})
+	}
+	entries = append(entries, tarEntry{Name: imager.DOCKER_MANIFEST, Body: "[]"}, tarEntry{Name: "blobs/data", Body: "data"})
+	rootfs := writeTar(t, entries)
+	small := writeTar(t, []tarEntry{{Name: "etc/"}, {Name: "etc/hostname", Body: "node"}})
+
+	store := imager.NewMetaStore(filepath.Join(dir, "store"))
+	tests := []struct {
+		name string
+		data []byte
+		file string
+	}{
+		{"probe", rootfs, imager.DOCKER_MANIFEST},
+		{"gzip", gzipBytes(t, rootfs), "blobs/data"},
+		{"small", small, "etc/hostname"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fpath := filepath.Join(dir, tt.name+".tar")
+			if err := os.WriteFile(fpath, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			cache := imager.NewImageCache()
+			cache.Store = store
+			req := cache.Request(fpath)
+			<-req.Done()
+			if err := req.Err(); err != nil {
+				t.Fatal(err)
+			}
+			// A flattened root filesystem is identified by the hash of the whole file
+			if want := sha256Digest(tt.data); req.Digest != want {
+				t.Errorf("got digest %s, expected %s", req.Digest, want)
+			}
+			if fm := req.Value().DirMeta().GetFile(tt.file); fm == nil || fm.Size == 0 {
+				t.Errorf("got %+v for %s", fm, tt.file)
+			}
+			stored, err := store.Load(req.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.TreeHash() == "" || stored.TreeHash() != req.Value().TreeHash() {
+				t.Errorf("stored tree hash %s, expected %s", stored.TreeHash(), req.Value().TreeHash())
+			}
+		})
+	}
+}
+
+func TestMetaStore(t *testing.T) {
+	store := imager.NewMetaStore(filepath.Join(t.TempDir(), "store"))
+	for _, digest := range []string{"", "sha256", "../sha256:ab", "sha256:ab/cd"} {
+		if _, err := store.Path(digest); err == nil {
+			t.Errorf("expected an error for '%s'", digest)
+		}
+	}
+	if _, err := store.Load("sha256:ab"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v loading a missing baseline", err)
+	}
+
+	dm := fsdiff.NewDirMeta("")
+	dm.MakeDir("etc").AddFile(&fsdiff.FileMeta{Name: "hostname", Mode: 0644, Size: 4, Hash: strings.Repeat("ab", 32)})
+	dm.UpdateTreeHash()
+	tree := fsdiff.NewCompactTree(dm)
+	if err := store.Save("sha256:ab", tree); err != nil {
+		t.Fatal(err)
+	}
+	fpath, err := store.Path("sha256:ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !imager.IsMetaFile(fpath) {
+		t.Errorf("%s is not a baseline file", fpath)
+	}
+	if imager.IsMetaFile(filepath.Join(store.Dir, "missing")) {
+		t.Error("a missing file can't be a baseline file")
+	}
+	loaded, err := imager.ReadMetaFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.TreeHash() != tree.TreeHash() || loaded.DirMeta().GetFile("etc/hostname") == nil {
+		t.Errorf("got %+v after loading", loaded.DirMeta())
+	}
+	// Only the baseline is left in the store
+	if names, err := os.ReadDir(store.Dir); err != nil || len(names) != 1 {
+		t.Errorf("got %v, %v in the store", names, err)
+	}
+}
@@ -2,7 +2,10 @@ package imager
 
 import (
 	"archive/tar"
-	"os"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
 	"path"
 	"sync"
 
@@ -10,7 +13,7 @@ import (
 	"github.com/bindernews/taki/pkg/task"
 )
 
-// Caches DirMeta objects for base images (tar files).
+// Caches the metadata of base images as CompactTrees (see ImageArchive for supported formats).
 // This way in a batch-processing scenario we're not re-reading
 // the same tar file mulitple times.
 type ImageCache struct {
@@ -19,6 +22,17 @@ type ImageCache struct {
 	// Cache of metadata, both in-progress and completed. In-progress requests
 	// will have Meta = nil, while finished ones will have Meta set.
 	cache map[string]*ImageRequest
+	// Optional on-disk store which is checked before reading an image, and
+	// which newly built baselines are saved to.
+	Store *MetaStore
+	// Platform to use from multi-platform images, see OpenImageArchive
+	Platform *Platform
+}
+
+func NewImageCache() *ImageCache {
+	return &ImageCache{
+		cache: make(map[string]*ImageRequest),
+	}
 }
 
 func (ic *ImageCache) Request(fpath string) *ImageRequest {
@@ -40,28 +54,79 @@ func (ic *ImageCache) Request(fpath string) *ImageRequest {
 
 // The metadata gathering process for the ImageRequest, should be run in a goroutine.
 func (ic *ImageCache) imageGather(req *ImageRequest) any {
-	// Create new builder and meta
-	b := fsdiff.NewDirMetaBuilder(fsdiff.NewDirMeta(""))
-	file, err := os.Open(req.Path)
+	// A baseline file may be given directly instead of an image
+	if IsMetaFile(req.Path) {
+		tree, err := ReadMetaFile(req.Path)
+		if err != nil {
+			return req.Fail(err)
+		}
+		if tree.TreeHash() == "" {
+			dm := tree.DirMeta()
+			dm.UpdateTreeHash()
+			tree = fsdiff.NewCompactTree(dm)
+		}
+		return req.Ok(tree)
+	}
+
+	// Flattened images don't have a manifest, so they're identified by their contents
+	img, err := openImageArchive(req.Path, ic.Platform, true)
 	if err != nil {
 		return req.Fail(err)
 	}
-	defer file.Close()
+	defer img.Close()
+	req.Digest = img.Digest
+	// Check the store before doing all the work
+	if ic.Store != nil {
+		tree, err := ic.Store.Load(req.Digest)
+		if err == nil {
+			return req.Ok(tree)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("ignoring stored baseline for '%s': %s", req.Digest, err)
+		}
+	}
 
-	tr := tar.NewReader(file)
-	if err := b.AddTar(tr); err != nil {
-		return req.Fail(err)
+	// Create new builder and meta, then apply each layer in order. A flattened
+	// image is just a single layer.
+	b := fsdiff.NewDirMetaBuilder(fsdiff.NewDirMeta(""))
+	for i := range img.Layers {
+		if err := addLayer(b, img, i); err != nil {
+			return req.Fail(err)
+		}
+	}
+	// Hashing the subtrees lets the base be sent in parts, see DirMeta.Truncate
+	b.Root.UpdateTreeHash()
+	// Only the compact tree is kept, the builder's tree can be freed
+	tree := fsdiff.NewCompactTree(b.Root)
+	if ic.Store != nil {
+		if err := ic.Store.Save(req.Digest, tree); err != nil {
+			log.Printf("failed to store baseline for '%s': %s", req.Digest, err)
+		}
 	}
 	// Success!
-	return req.Ok(b.Root)
+	return req.Ok(tree)
+}
+
+// Reads layer 'i' of the image into the builder.
+func addLayer(b *fsdiff.DirMetaBuilder, img *ImageArchive, i int) error {
+	rd, err := img.OpenLayer(i)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	if err := b.AddLayer(tar.NewReader(rd)); err != nil {
+		return fmt.Errorf("layer '%s': %w", img.Layers[i], err)
+	}
+	return nil
 }
 
 type ImageRequest struct {
 	*task.BaseTask
 	// Resolved path
 	Path string
+	// Digest identifying the image, empty if a baseline file was given directly
+	Digest string
 }
 
-func (ir *ImageRequest) Value() *fsdiff.DirMeta {
-	return ir.BaseTask.Value().(*fsdiff.DirMeta)
+func (ir *ImageRequest) Value() *fsdiff.CompactTree {
+	return ir.BaseTask.Value().(*fsdiff.CompactTree)
 }
@@ -6,20 +6,29 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
 
+	"github.com/bindernews/taki/pkg/fsdiff"
 	"github.com/bindernews/taki/pkg/rpcfs"
 	"github.com/bindernews/taki/pkg/task"
 	"github.com/bindernews/taki/pkg/tkserver"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 )
 
 const CONTAINER_NAME_PREFIX = "Defaulting debug container name to "
 const taskLocalMeta = "building local metadata"
 const taskGenerateDiff = "generating diff from base image"
+const taskDiffOverlay = "reading overlay upper directory"
+const taskVerifyPackages = "verifying files against package databases"
 const taskTarFiles = "collecting changed files"
 const taskDownload = "downloading archive"
+const taskContentDiff = "comparing modified file contents"
 
 type ImagerConfig struct {
 	// Command that runs 'kubectl'
@@ -32,10 +41,38 @@ type ImagerConfig struct {
 	DebugImage string
 	// List of paths to ignore
 	Ignored []string
+	// Exclude rules, applied to the base image and the container alike
+	Rules *fsdiff.RuleSet
 	// Image cache instance
 	MetaCache *ImageCache
-	// Base image path
+	// Base image path, a flattened root filesystem tar or an image archive. If empty,
+	// the container is checked against its package databases instead.
 	BaseImage string
+	// Number of files the server hashes at once, 0 means one per CPU
+	Workers int
+	// Maximum number of files the server reads at once, 0 means the same as Workers
+	MaxIO int
+	// Extra digests to compute for changed files and list in the archive manifest
+	Digests []fsdiff.HashAlgo
+	// Only hash files whose size, mode or modification time differ from the base
+	// image. Files skipped this way are listed in the archive.
+	Fast bool
+	// Formats to export the diff to, each is written next to the archive
+	Exports []fsdiff.ExportFormat
+	// Diff the upper directory of the container's overlay root instead of comparing
+	// against a base image, which requires node-level access. BaseImage is ignored.
+	Overlay bool
+	// Known-good and known-bad file hashes, changed files are tagged with them
+	HashSet *fsdiff.HashSet
+	// Don't collect added files whose contents are known-good
+	SkipKnownGood bool
+	// Number of base directory levels to send at first, deeper subtrees are only
+	// sent if they differ from the container. 0 sends the whole base at once.
+	BaseDepth int
+	// Largest modified text file to include a unified diff of in the exports, 0
+	// disables text diffs. The base contents are read from BaseImage. Only used
+	// with the patch export.
+	TextDiffSize int64
 }
 
 // Returns a copy of the config with default values set if they weren't already.
@@ -44,7 +81,7 @@ func (c ImagerConfig) Defaults() ImagerConfig {
 		c.DebugImage = "taki-collector"
 	}
 	if c.MetaCache == nil {
-		c.MetaCache = &ImageCache{}
+		c.MetaCache = NewImageCache()
 	}
 	return c
 }
@@ -101,7 +138,10 @@ func (m *Imager) Start() (err error) {
 	// Get pod metadata and verify that container exists, etc. Get image name.
 	// TODO
 	// Get base image and build DirInfo for it. Use cache in case of batch processing.
-	metaReq := m.config.MetaCache.Request(m.config.BaseImage)
+	var metaReq *ImageRequest
+	if m.config.BaseImage != "" && !m.config.Overlay {
+		metaReq = m.config.MetaCache.Request(m.config.BaseImage)
+	}
 	// TODO
 	// Start kubectl debug -it and setup stdio pipes
 	proc := exec.CommandContext(m.ctx, allArgs[0], allArgs[1:]...)
@@ -132,16 +172,18 @@ func (m *Imager) Start() (err error) {
 	mounts := make([]string, 0)
 
 	// Wait for DirMeta to be ready
-	m.currentTask = taskLocalMeta
-	m.setProgress(-1)
-	select {
-	case <-metaReq.Done():
-		err = metaReq.Err()
-	case <-m.ctx.Done():
-		err = m.ctx.Err()
-	}
-	if err != nil {
-		return
+	if metaReq != nil {
+		m.currentTask = taskLocalMeta
+		m.setProgress(-1)
+		select {
+		case <-metaReq.Done():
+			err = metaReq.Err()
+		case <-m.ctx.Done():
+			err = m.ctx.Err()
+		}
+		if err != nil {
+			return
+		}
 	}
 
 	// Set config
@@ -150,20 +192,53 @@ func (m *Imager) Start() (err error) {
 		Output:  OUTPUT_PATH,
 		Root:    possibleRoots[0],
 		Exclude: excludes,
+		Rules:   m.config.Rules.Lines(),
+		Workers: m.config.Workers,
+		MaxIO:   m.config.MaxIO,
+		Digests: m.config.Digests,
+		Fast:    m.config.Fast,
 	}
 	if err = m.client.SetConfig(&conf); err != nil {
 		return
 	}
-	// Have server diff and produce tar
-	m.currentTask = taskGenerateDiff
+	// Have server diff and produce tar. Unless known-good files are left out, the
+	// server collects the changed files while generating the diff.
+	skipKnownGood := m.config.HashSet != nil && m.config.SkipKnownGood
 	m.setProgress(-1)
-	if err = m.client.GenerateDiff(metaReq.Value()); err != nil {
-		return
+	if m.config.Overlay {
+		m.currentTask = taskDiffOverlay
+		if _, err = m.client.DiffOverlay(); err != nil {
+			return
+		}
+	} else if metaReq == nil {
+		m.currentTask = taskVerifyPackages
+		if _, err = m.client.VerifyPackages(); err != nil {
+			return
+		}
+	} else {
+		m.currentTask = taskGenerateDiff
+		// Filtering copies the cached base, which is shared. This also means excluded
+		// entries aren't sent to the server.
+		if err = m.generateDiff(metaReq.Value().Filter(m.config.Rules), !skipKnownGood); err != nil {
+			return
+		}
+	}
+
+	// Tag the diff with the hash sets before collecting, so known-good files can be
+	// left out
+	var diff *fsdiff.FsDiff
+	var skip []string
+	if skipKnownGood {
+		if diff, err = m.client.GetDiff(); err != nil {
+			return
+		}
+		diff.TagHashes(m.config.HashSet)
+		skip = diff.KnownGoodAdded()
 	}
 
 	m.currentTask = taskTarFiles
 	m.setProgress(-1)
-	if err = m.client.TarStart(); err != nil {
+	if err = m.client.TarStart(skip); err != nil {
 		return
 	}
 	// Wait for task to complete
@@ -185,15 +260,167 @@ func (m *Imager) Start() (err error) {
 		return
 	}
 
+	// Write the diff next to the archive. It's fetched again since collecting adds
+	// the ELF reports.
+	if len(m.config.Exports) > 0 {
+		if diff, err = m.client.GetDiff(); err != nil {
+			return
+		}
+		if m.config.HashSet != nil {
+			diff.TagHashes(m.config.HashSet)
+		}
+		// Reading the base and live copies is only worth it for the exports showing them
+		if metaReq != nil && (m.wantExport(fsdiff.FormatConfig) || m.wantExport(fsdiff.FormatPatch)) {
+			m.currentTask = taskContentDiff
+			m.setProgress(-1)
+			if err = m.diffContents(diff, possibleRoots[0]); err != nil {
+				return
+			}
+		}
+		for _, format := range m.config.Exports {
+			// Without hash sets nothing is known-bad
+			if format == fsdiff.FormatKnownBad && m.config.HashSet == nil {
+				continue
+			}
+			if format == fsdiff.FormatElf && diff.ElfPending {
+				log.Printf("ELF triage didn't finish, the %s export may be missing files", format)
+			}
+			if err = m.writeExport(format, diff); err != nil {
+				return
+			}
+		}
+	}
+
 	// Profit!
 	return
 }
 
+// Has the server diff the container against 'base'. The base is sent BaseDepth
+// levels at a time, and only the subtrees the server can't match are sent. If
+// 'collect' is set the changed files are collected meanwhile.
+func (m *Imager) generateDiff(base *fsdiff.CompactTree, collect bool) error {
+	depth := m.config.BaseDepth
+	pending, err := m.client.GenerateDiff(base.Truncate(depth), collect)
+	for err == nil && len(pending) > 0 {
+		fpath := pending[0]
+		pending = pending[1:]
+		sub := base.Subtree(fpath)
+		if sub == nil {
+			return fmt.Errorf("server requested unknown base directory '%s'", fpath)
+		}
+		var more []string
+		more, err = m.client.GenerateDiffAt(fpath, sub.Truncate(depth))
+		pending = append(pending, more...)
+	}
+	return err
+}
+
+// Attaches record-level changes to the modified config files in 'diff' (see
+// fsdiff.DiffConfig) and unified diffs to modified text files up to TextDiffSize,
+// reading the base copies from the base image and the live ones from the container
+// root at 'root'. Nothing is done for baseline files, which don't hold any contents.
+func (m *Imager) diffContents(diff *fsdiff.FsDiff, root string) error {
+	maxSize := m.config.TextDiffSize
+	if maxSize < fsdiff.MAX_CONFIG_SIZE {
+		maxSize = fsdiff.MAX_CONFIG_SIZE
+	}
+	entries := make(map[string]*fsdiff.DiffEntry)
+	for _, e := range diff.Entries {
+		if e.Kind != fsdiff.Modified || e.Type() != fsdiff.TypeFile {
+			continue
+		}
+		if fsdiff.IsConfigFile(e.Path) || m.wantTextDiff(e.Old.Size, e.New.Size) {
+			entries[e.Path] = e
+		}
+	}
+	if len(entries) == 0 || IsMetaFile(m.config.BaseImage) {
+		return nil
+	}
+	img, err := OpenImageArchive(m.config.BaseImage, m.config.MetaCache.Platform)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	base, err := img.ReadFiles(maps.Keys(entries), maxSize)
+	if err != nil {
+		return err
+	}
+	for fpath, e := range entries {
+		old, ok := base[fpath]
+		if !ok {
+			continue
+		}
+		live, err := m.readRemoteFile(path.Join(root, fpath), maxSize)
+		if err != nil {
+			log.Printf("skipping content diff of '%s': %s", fpath, err)
+			continue
+		}
+		if int64(len(old)) <= fsdiff.MAX_CONFIG_SIZE && int64(len(live)) <= fsdiff.MAX_CONFIG_SIZE {
+			e.Config = fsdiff.DiffConfig(fpath, old, live)
+		}
+		if m.wantTextDiff(int64(len(old)), int64(len(live))) && fsdiff.IsText(old) && fsdiff.IsText(live) {
+			e.TextDiff = fsdiff.UnifiedDiff(fpath, old, live)
+		}
+	}
+	return nil
+}
+
+// Returns true if a modified file of these sizes is small enough for a text diff,
+// and the patch export which shows them was requested.
+func (m *Imager) wantTextDiff(oldSize, newSize int64) bool {
+	limit := m.config.TextDiffSize
+	return limit > 0 && oldSize <= limit && newSize <= limit && m.wantExport(fsdiff.FormatPatch)
+}
+
+// Returns true if the diff is exported to 'format'.
+func (m *Imager) wantExport(format fsdiff.ExportFormat) bool {
+	return slices.Contains(m.config.Exports, format)
+}
+
+// Reads a whole file from the remote, failing if it's larger than 'maxSize'.
+func (m *Imager) readRemoteFile(fpath string, maxSize int64) ([]byte, error) {
+	src, err := m.rfs.OpenRead(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	data, err := io.ReadAll(io.LimitReader(src, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("file is larger than %d bytes", maxSize)
+	}
+	return data, nil
+}
+
 // Returns the tar file that will be created
 func (m *Imager) GetOutputName() string {
 	return fmt.Sprintf("%s_%s.tar.xz", m.config.Pod, m.config.Container)
 }
 
+// Returns the name of the diff export in the given format
+func (m *Imager) GetExportName(format fsdiff.ExportFormat) string {
+	return fmt.Sprintf("%s_%s.diff%s", m.config.Pod, m.config.Container, format.Ext())
+}
+
+// Writes the diff to a file in the given format
+func (m *Imager) writeExport(format fsdiff.ExportFormat, diff *fsdiff.FsDiff) error {
+	file, err := os.Create(m.GetExportName(format))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	wr := bufio.NewWriter(file)
+	if err := format.Write(wr, diff); err != nil {
+		return err
+	}
+	if err := wr.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
 // Close the update channel so the imager does not block.
 func (m *Imager) CloseUpdates() {
 	close(m.updateC)
@@ -0,0 +1,113 @@
+package imager
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/bindernews/taki/pkg/fsdiff"
+)
+
+// File extension of stored baselines
+const META_FILE_EXT = ".takimeta"
+
+// Digests are used as file names, so only allow safe characters
+var digestPattern = regexp.MustCompile(`^[a-zA-Z0-9]+:[a-zA-Z0-9]+$`)
+
+// On-disk store of base image metadata, keyed by image digest. Baselines may be
+// built ahead of time and shared by copying the files in the store directory.
+type MetaStore struct {
+	// Directory the baselines are stored in
+	Dir string
+}
+
+func NewMetaStore(dir string) *MetaStore {
+	return &MetaStore{Dir: dir}
+}
+
+// Returns the default store directory inside the user's cache directory.
+func DefaultMetaStoreDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "taki", "baselines"), nil
+}
+
+// Returns the path of the baseline for 'digest'.
+func (s *MetaStore) Path(digest string) (string, error) {
+	if !digestPattern.MatchString(digest) {
+		return "", fmt.Errorf("invalid image digest '%s'", digest)
+	}
+	return filepath.Join(s.Dir, strings.Replace(digest, ":", "_", 1)+META_FILE_EXT), nil
+}
+
+// Loads the baseline for 'digest'. If there is none the error satisfies
+// errors.Is(err, fs.ErrNotExist).
+func (s *MetaStore) Load(digest string) (*fsdiff.CompactTree, error) {
+	fpath, err := s.Path(digest)
+	if err != nil {
+		return nil, err
+	}
+	return ReadMetaFile(fpath)
+}
+
+// Stores the baseline for 'digest', replacing any existing one.
+func (s *MetaStore) Save(digest string, t *fsdiff.CompactTree) (err error) {
+	var fpath string
+	var file *os.File
+	if fpath, err = s.Path(digest); err != nil {
+		return
+	}
+	if err = os.MkdirAll(s.Dir, 0755); err != nil {
+		return
+	}
+	// Write to a temporary file first so readers never see a partial baseline
+	if file, err = os.CreateTemp(s.Dir, "tmp-*"+META_FILE_EXT); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+	wr := bufio.NewWriter(file)
+	if err = fsdiff.WriteCompactTree(wr, t); err != nil {
+		return
+	}
+	if err = wr.Flush(); err != nil {
+		return
+	}
+	// Temporary files are private, but baselines are meant to be shared
+	if err = file.Chmod(0644); err != nil {
+		return
+	}
+	if err = file.Close(); err != nil {
+		return
+	}
+	return os.Rename(file.Name(), fpath)
+}
+
+// Reads a baseline file written by MetaStore or fsdiff.WriteDirMeta.
+func ReadMetaFile(fpath string) (*fsdiff.CompactTree, error) {
+	file, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return fsdiff.ReadCompactTree(bufio.NewReader(file))
+}
+
+// Returns true if the file at 'fpath' is a baseline file rather than an image.
+func IsMetaFile(fpath string) bool {
+	file, err := os.Open(fpath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	return fsdiff.IsMetaFile(bufio.NewReader(file))
+}
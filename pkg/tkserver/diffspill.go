@@ -0,0 +1,84 @@
+package tkserver
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/bindernews/taki/pkg/fsdiff"
+)
+
+// Changes of a diff, written to a temporary file as they're found so the server
+// doesn't keep them in memory while the target is walked. Entries are gob-encoded
+// one after the other.
+type diffSpill struct {
+	file *os.File
+	w    *bufio.Writer
+	enc  *gob.Encoder
+	// Number of entries written
+	count int
+}
+
+func newDiffSpill() (*diffSpill, error) {
+	file, err := os.CreateTemp("", "taki-diff-*")
+	if err != nil {
+		return nil, err
+	}
+	s := &diffSpill{file: file, w: bufio.NewWriter(file)}
+	s.enc = gob.NewEncoder(s.w)
+	return s, nil
+}
+
+// Appends 'e' to the spill. This is a fsdiff.DiffFunc.
+func (s *diffSpill) add(e *fsdiff.DiffEntry) error {
+	if err := s.enc.Encode(e); err != nil {
+		return err
+	}
+	s.count++
+	return nil
+}
+
+// Calls fn with each entry, in the order they were added. Returning an error stops
+// the iteration.
+func (s *diffSpill) each(fn fsdiff.DiffFunc) error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	// Read through a separate handle, so more entries can be added meanwhile
+	file, err := os.Open(s.file.Name())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dec := gob.NewDecoder(bufio.NewReader(file))
+	for i := 0; i < s.count; i++ {
+		e := &fsdiff.DiffEntry{}
+		if err := dec.Decode(e); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads the whole diff into memory.
+func (s *diffSpill) load() (*fsdiff.FsDiff, error) {
+	d := fsdiff.NewFsDiff()
+	if err := s.each(d.Add); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Closes and deletes the spill.
+func (s *diffSpill) remove() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
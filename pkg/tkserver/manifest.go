@@ -0,0 +1,79 @@
+package tkserver
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+
+	"github.com/bindernews/taki/pkg/fsdiff"
+	"golang.org/x/exp/slices"
+)
+
+// Name of the manifest added to the root of the archive
+const MANIFEST_NAME = "taki-manifest.tsv"
+
+// Name of the list of files that fast mode didn't hash, added to the root of the archive
+const UNHASHED_NAME = "taki-unhashed.txt"
+
+// Writes a tab-separated manifest listing each collected file with its size, the
+// first path of its hard link group (if any), and every digest that was computed,
+// starting with the primary one. 'metas' holds the metadata for each file in 'files',
+// and may contain nil for unknown files.
+func WriteManifest(w io.Writer, files []string, metas []*fsdiff.FileMeta, digests []fsdiff.HashAlgo) error {
+	mw, err := newManifestWriter(w, digests)
+	if err != nil {
+		return err
+	}
+	for i, file := range files {
+		if err := mw.write(file, metas[i]); err != nil {
+			return err
+		}
+	}
+	return mw.flush()
+}
+
+// Writes the manifest one file at a time, see WriteManifest.
+type manifestWriter struct {
+	cw    *csv.Writer
+	algos []fsdiff.HashAlgo
+}
+
+// Writes the header of the manifest to 'w'.
+func newManifestWriter(w io.Writer, digests []fsdiff.HashAlgo) (*manifestWriter, error) {
+	algos := []fsdiff.HashAlgo{fsdiff.PRIMARY_HASH}
+	for _, algo := range digests {
+		if !slices.Contains(algos, algo) {
+			algos = append(algos, algo)
+		}
+	}
+	cw := csv.NewWriter(w)
+	cw.Comma = '\t'
+	header := []string{"path", "size", "hardlink"}
+	for _, algo := range algos {
+		header = append(header, string(algo))
+	}
+	if err := cw.Write(header); err != nil {
+		return nil, err
+	}
+	return &manifestWriter{cw: cw, algos: algos}, nil
+}
+
+// Writes the row of 'file', 'fm' may be nil if the metadata is unknown.
+func (mw *manifestWriter) write(file string, fm *fsdiff.FileMeta) error {
+	row := []string{file, "", ""}
+	if fm != nil {
+		row[1] = strconv.FormatInt(fm.Size, 10)
+		row[2] = fm.HardLink
+		for _, algo := range mw.algos {
+			row = append(row, fm.Digest(algo))
+		}
+	} else {
+		row = append(row, make([]string, len(mw.algos))...)
+	}
+	return mw.cw.Write(row)
+}
+
+func (mw *manifestWriter) flush() error {
+	mw.cw.Flush()
+	return mw.cw.Error()
+}
@@ -0,0 +1,159 @@
+package tkserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// One line of /proc/<pid>/mountinfo
+type MountInfo struct {
+	// Mount point, relative to the process's root
+	MountPoint string
+	// Filesystem type, e.g. "overlay"
+	FsType string
+	// Mount source, e.g. "/dev/sda1"
+	Source string
+	// Filesystem specific options, e.g. "lowerdir=...,upperdir=..."
+	SuperOptions string
+}
+
+// Parses a mountinfo file, see proc(5).
+func ParseMountInfo(r io.Reader) ([]MountInfo, error) {
+	mounts := make([]MountInfo, 0)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Fields(scanner.Text())
+		// Optional fields end with a lone "-"
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || len(fields) < sep+3 {
+			return nil, fmt.Errorf("mountinfo line %d: invalid format", lineNo)
+		}
+		m := MountInfo{MountPoint: unescapeMount(fields[4])}
+		m.FsType = fields[sep+1]
+		m.Source = unescapeMount(fields[sep+2])
+		if len(fields) > sep+3 {
+			m.SuperOptions = fields[sep+3]
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, scanner.Err()
+}
+
+// Decodes the octal escapes (e.g. "\040" for a space) the kernel uses in mountinfo.
+func unescapeMount(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				sb.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// Returns the value of a filesystem option.
+func (m *MountInfo) Option(name string) (string, bool) {
+	// Commas within values are octal escaped, so they can't be confused
+	for _, opt := range strings.Split(m.SuperOptions, ",") {
+		if key, value, _ := strings.Cut(opt, "="); key == name {
+			return unescapeMount(value), true
+		}
+	}
+	return "", false
+}
+
+// Returns the upper directory and the lower directories (top to bottom) of an
+// overlay mount.
+func (m *MountInfo) OverlayDirs() (upper string, lowers []string, err error) {
+	if m.FsType != "overlay" {
+		return "", nil, fmt.Errorf("%s is %s, not overlay", m.MountPoint, m.FsType)
+	}
+	var ok bool
+	if upper, ok = m.Option("upperdir"); !ok {
+		return "", nil, errors.New("overlay has no upperdir")
+	}
+	lowerOpt, _ := m.Option("lowerdir")
+	for _, dir := range splitEscaped(lowerOpt, ':') {
+		// Data-only layers follow "::" and only hold file contents
+		if dir == "" {
+			break
+		}
+		lowers = append(lowers, strings.ReplaceAll(dir, "\\:", ":"))
+	}
+	return
+}
+
+// Splits 's' at each 'sep' that isn't preceded by a backslash.
+func splitEscaped(s string, sep byte) []string {
+	parts := make([]string, 0)
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+		} else if s[i] == sep {
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Finds the overlay mounted at the root of the process whose root is 'root'
+// (/proc/<pid>/root), and returns its upper and lower directories as paths this
+// process can reach. The directories are paths on the node, so they're only
+// reachable if the server shares the node's mount namespace or can see the node's
+// root through /proc/1/root.
+func findOverlay(root string) (upper string, lowers []string, err error) {
+	file, err := os.Open(filepath.Join(filepath.Dir(root), "mountinfo"))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	var mounts []MountInfo
+	if mounts, err = ParseMountInfo(file); err != nil {
+		return
+	}
+	var rootMount *MountInfo
+	for i := range mounts {
+		// Later mounts hide earlier ones
+		if mounts[i].MountPoint == "/" {
+			rootMount = &mounts[i]
+		}
+	}
+	if rootMount == nil {
+		return "", nil, errors.New("root mount not found")
+	}
+	if upper, lowers, err = rootMount.OverlayDirs(); err != nil {
+		return
+	}
+	for _, prefix := range []string{"/", "/proc/1/root"} {
+		dir := filepath.Join(prefix, upper)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		for i := range lowers {
+			lowers[i] = filepath.Join(prefix, lowers[i])
+		}
+		return dir, lowers, nil
+	}
+	return "", nil, fmt.Errorf("overlay upperdir '%s' is not reachable, the server must run with access to the node's filesystem", upper)
+}
@@ -0,0 +1,140 @@
+package tkserver
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// From /proc/<pid>/mountinfo of a containerd container
+const containerdMountInfo = `1398 1320 0:190 / / rw,relatime master:435 - overlay overlay rw,lowerdir=/var/lib/containerd/io.containerd.snapshotter.v1.overlayfs/snapshots/312/fs:/var/lib/containerd/io.containerd.snapshotter.v1.overlayfs/snapshots/311/fs,upperdir=/var/lib/containerd/io.containerd.snapshotter.v1.overlayfs/snapshots/318/fs,workdir=/var/lib/containerd/io.containerd.snapshotter.v1.overlayfs/snapshots/318/work
+1399 1398 0:192 / /proc rw,nosuid,nodev,noexec,relatime - proc proc rw
+1400 1398 0:193 / /dev rw,nosuid - tmpfs tmpfs rw,size=65536k,mode=755
+1411 1398 259:1 /var/lib/kubelet/pods/9c1f/volumes/kubernetes.io~empty-dir/cache /data/my\040cache rw,relatime - ext4 /dev/nvme0n1p1 rw,discard
+`
+
+// From /proc/<pid>/mountinfo of a CRI-O container, the SELinux context has commas
+const crioMountInfo = `3095 2890 0:287 / / rw,relatime - overlay overlay rw,context="system_u:object_r:container_file_t:s0:c123,c456",lowerdir=/var/lib/containers/storage/overlay/l/Q6PHZW5ZJ7J2:/var/lib/containers/storage/overlay/l/KXR6LKF3ZQYO,upperdir=/var/lib/containers/storage/overlay/5b1e6c0d/diff,workdir=/var/lib/containers/storage/overlay/5b1e6c0d/work,metacopy=on
+3096 3095 0:290 / /proc rw,nosuid,nodev,noexec,relatime shared:1402 - proc proc rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, err := ParseMountInfo(strings.NewReader(containerdMountInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 4 {
+		t.Fatalf("expected 4 mounts, got %d", len(mounts))
+	}
+	if m := mounts[0]; m.MountPoint != "/" || m.FsType != "overlay" || m.Source != "overlay" {
+		t.Errorf("wrong root mount %+v", m)
+	}
+	if m := mounts[3]; m.MountPoint != "/data/my cache" || m.FsType != "ext4" || m.Source != "/dev/nvme0n1p1" {
+		t.Errorf("wrong volume mount %+v", m)
+	}
+
+	mounts, err = ParseMountInfo(strings.NewReader(crioMountInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := mounts[1]; m.MountPoint != "/proc" || m.FsType != "proc" {
+		t.Errorf("wrong mount after optional fields %+v", m)
+	}
+	if _, err := ParseMountInfo(strings.NewReader("1398 1320 0:190 / / rw,relatime overlay\n")); err == nil {
+		t.Error("expected an error for a line without a separator")
+	}
+}
+
+func TestOverlayDirs(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		upper  string
+		lowers []string
+	}{
+		{
+			name:  "containerd",
+			line:  strings.Split(containerdMountInfo, "\n")[0],
+			upper: "/var/lib/containerd/io.containerd.snapshotter.v1.overlayfs/snapshots/318/fs",
+			lowers: []string{
+				"/var/lib/containerd/io.containerd.snapshotter.v1.overlayfs/snapshots/312/fs",
+				"/var/lib/containerd/io.containerd.snapshotter.v1.overlayfs/snapshots/311/fs",
+			},
+		},
+		{
+			name:   "cri-o",
+			line:   strings.Split(crioMountInfo, "\n")[0],
+			upper:  "/var/lib/containers/storage/overlay/5b1e6c0d/diff",
+			lowers: []string{"/var/lib/containers/storage/overlay/l/Q6PHZW5ZJ7J2", "/var/lib/containers/storage/overlay/l/KXR6LKF3ZQYO"},
+		},
+		{
+			// The kernel escapes the backslash of an escaped ':' as \134
+			name:   "escaped colon",
+			line:   `1 0 0:1 / / rw - overlay overlay rw,lowerdir=/layers/a\134:b:/layers/c,upperdir=/upper,workdir=/work`,
+			upper:  "/upper",
+			lowers: []string{"/layers/a:b", "/layers/c"},
+		},
+		{
+			name:   "data-only layers",
+			line:   `1 0 0:1 / / rw - overlay overlay rw,lowerdir=/layers/a:/layers/b::/data/1::/data/2,upperdir=/upper,workdir=/work,redirect_dir=on,metacopy=on`,
+			upper:  "/upper",
+			lowers: []string{"/layers/a", "/layers/b"},
+		},
+	}
+	for _, tt := range tests {
+		mounts, err := ParseMountInfo(strings.NewReader(tt.line))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		upper, lowers, err := mounts[0].OverlayDirs()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if upper != tt.upper || !reflect.DeepEqual(lowers, tt.lowers) {
+			t.Errorf("%s: got %s %v, expected %s %v", tt.name, upper, lowers, tt.upper, tt.lowers)
+		}
+	}
+
+	mounts, _ := ParseMountInfo(strings.NewReader(containerdMountInfo))
+	if _, _, err := mounts[1].OverlayDirs(); err == nil {
+		t.Error("expected an error for a proc mount")
+	}
+}
+
+func TestFindOverlay(t *testing.T) {
+	dir := t.TempDir()
+	upper := filepath.Join(dir, "snapshots/318/fs")
+	if err := os.MkdirAll(upper, 0755); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "proc/1234/root")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A later mount on / hides the first one
+	mountinfo := "1 0 0:1 / / rw - ext4 /dev/sda1 rw\n" +
+		"1398 1 0:190 / / rw,relatime master:435 - overlay overlay rw,lowerdir=" + dir + "/snapshots/312/fs:" +
+		dir + "/snapshots/311/fs,upperdir=" + upper + ",workdir=" + dir + "/snapshots/318/work\n"
+	if err := os.WriteFile(filepath.Join(dir, "proc/1234/mountinfo"), []byte(mountinfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gotUpper, lowers, err := findOverlay(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLowers := []string{dir + "/snapshots/312/fs", dir + "/snapshots/311/fs"}
+	if gotUpper != upper || !reflect.DeepEqual(lowers, wantLowers) {
+		t.Errorf("got %s %v, expected %s %v", gotUpper, lowers, upper, wantLowers)
+	}
+
+	// The upper directory isn't reachable from here
+	if err := os.RemoveAll(upper); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := findOverlay(root); err == nil {
+		t.Error("expected an error for an unreachable upperdir")
+	}
+}
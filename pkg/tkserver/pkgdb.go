@@ -0,0 +1,40 @@
+package tkserver
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/bindernews/taki/pkg/fsdiff"
+)
+
+// Locations of the rpm database, relative to the root
+var rpmDbPaths = []string{"var/lib/rpm", "usr/lib/sysimage/rpm"}
+
+// Reads the package databases under 'root'. The rpm database is read with the rpm
+// tool, which must be installed in the debug container.
+func readPackageDB(root string) (*fsdiff.PackageDB, error) {
+	db, err := fsdiff.ReadPackageDB(fsdiff.NewOsFS(root))
+	if err != nil {
+		return nil, err
+	}
+	for _, dbPath := range rpmDbPaths {
+		if _, err := os.Stat(filepath.Join(root, dbPath)); err != nil {
+			continue
+		}
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command("rpm", "--root", root, "--dbpath", "/"+dbPath,
+			"-qa", "--qf", fsdiff.RPM_QUERY_FORMAT)
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("rpm: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		if err := db.ReadRpm(&stdout); err != nil {
+			return nil, fmt.Errorf("rpm: %w", err)
+		}
+		break
+	}
+	return db, nil
+}
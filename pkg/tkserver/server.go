@@ -1,26 +1,34 @@
 package tkserver
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime"
 
 	"github.com/bindernews/taki/pkg/fsdiff"
-	"github.com/bindernews/taki/pkg/task"
-	"github.com/samber/lo"
 )
 
 const TAKI_SERVER_CLASS = "TakiServer"
 
 type TakiServer struct {
 	cfg *ServerConfig
-	// Generated diff
-	fdiff *fsdiff.FsDiff
-	// Root of collected metadata
-	rootMeta *fsdiff.DirMeta
-	// Tar task
+	// Changes of the generated diff, kept on disk
+	spill *diffSpill
+	// Base tree the diff was generated from, with all subtrees received so far
+	base *baseParts
+	// Builder for the current diff, kept so hard link groups span all requests
+	builder *fsdiff.DirMetaBuilder
+	// Files the current diff didn't hash in fast mode, nil if it isn't enabled
+	unhashed *unhashedList
+	// True once moves have been detected, which requires the whole diff
+	diffDone bool
+	// Tar task, started with the diff if GenerateDiffReq.Collect was set
 	tarTask *TarTask
 }
 
@@ -57,55 +65,324 @@ func (s *TakiServer) GetRoots(req Empty, res *GetRootsRes) (err error) {
 	return nil
 }
 
-func (s *TakiServer) GenerateDiff(req *GenerateDiffReq, res *Empty) (err error) {
+func (s *TakiServer) GenerateDiff(req *GenerateDiffReq, res *GenerateDiffRes) (err error) {
 	if s.cfg == nil {
 		return errors.New("config is not set")
 	}
+	if req.Base == nil {
+		return errors.New("base is missing")
+	}
+	fsys := fsdiff.NewOsFS(s.cfg.Root)
+	if req.Path == "" {
+		if err = s.newDiff(); err != nil {
+			return
+		}
+		s.base = &baseParts{root: req.Base, subtrees: make(map[string]*fsdiff.CompactTree)}
+		s.diffDone = false
+		if req.Collect {
+			s.startTar(nil)
+		}
+	} else if s.spill == nil || s.diffDone || s.base == nil {
+		return errors.New("diff has not been started")
+	} else {
+		s.base.subtrees[req.Path] = req.Base
+	}
+
+	// Stream the comparison, the changes are written to disk as they're found
+	b := s.builder
+	b.Pending = nil
+	if err = fsdiff.CompareCompactFsAt(req.Base, fsys, req.Path, b, s.addEntry); err != nil {
+		if s.tarTask != nil {
+			s.tarTask.Abort(err)
+		}
+		return
+	}
+	res.Pending = b.Pending
+	return
+}
+
+// Generates a diff without a base image, by checking the files in the root against
+// the package databases found there. Packaged files that differ are modified and
+// files no package owns are added, see fsdiff.VerifyPackages.
+func (s *TakiServer) VerifyPackages(req Empty, res *VerifyPackagesRes) (err error) {
+	if s.cfg == nil {
+		return errors.New("config is not set")
+	}
+	var db *fsdiff.PackageDB
+	if db, err = readPackageDB(s.cfg.Root); err != nil {
+		return
+	}
+	if len(db.Sources) == 0 {
+		return errors.New("no dpkg, apk or rpm package database found")
+	}
+	if err = s.newDiff(); err != nil {
+		return
+	}
+	s.base = nil
+	// Without a base there's nothing to detect moves against
+	s.diffDone = true
+	fsys := fsdiff.NewOsFS(s.cfg.Root)
+	if err = fsdiff.VerifyPackages(db, fsys, s.builder, s.addEntry); err != nil {
+		return
+	}
+	res.Sources = db.Sources
+	return
+}
+
+// Generates a diff without a base image, from the upper directory of the overlay
+// filesystem the target's root is mounted from. Only works if the server can reach
+// the node's filesystem, see findOverlay.
+func (s *TakiServer) DiffOverlay(req Empty, res *DiffOverlayRes) (err error) {
+	if s.cfg == nil {
+		return errors.New("config is not set")
+	}
+	if res.Upper, res.Lowers, err = findOverlay(s.cfg.Root); err != nil {
+		return
+	}
+	if err = s.newDiff(); err != nil {
+		return
+	}
+	// Renamed files are detected as moves once the diff is done, see finishDiff
+	s.base = nil
+	s.diffDone = false
+	lowers := make([]fs.FS, len(res.Lowers))
+	for i, dir := range res.Lowers {
+		lowers[i] = fsdiff.NewOsFS(dir)
+	}
+	return fsdiff.CompareOverlay(fsdiff.NewOsFS(res.Upper), lowers, s.builder, s.addEntry)
+}
+
+// Starts a new diff, removing the changes of the previous one and stopping its
+// collection if it never finished.
+func (s *TakiServer) newDiff() (err error) {
+	if s.spill != nil {
+		s.spill.remove()
+		s.spill = nil
+	}
+	if s.tarTask != nil {
+		s.tarTask.Abort(errors.New("a new diff was started"))
+		s.tarTask = nil
+	}
+	if s.builder, err = s.newBuilder(); err != nil {
+		return
+	}
+	s.spill, err = newDiffSpill()
+	return
+}
 
-	s.rootMeta = fsdiff.NewDirMeta("")
-	b := fsdiff.NewDirMetaBuilder(s.rootMeta)
-	if err = b.AddFs(os.DirFS(s.cfg.Root)); err != nil {
+// Records a change of the current diff, and collects it right away if the tar task
+// was started with the diff.
+func (s *TakiServer) addEntry(e *fsdiff.DiffEntry) error {
+	if err := s.spill.add(e); err != nil {
 		return err
 	}
-	s.fdiff = fsdiff.NewFsDiff()
-	if err = s.fdiff.Compare(req.Base, s.rootMeta); err != nil {
+	if s.tarTask != nil {
+		return s.tarTask.Add(e)
+	}
+	return nil
+}
+
+// Creates the builder used to collect live metadata, from the config. This starts a
+// new diff, so the list of unhashed files of the previous one is removed.
+func (s *TakiServer) newBuilder() (b *fsdiff.DirMetaBuilder, err error) {
+	if s.unhashed != nil {
+		s.unhashed.remove()
+		s.unhashed = nil
+	}
+	b = fsdiff.NewDirMetaBuilder(nil)
+	b.Excludes = s.cfg.Exclude
+	if b.Rules, err = fsdiff.ParseRuleLines(s.cfg.Rules); err != nil {
 		return
 	}
+	b.Workers = s.cfg.Workers
+	if b.Workers < 1 {
+		b.Workers = runtime.NumCPU()
+	}
+	b.MaxIO = s.cfg.MaxIO
+	b.Digests = s.cfg.Digests
+	b.Fast = s.cfg.Fast
+	if b.Fast {
+		if s.unhashed, err = newUnhashedList(); err != nil {
+			return
+		}
+		b.UnhashedList = s.unhashed
+	}
 	return
 }
 
-// Start collecting files into an archive
-func (s *TakiServer) TarStart(req Empty, res *Empty) error {
-	// Get the files and their corresponding sizes
-	files := s.fdiff.GetAddedModified()
-	sizes := lo.Map(files, func(path string, _ int) int64 {
-		fm := s.rootMeta.GetFile(path)
-		if fm == nil {
-			return 0
-		} else {
-			return fm.Size
+// List of the files fast mode didn't hash, written to a temporary file as they're
+// found instead of being kept in memory. The file is named UNHASHED_NAME so it can
+// be added to the archive as it is.
+type unhashedList struct {
+	*bufio.Writer
+	file *os.File
+}
+
+func newUnhashedList() (*unhashedList, error) {
+	dir, err := os.MkdirTemp("", "taki-unhashed-*")
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Create(filepath.Join(dir, UNHASHED_NAME))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	l := &unhashedList{Writer: bufio.NewWriter(file), file: file}
+	fmt.Fprintln(l, "# Not hashed in fast mode: their size, mode and modification time matched the base image")
+	return l, nil
+}
+
+// Closes and deletes the list.
+func (l *unhashedList) remove() {
+	l.file.Close()
+	os.RemoveAll(filepath.Dir(l.file.Name()))
+}
+
+// The parts of a base tree received by GenerateDiff, kept as they were sent. Each
+// subtree fills in a partial directory of the root or of another subtree.
+type baseParts struct {
+	root *fsdiff.CompactTree
+	// Subtrees by their path
+	subtrees map[string]*fsdiff.CompactTree
+}
+
+// Implement fsdiff.FileFinder.FindFiles
+func (p *baseParts) FindFiles(hashes map[string]bool, fn func(fpath string, fm *fsdiff.FileMeta)) {
+	p.root.FindFiles(hashes, fn)
+	for dir, sub := range p.subtrees {
+		prefix := dir
+		sub.FindFiles(hashes, func(fpath string, fm *fsdiff.FileMeta) {
+			fn(path.Join(prefix, fpath), fm)
+		})
+	}
+}
+
+// Finishes the diff once all parts of the base have been compared. Detecting moves
+// needs the whole diff, so it's read into memory for as long as that takes.
+func (s *TakiServer) finishDiff() error {
+	if s.diffDone {
+		return nil
+	}
+	d, err := s.spill.load()
+	if err != nil {
+		return err
+	}
+	// The lower layers of an overlay aren't searched for copies
+	var base fsdiff.FileFinder = fsdiff.NewDirMeta("")
+	if s.base != nil {
+		base = s.base
+	}
+	d.DetectMoves(base)
+	spill, err := newDiffSpill()
+	if err != nil {
+		return err
+	}
+	for _, e := range d.Entries {
+		if err := spill.add(e); err != nil {
+			spill.remove()
+			return err
 		}
-	})
+	}
+	s.spill.remove()
+	s.spill = spill
+	s.diffDone = true
+	return nil
+}
 
-	s.tarTask = &TarTask{
-		BaseTask:  task.NewBaseTask(),
-		Output:    s.cfg.Output,
-		Root:      s.cfg.Root,
-		Files:     files,
-		FileSizes: sizes,
+// Get the diff generated by GenerateDiff, with the metadata of each change. It's
+// read into memory only for as long as it takes to send it. Once TarStart was
+// called this waits for the ELF triage, otherwise the diff is marked ElfPending.
+func (s *TakiServer) GetDiff(req Empty, res *fsdiff.FsDiff) error {
+	if s.spill == nil {
+		return errors.New("diff has not been generated")
 	}
-	go s.tarTask.Run(context.Background())
+	if err := s.finishDiff(); err != nil {
+		return err
+	}
+	d, err := s.spill.load()
+	if err != nil {
+		return err
+	}
+	if s.tarTask != nil {
+		d.ElfPending = !s.tarTask.WaitTriage()
+		for _, e := range d.Entries {
+			if e.MayBeElf() {
+				e.Elf = s.tarTask.ElfReport(e.Path)
+			}
+		}
+	}
+	d.UnhashedCount = s.builder.UnhashedCount
+	*res = *d
+	return nil
+}
+
+// Start collecting files into an archive. If the collection was started with the
+// diff this only finishes it, and nothing can be skipped.
+func (s *TakiServer) TarStart(req *TarStartReq, res *Empty) error {
+	if s.spill == nil {
+		return errors.New("diff has not been generated")
+	}
+	if err := s.finishDiff(); err != nil {
+		return err
+	}
+	var unhashed string
+	if s.unhashed != nil && s.builder.UnhashedCount > 0 {
+		if err := s.unhashed.Flush(); err != nil {
+			return err
+		}
+		unhashed = s.unhashed.file.Name()
+	}
+	if s.tarTask != nil {
+		if len(req.Skip) > 0 {
+			return errors.New("files can't be skipped, they were collected with the diff")
+		}
+		s.tarTask.Finish(unhashed)
+		return nil
+	}
+
+	skip := make(map[string]bool, len(req.Skip))
+	for _, fpath := range req.Skip {
+		skip[fpath] = true
+	}
+	s.startTar(skip)
+	// Feed the changes from disk, at the pace tar collects them
+	tt, spill := s.tarTask, s.spill
+	go func() {
+		if err := spill.each(tt.Add); err != nil {
+			tt.Abort(err)
+			return
+		}
+		tt.Finish(unhashed)
+	}()
 	return nil
 }
 
-// Get the progress of the tar task
+// Starts the tar task, which collects the changes as they're added to it.
+func (s *TakiServer) startTar(skip map[string]bool) {
+	s.tarTask = NewTarTask(s.cfg.Output, s.cfg.Root)
+	s.tarTask.Digests = s.cfg.Digests
+	s.tarTask.Skip = skip
+	s.tarTask.Workers = s.builder.Workers
+	// Targets that match are never skipped, they aren't part of the diff
+	s.tarTask.MatchedLink = s.builder.MatchedLink
+	go s.tarTask.Run(context.Background())
+}
+
+// Get the progress of the tar task, or its error if it failed
 func (s *TakiServer) TarProgress(req Empty, res *float64) error {
 	if s.tarTask == nil {
 		return ErrTaskNotStarted
-	} else {
-		*res = s.tarTask.GetProgress()
-		return nil
 	}
+	select {
+	case <-s.tarTask.Done():
+		if err := s.tarTask.Err(); err != nil {
+			return err
+		}
+	default:
+	}
+	*res = s.tarTask.GetProgress()
+	return nil
 }
 
 func (s *TakiServer) SetConfig(config *ServerConfig, res *bool) error {
@@ -25,7 +25,41 @@ type GetRootsRes struct {
 }
 
 type GenerateDiffReq struct {
-	Base *fsdiff.DirMeta
+	// Base tree, which may be partial (see fsdiff.DirMeta.Truncate). It's sent in
+	// compact form, which is much faster to encode.
+	Base *fsdiff.CompactTree
+	// Empty to start a new diff. Otherwise Base is the subtree at this path, which
+	// was listed in GenerateDiffRes.Pending, and the changes in it are added to the
+	// current diff.
+	Path string
+	// Start collecting the changed files while the diff is generated, instead of
+	// waiting for TarStart. Only read when a new diff is started. The files can't
+	// be skipped then, and files that turn out to be moved or copied are collected
+	// too. Hard links to files that are matched later are collected as well.
+	Collect bool
+}
+
+type GenerateDiffRes struct {
+	// Partial base directories that differ from the target, send each one's
+	// subtree in another request
+	Pending []string
+}
+
+type VerifyPackagesRes struct {
+	// Package managers whose databases were checked, e.g. "dpkg"
+	Sources []string
+}
+
+type DiffOverlayRes struct {
+	// Upper directory of the target's overlay root, as seen by the server
+	Upper string
+	// Lower directories, from top to bottom
+	Lowers []string
+}
+
+type TarStartReq struct {
+	// Added or modified files to leave out of the archive, e.g. known-good ones
+	Skip []string
 }
 
 type CollectFilesRes struct {
@@ -42,6 +76,17 @@ type ServerConfig struct {
 	Root string
 	// List of exclusions (relative to root)
 	Exclude []string
+	// Exclude rules, one per line, see fsdiff.Rule for the syntax
+	Rules []string
 	// Output path for CollectFiles
 	Output string
+	// Number of files to hash at once when generating the diff, 0 means one per CPU
+	Workers int
+	// Maximum number of files to read at once, 0 means the same as Workers
+	MaxIO int
+	// Digests to compute for added and modified files and list in the archive
+	// manifest, in addition to the primary one
+	Digests []fsdiff.HashAlgo
+	// Only hash files whose size, mode or modification time differ from the base
+	Fast bool
 }
@@ -0,0 +1,20 @@
+package tkserver
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bindernews/taki/pkg/fsdiff"
+)
+
+func GetInode(path string) (uint, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if ino, _, ok := fsdiff.FileInode(info); ok {
+		return uint(ino.Ino), nil
+	} else {
+		return 0, fmt.Errorf("failed to stat file '%s'", path)
+	}
+}
@@ -3,111 +3,374 @@ package tkserver
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
 	"sync/atomic"
 
+	"github.com/bindernews/taki/pkg/fsdiff"
 	"github.com/bindernews/taki/pkg/task"
 )
 
+// Highest progress reported by TarTask before it's done
+const TAR_PROGRESS_MAX = 0.99
+
+// Changes buffered by TarTask.Add before it blocks
+const tarQueueSize = 256
+
+// Error returned by TarTask.Add once the task stopped collecting
+var errTarStopped = errors.New("tar task has stopped")
+
+// Error returned by TarTask.Add once the list of changes ended
+var errTarEnded = errors.New("tar task has no more changes to collect")
+
+// Collects the contents of the changes into an archive as they're added, so the
+// diff doesn't need to be complete or held in memory. Tar reads the list of files
+// from a pipe, and only the files tar hasn't reached yet are kept.
 type TarTask struct {
 	*task.BaseTask
 	// Ouput tar file path
 	Output string
 	// Root of tar file contents
 	Root string
-	// List of file paths to collect (relative to Root)
-	Files []string
-	// Size of each file
-	FileSizes []int64
-	// Total size of all files to collect
+	// Extra digests to list in the manifest
+	Digests []fsdiff.HashAlgo
+	// Returns true if the file at 'fpath' starts a hard link group and was hashed
+	// and found unchanged, see fsdiff.DirMetaBuilder.MatchedLink. May be nil.
+	MatchedLink func(fpath string) bool
+	// Added or modified files to leave out of the archive, e.g. known-good ones.
+	// They're still triaged.
+	Skip map[string]bool
+	// Number of files triaged at once
+	Workers int
+	// Changes to collect
+	entries chan *fsdiff.DiffEntry
+	// Closed by Finish or Abort
+	ended chan struct{}
+	// Closed once the changes aren't read anymore
+	stopped  chan struct{}
+	endOnce  sync.Once
+	endErr   error
+	unhashed string
+	// Size of each listed file that tar hasn't reached yet
+	pending    map[string]int64
+	pendingLck sync.Mutex
+	// Total size of all files listed so far
 	totalBytes int64
 	// Bytes processed
-	currentBytes *int64
+	currentBytes int64
+	// ELF reports of the new files, by path, see ElfReport
+	elfs   map[string]*fsdiff.ElfReport
+	elfLck sync.Mutex
 	// tar process
 	proc *exec.Cmd
 }
 
-func (tt *TarTask) Run(ctx context.Context) task.Void {
-	var err error
-	var listFile *os.File
-	var rdRaw io.ReadCloser
-	tt.currentBytes = new(int64)
+func NewTarTask(output, root string) *TarTask {
+	return &TarTask{
+		BaseTask: task.NewBaseTask(),
+		Output:   output,
+		Root:     root,
+		entries:  make(chan *fsdiff.DiffEntry, tarQueueSize),
+		ended:    make(chan struct{}),
+		stopped:  make(chan struct{}),
+		pending:  make(map[string]int64),
+		elfs:     make(map[string]*fsdiff.ElfReport),
+	}
+}
 
-	// Sum all file sizes
-	tt.totalBytes = 0
-	for _, s := range tt.FileSizes {
-		tt.totalBytes += s
+// Adds a change of the diff. Its contents are collected if it's one of
+// fsdiff.FsDiff.GetAddedModified, and new ELF files are triaged like
+// fsdiff.FsDiff.TagElfs does. Blocks while tar is behind. Returns an error if the
+// task stopped, see Err.
+func (tt *TarTask) Add(e *fsdiff.DiffEntry) error {
+	select {
+	case <-tt.ended:
+		return errTarEnded
+	default:
+	}
+	select {
+	case tt.entries <- e:
+		return nil
+	case <-tt.stopped:
+		// Wait for the error that stopped it
+		<-tt.Done()
+		if err := tt.Err(); err != nil {
+			return err
+		}
+		return errTarStopped
 	}
+}
+
+// Ends the list of changes, so the archive can be completed. 'unhashedList' is the
+// path of the list of files which weren't hashed in fast mode, named UNHASHED_NAME.
+// It's added to the root of the archive if not empty.
+func (tt *TarTask) Finish(unhashedList string) {
+	tt.endOnce.Do(func() {
+		tt.unhashed = unhashedList
+		close(tt.ended)
+	})
+}
+
+// Ends the list of changes because the diff failed, which fails the task.
+func (tt *TarTask) Abort(err error) {
+	tt.endOnce.Do(func() {
+		tt.endErr = err
+		close(tt.ended)
+	})
+}
 
-	// Write list of all files to gather
-	if listFile, err = os.CreateTemp("", "tar-list-*"); err != nil {
+func (tt *TarTask) Run(ctx context.Context) task.Void {
+	if err := tt.collect(ctx); err != nil {
 		return tt.Fail(err)
 	}
-	listFilePath := listFile.Name()
-	defer os.Remove(listFilePath)
+	return tt.Ok(tt.Output)
+}
 
-	for _, file := range tt.Files {
-		if _, err = fmt.Fprintln(listFile, file); err != nil {
-			return tt.Fail(err)
-		}
+// Runs tar, listing the files of the changes as they're added, then the manifest.
+func (tt *TarTask) collect(ctx context.Context) (err error) {
+	defer close(tt.stopped)
+
+	// Write the manifest to its own directory so it can be added at the archive root
+	var manifestDir string
+	if manifestDir, err = os.MkdirTemp("", "taki-manifest-*"); err != nil {
+		return
 	}
-	if err = listFile.Close(); err != nil {
-		return tt.Fail(err)
+	defer os.RemoveAll(manifestDir)
+	var manifest *os.File
+	if manifest, err = os.Create(filepath.Join(manifestDir, MANIFEST_NAME)); err != nil {
+		return
+	}
+	defer manifest.Close()
+	manifestBuf := bufio.NewWriter(manifest)
+	var mw *manifestWriter
+	if mw, err = newManifestWriter(manifestBuf, tt.Digests); err != nil {
+		return
 	}
 
-	// Dtermine the arguments to tar
-	args := []string{"cvJf", tt.Output, "-C", tt.Root, "--from-file=" + listFilePath}
-	tt.proc = exec.CommandContext(ctx, "tar", args...)
+	// Tar reads the names from stdin, and the list ends with the manifest
+	tt.proc = exec.CommandContext(ctx, "tar", "cvJf", tt.Output, "-C", tt.Root, "-T", "-")
+	var list io.WriteCloser
+	var rdRaw io.ReadCloser
+	if list, err = tt.proc.StdinPipe(); err != nil {
+		return
+	}
 	// Setup the pipe so we can monitor progress
 	if rdRaw, err = tt.proc.StdoutPipe(); err != nil {
-		return tt.Fail(err)
+		return
 	}
-	rd := bufio.NewReader(rdRaw)
-	// Start tar
 	if err = tt.proc.Start(); err != nil {
-		return tt.Fail(err)
-	}
-	// Build size map while waiting for tar to do things
-	sizeMap := make(map[string]int64, len(tt.Files))
-	for i, name := range tt.Files {
-		sizeMap[name] = tt.FileSizes[i]
+		return
 	}
-	// Now update progress once each file is completed
-	var ln string
+	progressDone := make(chan struct{})
+	go func() {
+		defer close(progressDone)
+		tt.readProgress(rdRaw)
+	}()
+	elfs := newElfTriage(fsdiff.NewOsFS(tt.Root), tt.Workers)
+	defer elfs.wait()
+	defer func() {
+		if err != nil {
+			list.Close()
+			_ = tt.proc.Process.Kill()
+			<-progressDone
+			_ = tt.proc.Wait()
+		}
+	}()
+
 	for {
-		if ln, err = rd.ReadString('\n'); err != nil {
+		e, ok := tt.next()
+		if !ok {
 			break
 		}
-		// Determine size of added file and update progress
-		fSize := sizeMap[ln]
-		if fSize != 0 {
-			atomic.AddInt64(tt.currentBytes, fSize)
+		if e.MayBeElf() {
+			elfs.add(e.Path, tt.setElfReport)
 		}
+		if !e.IsAddedModified() || tt.Skip[e.Path] {
+			continue
+		}
+		if err = mw.write(e.Path, e.New); err != nil {
+			return
+		}
+		if tt.linkOnly(e.New) {
+			continue
+		}
+		if err = tt.list(list, e.Path, e.New.Size); err != nil {
+			return
+		}
+	}
+	if tt.endErr != nil {
+		return tt.endErr
+	}
+
+	if err = mw.flush(); err != nil {
+		return
+	}
+	if err = manifestBuf.Flush(); err != nil {
+		return
+	}
+	if err = manifest.Close(); err != nil {
+		return
 	}
-	// If EOF, close safely
-	if err == io.EOF {
-		// Update progress to "finished"
-		atomic.StoreInt64(tt.currentBytes, tt.totalBytes)
-		err = nil
-	} else {
-		// TODO close/kill process
-		_ = tt.proc.Process.Kill()
+	end := "--directory=" + manifestDir + "\n" + MANIFEST_NAME + "\n"
+	if tt.unhashed != "" {
+		end += "--directory=" + filepath.Dir(tt.unhashed) + "\n" + filepath.Base(tt.unhashed) + "\n"
 	}
-	if err != nil {
-		tt.Fail(err)
-	} else {
-		tt.Ok(tt.Output)
+	if _, err = io.WriteString(list, end); err != nil {
+		return
 	}
-	return nil
+	if err = list.Close(); err != nil {
+		return
+	}
+	<-progressDone
+	if err = tt.proc.Wait(); err != nil {
+		return fmt.Errorf("tar failed: %w", err)
+	}
+	atomic.StoreInt64(&tt.currentBytes, atomic.LoadInt64(&tt.totalBytes))
+	return
+}
+
+// Returns the next change, or false once the list ended and every change was read.
+func (tt *TarTask) next() (*fsdiff.DiffEntry, bool) {
+	select {
+	case e := <-tt.entries:
+		return e, true
+	case <-tt.ended:
+		select {
+		case e := <-tt.entries:
+			return e, true
+		default:
+			return nil, false
+		}
+	}
+}
+
+// Writes 'fpath' to the list tar reads, and counts it as pending. Names starting
+// with a dash would be read as options.
+func (tt *TarTask) list(w io.Writer, fpath string, size int64) error {
+	tt.pendingLck.Lock()
+	tt.pending[fpath] = size
+	tt.pendingLck.Unlock()
+	atomic.AddInt64(&tt.totalBytes, size)
+	line := fpath + "\n"
+	if strings.HasPrefix(fpath, "-") {
+		line = "--add-file=" + line
+	}
+	_, err := io.WriteString(w, line)
+	return err
+}
+
+// Updates the progress as tar prints the name of each file it archived.
+func (tt *TarTask) readProgress(r io.Reader) {
+	rd := bufio.NewReader(r)
+	for {
+		ln, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		name := strings.TrimSuffix(ln, "\n")
+		tt.pendingLck.Lock()
+		size, ok := tt.pending[name]
+		delete(tt.pending, name)
+		tt.pendingLck.Unlock()
+		if ok {
+			atomic.AddInt64(&tt.currentBytes, size)
+		}
+	}
+}
+
+// Returns true if the file is a hard link to a file that was hashed and found
+// unchanged. Those are only listed in the manifest, since their contents are in the
+// base. Any other target (excluded, unhashed in fast mode, or skipped) may have
+// changed, so the contents are collected. Hard links to collected files are stored
+// as links by tar itself.
+func (tt *TarTask) linkOnly(fm *fsdiff.FileMeta) bool {
+	return tt.MatchedLink != nil && fm != nil && fm.HardLink != "" && tt.MatchedLink(fm.HardLink)
+}
+
+func (tt *TarTask) setElfReport(fpath string, rep *fsdiff.ElfReport) {
+	tt.elfLck.Lock()
+	tt.elfs[fpath] = rep
+	tt.elfLck.Unlock()
+}
+
+// Waits for the triage of every change if the list of changes ended, see Finish.
+// Returns false if some changes may not be triaged, because more may be added or
+// the task failed.
+func (tt *TarTask) WaitTriage() bool {
+	select {
+	case <-tt.ended:
+	default:
+		return false
+	}
+	<-tt.Done()
+	return tt.Err() == nil
+}
+
+// Returns the ELF report of the new file at 'fpath', nil if it isn't an ELF file
+// or hasn't been triaged yet.
+func (tt *TarTask) ElfReport(fpath string) *fsdiff.ElfReport {
+	tt.elfLck.Lock()
+	defer tt.elfLck.Unlock()
+	return tt.elfs[fpath]
 }
 
 func (tt *TarTask) GetCurrentBytes() int64 {
-	return *tt.currentBytes
+	return atomic.LoadInt64(&tt.currentBytes)
 }
 
+// Returns the fraction of bytes collected so far. It stays below 1 until the task is
+// done, which includes the ELF triage, and the total grows as changes are added.
 func (tt *TarTask) GetProgress() float64 {
-	return float64(*tt.currentBytes) / float64(tt.totalBytes)
+	select {
+	case <-tt.Done():
+		return 1
+	default:
+	}
+	total := atomic.LoadInt64(&tt.totalBytes)
+	if total == 0 {
+		return 0
+	}
+	return math.Min(float64(atomic.LoadInt64(&tt.currentBytes))/float64(total), TAR_PROGRESS_MAX)
+}
+
+// Triages ELF files with a limited number at once, see fsdiff.AnalyzeElfFile. Files
+// that can't be read or parsed are left without a report.
+type elfTriage struct {
+	fsys fs.FS
+	sem  chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newElfTriage(fsys fs.FS, workers int) *elfTriage {
+	if workers < 1 {
+		workers = 1
+	}
+	return &elfTriage{fsys: fsys, sem: make(chan struct{}, workers)}
+}
+
+// Triages the file at 'fpath', calling fn with the report if it's an ELF file.
+func (t *elfTriage) add(fpath string, fn func(fpath string, rep *fsdiff.ElfReport)) {
+	t.sem <- struct{}{}
+	t.wg.Add(1)
+	go func() {
+		defer func() {
+			<-t.sem
+			t.wg.Done()
+		}()
+		if rep, _ := fsdiff.AnalyzeElfFile(t.fsys, fpath); rep != nil {
+			fn(fpath, rep)
+		}
+	}()
+}
+
+func (t *elfTriage) wait() {
+	t.wg.Wait()
 }
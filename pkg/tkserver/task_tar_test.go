@@ -0,0 +1,159 @@
+package tkserver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bindernews/taki/pkg/fsdiff"
+	"golang.org/x/exp/slices"
+)
+
+func TestLinkOnly(t *testing.T) {
+	tt := &TarTask{MatchedLink: func(fpath string) bool { return fpath == "bin/busybox" }}
+	metas := []*fsdiff.FileMeta{
+		{Name: "vi", HardLink: "bin/busybox"},
+		// The target was excluded, skipped or not hashed
+		{Name: "ed", HardLink: "bin/unknown"},
+		{Name: "ls"},
+		nil,
+	}
+	linkOnly := func() []bool {
+		got := make([]bool, len(metas))
+		for i, fm := range metas {
+			got[i] = tt.linkOnly(fm)
+		}
+		return got
+	}
+	if got, want := linkOnly(), []bool{true, false, false, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, expected %v", got, want)
+	}
+	tt.MatchedLink = nil
+	if got, want := linkOnly(), []bool{false, false, false, false}; !reflect.DeepEqual(got, want) {
+		t.Errorf("without MatchedLink got %v, expected %v", got, want)
+	}
+}
+
+func TestTarTask(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar is not installed")
+	}
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	files := map[string]string{"etc/new.conf": "new", "bin/-rf": "dash", "etc/known": "good", "etc/same": "same"}
+	entries := []*fsdiff.DiffEntry{}
+	for fpath, data := range files {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(fpath)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, fpath), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		kind := fsdiff.Added
+		if fpath == "etc/same" {
+			kind = fsdiff.MetaModified
+		}
+		fm := &fsdiff.FileMeta{Name: filepath.Base(fpath), Mode: 0644, Size: int64(len(data))}
+		entries = append(entries, &fsdiff.DiffEntry{Path: fpath, Kind: kind, New: fm})
+	}
+	unhashed := filepath.Join(dir, "list", UNHASHED_NAME)
+	if err := os.MkdirAll(filepath.Dir(unhashed), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(unhashed, []byte("etc/same\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := NewTarTask(filepath.Join(dir, "out.tar.xz"), root)
+	tt.Skip = map[string]bool{"etc/known": true}
+	go tt.Run(context.Background())
+	for _, e := range entries {
+		if err := tt.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tt.WaitTriage() {
+		t.Error("triage can't be complete before Finish")
+	}
+	tt.Finish(unhashed)
+	if !tt.WaitTriage() {
+		t.Error("triage should be complete after Finish")
+	}
+	<-tt.Done()
+	if err := tt.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if p := tt.GetProgress(); p != 1 {
+		t.Errorf("progress is %v once done", p)
+	}
+
+	out, err := exec.Command("tar", "tJf", tt.Output).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Fields(string(out))
+	slices.Sort(got)
+	want := []string{"bin/-rf", "etc/new.conf", MANIFEST_NAME, UNHASHED_NAME}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("archived %v, expected %v", got, want)
+	}
+
+	if err := tt.Add(entries[0]); err == nil {
+		t.Error("expected an error adding after Finish")
+	}
+
+	// Aborting fails the task with the error
+	tt = NewTarTask(filepath.Join(dir, "aborted.tar.xz"), root)
+	go tt.Run(context.Background())
+	if err := tt.Add(entries[0]); err != nil {
+		t.Fatal(err)
+	}
+	tt.Abort(errors.New("diff failed"))
+	<-tt.Done()
+	if err := tt.Err(); err == nil || err.Error() != "diff failed" {
+		t.Errorf("got error %v after aborting", err)
+	}
+	if err := tt.Add(entries[1]); err == nil {
+		t.Error("expected an error adding after Abort")
+	}
+}
+
+func TestDiffSpill(t *testing.T) {
+	spill, err := newDiffSpill()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spill.remove()
+	entries := []*fsdiff.DiffEntry{
+		{Path: "etc/passwd", Kind: fsdiff.Modified, Old: &fsdiff.FileMeta{Name: "passwd", Size: 1}, New: &fsdiff.FileMeta{Name: "passwd", Size: 2}},
+		{Path: "tmp", Kind: fsdiff.Removed, Old: &fsdiff.FileMeta{Name: "tmp", Mode: os.ModeDir | 0755}},
+		{Path: "usr/bin/tool", Kind: fsdiff.Added, New: &fsdiff.FileMeta{Name: "tool", Size: 3}},
+	}
+	for _, e := range entries[:2] {
+		if err := spill.add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err := spill.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.Entries, entries[:2]) || !reflect.DeepEqual(d.RemovedDirs, []string{"tmp"}) {
+		t.Errorf("got %+v", d)
+	}
+	// Adding after reading continues the same stream
+	if err := spill.add(entries[2]); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = spill.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.Entries, entries) || !reflect.DeepEqual(d.Added, []string{"usr/bin/tool"}) {
+		t.Errorf("got %+v after adding more", d)
+	}
+}